@@ -0,0 +1,133 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package clockz provides a Clock abstraction over the time package, so code which uses timers can be
+// tested deterministically, by giving it a FakeClock in place of the real clock.
+package clockz
+
+import (
+	"context"
+	"time"
+)
+
+// A Clock provides the current time and timers
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// Since returns the time elapsed since t
+	Since(t time.Time) time.Duration
+
+	// Until returns the duration until t
+	Until(t time.Time) time.Duration
+
+	// NewTimer creates a Timer which sends the current time on its channel after at least d has elapsed
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc waits for d to elapse, then calls f in its own goroutine. The returned Timer has no
+	// channel, and can be used to cancel the call with Stop
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// Sleep pauses the calling goroutine for at least d
+	Sleep(d time.Duration)
+}
+
+// A Timer is a single event, created by Clock.NewTimer or Clock.AfterFunc
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires. It is nil for AfterFunc timers
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. Returns false if the timer had already fired or been stopped
+	Stop() bool
+
+	// Reset changes the timer to fire after d. Returns true if the timer was active. As with time.Timer
+	// from Go 1.23, no stale value is received from the channel after a Reset
+	Reset(d time.Duration) bool
+}
+
+// Real returns a Clock backed by the time package
+func Real() Clock {
+	return realClock{}
+}
+
+// OrReal returns the given clock, or the real clock if the given clock is nil. It is useful for types
+// which take an optional clock in their config
+func OrReal(clock Clock) Clock {
+	if clock == nil {
+		return Real()
+	}
+	return clock
+}
+
+// WithTimeout works like context.WithTimeout, but times out using the given clock. The context's error
+// is context.DeadlineExceeded once the timeout elapses
+func WithTimeout(ctx context.Context, clock Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	result, cancel := context.WithCancelCause(ctx)
+	timer := clock.AfterFunc(timeout, func() {
+		cancel(context.DeadlineExceeded)
+	})
+	return &timeoutContext{Context: result}, func() {
+		timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// timeoutContext reports the cause as its error, so a timeout looks like context.DeadlineExceeded, as it
+// would from context.WithTimeout
+type timeoutContext struct {
+	context.Context
+}
+
+func (self *timeoutContext) Err() error {
+	if self.Context.Err() == nil {
+		return nil
+	}
+	return context.Cause(self.Context)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) Until(t time.Time) time.Duration {
+	return time.Until(t)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{Timer: time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{Timer: time.AfterFunc(d, f)}
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (self realTimer) C() <-chan time.Time {
+	return self.Timer.C
+}
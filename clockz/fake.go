@@ -0,0 +1,222 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package clockz
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A FakeClock is a Clock whose time only moves when Advance or Set is called. Timers fire, in due time
+// order, as the clock moves past them. AfterFunc calls are made in their own goroutines, as they are
+// by the real clock.
+//
+// Code under test usually creates its timers from other goroutines, so tests should wait for the
+// expected timers to exist, using AwaitTimers, before advancing the clock.
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{}
+}
+
+// NewFakeClock returns a FakeClock set to the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:     now,
+		changed: make(chan struct{}),
+	}
+}
+
+func (self *FakeClock) Now() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.now
+}
+
+func (self *FakeClock) Since(t time.Time) time.Duration {
+	return self.Now().Sub(t)
+}
+
+func (self *FakeClock) Until(t time.Time) time.Duration {
+	return t.Sub(self.Now())
+}
+
+func (self *FakeClock) NewTimer(d time.Duration) Timer {
+	timer := &fakeTimer{
+		clock: self,
+		c:     make(chan time.Time, 1),
+	}
+	self.schedule(timer, d)
+	return timer
+}
+
+func (self *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	timer := &fakeTimer{
+		clock: self,
+		f:     f,
+	}
+	self.schedule(timer, d)
+	return timer
+}
+
+// Sleep blocks until the clock has been advanced by at least d
+func (self *FakeClock) Sleep(d time.Duration) {
+	<-self.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing any timers which come due
+func (self *FakeClock) Advance(d time.Duration) {
+	self.Set(self.Now().Add(d))
+}
+
+// Set moves the clock to the given time, firing any timers which come due. Moving the clock backwards
+// doesn't fire any timers
+func (self *FakeClock) Set(t time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for len(self.timers) > 0 && !self.timers[0].due.After(t) {
+		timer := self.timers[0]
+		self.removeLocked(timer)
+		self.now = timer.due
+		timer.fire(self.now)
+	}
+	self.now = t
+}
+
+// TimerCount returns the number of timers which haven't yet fired or been stopped
+func (self *FakeClock) TimerCount() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.timers)
+}
+
+// AwaitTimers waits, in real time, until at least count timers are pending, returning an error if that
+// doesn't happen before the timeout elapses
+func (self *FakeClock) AwaitTimers(count int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		self.lock.Lock()
+		current := len(self.timers)
+		changed := self.changed
+		self.lock.Unlock()
+
+		if current >= count {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out waiting for %v timers, %v pending", count, current)
+		}
+	}
+}
+
+func (self *FakeClock) schedule(timer *fakeTimer, d time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.scheduleLocked(timer, d)
+}
+
+func (self *FakeClock) scheduleLocked(timer *fakeTimer, d time.Duration) {
+	timer.due = self.now.Add(d)
+	timer.active = true
+
+	// keep the timers ordered by due time, with timers due at the same time in the order they were set
+	idx := sort.Search(len(self.timers), func(i int) bool {
+		return self.timers[i].due.After(timer.due)
+	})
+	self.timers = append(self.timers, nil)
+	copy(self.timers[idx+1:], self.timers[idx:])
+	self.timers[idx] = timer
+
+	self.notifyChangedLocked()
+}
+
+func (self *FakeClock) removeLocked(timer *fakeTimer) bool {
+	if !timer.active {
+		return false
+	}
+	timer.active = false
+	for i, current := range self.timers {
+		if current == timer {
+			self.timers = append(self.timers[:i], self.timers[i+1:]...)
+			break
+		}
+	}
+	self.notifyChangedLocked()
+	return true
+}
+
+func (self *FakeClock) notifyChangedLocked() {
+	close(self.changed)
+	self.changed = make(chan struct{})
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+	f     func()
+	// due and active are guarded by the clock's lock
+	due    time.Time
+	active bool
+}
+
+func (self *fakeTimer) C() <-chan time.Time {
+	return self.c
+}
+
+func (self *fakeTimer) Stop() bool {
+	self.clock.lock.Lock()
+	defer self.clock.lock.Unlock()
+	return self.clock.removeLocked(self)
+}
+
+func (self *fakeTimer) Reset(d time.Duration) bool {
+	self.clock.lock.Lock()
+	defer self.clock.lock.Unlock()
+
+	wasActive := self.clock.removeLocked(self)
+	if self.c != nil {
+		// discard a value sent before the reset, matching time.Timer
+		select {
+		case <-self.c:
+		default:
+		}
+	}
+	self.clock.scheduleLocked(self, d)
+	return wasActive
+}
+
+// fire is called with the clock's lock held, once the timer has been removed from the clock
+func (self *fakeTimer) fire(now time.Time) {
+	if self.f != nil {
+		go self.f()
+		return
+	}
+
+	select {
+	case self.c <- now:
+	default:
+	}
+}
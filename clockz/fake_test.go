@@ -0,0 +1,171 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package clockz
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireFired(t *testing.T, timer Timer) time.Time {
+	select {
+	case val := <-timer.C():
+		return val
+	default:
+		require.FailNow(t, "timer should have fired")
+		return time.Time{}
+	}
+}
+
+func requireNotFired(t *testing.T, timer Timer) {
+	select {
+	case <-timer.C():
+		require.FailNow(t, "timer should not have fired")
+	default:
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("only moves when advanced", func(t *testing.T) {
+		req := require.New(t)
+		clock := NewFakeClock(start)
+		req.Equal(start, clock.Now())
+
+		clock.Advance(time.Minute)
+		req.Equal(start.Add(time.Minute), clock.Now())
+		req.Equal(time.Minute, clock.Since(start))
+		req.Equal(time.Minute, clock.Until(start.Add(2*time.Minute)))
+	})
+
+	t.Run("fires timers as they come due", func(t *testing.T) {
+		req := require.New(t)
+		clock := NewFakeClock(start)
+
+		first := clock.NewTimer(time.Second)
+		second := clock.NewTimer(2 * time.Second)
+		req.Equal(2, clock.TimerCount())
+
+		clock.Advance(time.Second - time.Nanosecond)
+		requireNotFired(t, first)
+
+		clock.Advance(3 * time.Second)
+		req.Equal(start.Add(time.Second), requireFired(t, first))
+		req.Equal(start.Add(2*time.Second), requireFired(t, second))
+		req.Equal(0, clock.TimerCount())
+		req.False(first.Stop())
+	})
+
+	t.Run("stops and resets timers", func(t *testing.T) {
+		req := require.New(t)
+		clock := NewFakeClock(start)
+
+		timer := clock.NewTimer(time.Second)
+		req.True(timer.Stop())
+		req.False(timer.Stop())
+		clock.Advance(time.Second)
+		requireNotFired(t, timer)
+
+		req.False(timer.Reset(time.Second))
+		clock.Advance(time.Second)
+
+		// a reset discards a value which was never received
+		req.False(timer.Reset(time.Second))
+		requireNotFired(t, timer)
+
+		req.True(timer.Reset(2 * time.Second))
+		clock.Advance(time.Second)
+		requireNotFired(t, timer)
+		clock.Advance(time.Second)
+		requireFired(t, timer)
+	})
+
+	t.Run("runs after funcs in their own goroutines", func(t *testing.T) {
+		req := require.New(t)
+		clock := NewFakeClock(start)
+
+		called := make(chan struct{})
+		clock.AfterFunc(time.Second, func() {
+			// the clock isn't locked during the call
+			clock.NewTimer(time.Second)
+			close(called)
+		})
+		cancelled := clock.AfterFunc(time.Second, func() {
+			req.Fail("stopped func should not be called")
+		})
+		req.True(cancelled.Stop())
+		req.Nil(cancelled.C())
+
+		clock.Advance(time.Second)
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			req.FailNow("func should have been called")
+		}
+	})
+
+	t.Run("waits for timers and sleepers", func(t *testing.T) {
+		req := require.New(t)
+		clock := NewFakeClock(start)
+
+		woke := make(chan struct{})
+		go func() {
+			clock.Sleep(time.Minute)
+			close(woke)
+		}()
+
+		req.NoError(clock.AwaitTimers(1, time.Second))
+		clock.Advance(time.Minute)
+		select {
+		case <-woke:
+		case <-time.After(time.Second):
+			req.FailNow("sleeper should have woken")
+		}
+
+		req.Error(clock.AwaitTimers(1, 10*time.Millisecond))
+	})
+
+	t.Run("times out contexts", func(t *testing.T) {
+		req := require.New(t)
+		clock := NewFakeClock(start)
+
+		ctx, cancel := WithTimeout(context.Background(), clock, time.Minute)
+		defer cancel()
+		req.NoError(ctx.Err())
+
+		clock.Advance(time.Minute)
+		<-ctx.Done()
+		req.ErrorIs(ctx.Err(), context.DeadlineExceeded)
+
+		ctx, cancel = WithTimeout(context.Background(), clock, time.Minute)
+		cancel()
+		req.ErrorIs(ctx.Err(), context.Canceled)
+		req.Equal(0, clock.TimerCount())
+	})
+}
+
+func TestOrReal(t *testing.T) {
+	req := require.New(t)
+	req.Equal(Real(), OrReal(nil))
+
+	clock := NewFakeClock(time.Now())
+	req.Same(clock, OrReal(clock))
+}
@@ -0,0 +1,82 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package debugz
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var dumpSources = struct {
+	sync.Mutex
+	m map[string]func(io.Writer)
+}{m: map[string]func(io.Writer){}}
+
+// AddDebugDumpSource registers a function which writes the diagnostic state of some component, to be
+// included in GenerateDebugDump. Registering a source with an existing name replaces it. This lets
+// packages which debugz can't depend on, such as goroutines, contribute to the dump.
+func AddDebugDumpSource(name string, source func(w io.Writer)) {
+	dumpSources.Lock()
+	defer dumpSources.Unlock()
+	dumpSources.m[name] = source
+}
+
+// RemoveDebugDumpSource removes the source registered with the given name, if there is one
+func RemoveDebugDumpSource(name string) {
+	dumpSources.Lock()
+	defer dumpSources.Unlock()
+	delete(dumpSources.m, name)
+}
+
+// GenerateDebugDump returns the output of every registered dump source, in name order, followed by
+// the stacks of all goroutines
+func GenerateDebugDump() string {
+	dumpSources.Lock()
+	names := make([]string, 0, len(dumpSources.m))
+	sources := make(map[string]func(io.Writer), len(dumpSources.m))
+	for name, source := range dumpSources.m {
+		names = append(names, name)
+		sources[name] = source
+	}
+	dumpSources.Unlock()
+
+	sort.Strings(names)
+
+	// sources are called without the lock held, so a source may itself add or remove sources
+	builder := &strings.Builder{}
+	for _, name := range names {
+		_, _ = fmt.Fprintf(builder, "=== %v ===\n", name)
+		sources[name](builder)
+		builder.WriteString("\n")
+	}
+
+	builder.WriteString("=== goroutines ===\n")
+	builder.WriteString(GenerateStack())
+	return builder.String()
+}
+
+func DumpDebug() {
+	fmt.Println(GenerateDebugDump())
+}
+
+func DumpDebugToFile(fileName string) error {
+	return os.WriteFile(fileName, []byte(GenerateDebugDump()), 0644)
+}
@@ -261,6 +261,14 @@ func NewUnauthorizedSecondaryExtTokenInvalid(extJwtIds, issuers []string) *ApiEr
 	}
 }
 
+func NewTooManyRequests() *ApiError {
+	return &ApiError{
+		AppCode: ServerTooManyRequestsCode,
+		Message: ServerTooManyRequestsMessage,
+		Status:  ServerTooManyRequestsStatus,
+	}
+}
+
 func NewInvalidFilter(cause error) *ApiError {
 	return &ApiError{
 		AppCode:     InvalidFilterCode,
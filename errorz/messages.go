@@ -30,6 +30,10 @@ const (
 	UnauthorizedCode    string = "UNAUTHORIZED"
 	UnauthorizedMessage string = "The request could not be completed. The session is not authorized or the credentials are invalid"
 	UnauthorizedStatus  int    = http.StatusUnauthorized
+
+	ServerTooManyRequestsCode    string = "SERVER_TOO_MANY_REQUESTS"
+	ServerTooManyRequestsMessage string = "Too many requests have been issued. Please slow your request rate or try again later"
+	ServerTooManyRequestsStatus  int    = http.StatusTooManyRequests
 )
 
 // specific
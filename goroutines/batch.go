@@ -0,0 +1,214 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/debugz"
+	"github.com/pkg/errors"
+)
+
+// BatchMode determines what BatchPool.QueueBatch does when not all of a batch fits in the queue
+type BatchMode uint8
+
+const (
+	// BatchAllOrNothing queues every item of a batch, or none of them
+	BatchAllOrNothing BatchMode = iota
+	// BatchBestEffort queues the items of a batch in order, until the queue is full
+	BatchBestEffort
+)
+
+func (self BatchMode) validate() error {
+	if self > BatchBestEffort {
+		return fmt.Errorf("invalid batch mode %v", self)
+	}
+	return nil
+}
+
+// workBatch gates the items of an all-or-nothing batch spread across the shards of a sharded pool. The
+// shards are filled one at a time, so if they fill part way through a batch, the items already queued
+// are abandoned. A worker which
+// takes an item before the batch is decided waits for the decision, which the submitter makes without
+// blocking
+type workBatch struct {
+	decided  chan struct{}
+	accepted atomic.Bool
+}
+
+func newWorkBatch() *workBatch {
+	return &workBatch{
+		decided: make(chan struct{}),
+	}
+}
+
+func (self *workBatch) decide(accepted bool) {
+	self.accepted.Store(accepted)
+	close(self.decided)
+}
+
+// shouldRun returns true if the item's batch was accepted. Items which aren't part of a batch always run
+func (self *workBatch) shouldRun() bool {
+	if self == nil {
+		return true
+	}
+	<-self.decided
+	return self.accepted.Load()
+}
+
+// workGroup holds the items of a batch which is queued as a single entry. Workers claim the items one
+// at a time, so several workers can share the batch
+type workGroup struct {
+	items    []func()
+	queuedAt time.Time
+	next     atomic.Int32
+	// true while the group is on the queue, so that it is only on the queue once at a time
+	queued atomic.Bool
+}
+
+func newWorkGroup(items []func(), queuedAt time.Time) *workGroup {
+	result := &workGroup{
+		items:    items,
+		queuedAt: queuedAt,
+	}
+	result.queued.Store(true)
+	return result
+}
+
+// claim takes the next item, returning false if every item has been claimed. last is true if the
+// returned item was the final one
+func (self *workGroup) claim() (item func(), last bool, ok bool) {
+	for {
+		next := self.next.Load()
+		if int(next) >= len(self.items) {
+			return nil, false, false
+		}
+		if self.next.CompareAndSwap(next, next+1) {
+			return self.items[next], int(next) == len(self.items)-1, true
+		}
+	}
+}
+
+func (self *workGroup) remaining() int {
+	return len(self.items) - int(self.next.Load())
+}
+
+// BatchError is returned by RunAll when any work item fails, can't be queued or panics
+type BatchError struct {
+	// The error for each work item, in the same order as the work. Items which succeeded have a nil error
+	Errors []error
+}
+
+func (self *BatchError) Error() string {
+	var first error
+	failed := 0
+	for _, err := range self.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%v of %v work items failed, first error: %v", failed, len(self.Errors), first)
+}
+
+// Unwrap returns the errors of the failed work items, so errors.Is and errors.As can see through them
+func (self *BatchError) Unwrap() []error {
+	var result []error
+	for _, err := range self.Errors {
+		if err != nil {
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+// RunAll runs each work item on the pool and waits for them all to complete. If the pool is a BatchPool,
+// as much work as fits is queued as a batch, and the rest is queued one item at a time, waiting for
+// queue space. If any work returns an error, panics, or doesn't run because the pool has stopped, a
+// *BatchError is returned. A panic is recovered by RunAll, so it is not passed to the pool's
+// PanicHandler, and is reported as a *PanicError.
+func RunAll(pool Pool, work []func() error) error {
+	errs := make([]error, len(work))
+	wrapped := make([]func(), len(work))
+
+	// each item is completed exactly once, by running it, failing to queue it, or abandoning it
+	completed := make([]atomic.Bool, len(work))
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(len(work))
+
+	for i, f := range work {
+		wrapped[i] = func() {
+			if !completed[i].CompareAndSwap(false, true) {
+				return
+			}
+			defer waitGroup.Done()
+			defer func() {
+				if val := recover(); val != nil {
+					errs[i] = &PanicError{
+						Value: val,
+						Stack: debugz.GenerateLocalStack(),
+					}
+				}
+			}()
+			errs[i] = f()
+		}
+	}
+
+	// queued work which hasn't started by the time the pool stops never will
+	if stop := stopContextOf(pool); stop != nil {
+		unwatch := context.AfterFunc(stop, func() {
+			for i := range completed {
+				if completed[i].CompareAndSwap(false, true) {
+					errs[i] = errors.Wrap(PoolStoppedError, "work abandoned")
+					waitGroup.Done()
+				}
+			}
+		})
+		defer unwatch()
+	}
+
+	var queued int
+	var err error
+	if batchPool, ok := pool.(BatchPool); ok {
+		queued, err = batchPool.QueueBatch(wrapped, BatchBestEffort)
+	}
+	for i := queued; i < len(wrapped); i++ {
+		if err == nil || errors.Is(err, QueueFullError) {
+			err = pool.Queue(wrapped[i])
+		}
+		if err != nil && completed[i].CompareAndSwap(false, true) {
+			errs[i] = err
+			waitGroup.Done()
+		}
+	}
+
+	waitGroup.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueBatch(t *testing.T) {
+	newPools := map[string]func(config PoolConfig) (fullPool, error){
+		"pool": newFullPool,
+		"sharded": func(config PoolConfig) (fullPool, error) {
+			return NewShardedPool(config)
+		},
+	}
+
+	for name, newPool := range newPools {
+		t.Run(name, func(t *testing.T) {
+			// newBlockedPool returns a pool with a single worker, which is kept busy until release is closed,
+			// so that batches only go to the queue
+			newBlockedPool := func(t *testing.T) (fullPool, chan struct{}) {
+				p, err := newPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+				require.NoError(t, err)
+				t.Cleanup(p.Shutdown)
+
+				release := make(chan struct{})
+				started := make(chan struct{})
+				require.NoError(t, p.Queue(func() {
+					close(started)
+					<-release
+				}))
+				requireClosed(t, started, "blocking work should have started")
+				return p, release
+			}
+
+			newBatch := func(size int, counter *atomic.Int32) []func() {
+				var result []func()
+				for i := 0; i < size; i++ {
+					result = append(result, func() { counter.Add(1) })
+				}
+				return result
+			}
+
+			t.Run("best effort queues what fits", func(t *testing.T) {
+				req := require.New(t)
+				p, release := newBlockedPool(t)
+
+				var ran atomic.Int32
+				accepted, err := p.QueueBatch(newBatch(6, &ran), BatchBestEffort)
+				req.ErrorIs(err, QueueFullError)
+				req.Equal(4, accepted)
+				req.Equal(uint32(4), p.GetQueueSize())
+				req.Equal(uint32(5), p.GetOutstanding())
+				if impl, ok := p.(*pool); ok {
+					req.Len(impl.queues[PriorityNormal], 1, "the batch should be queued as a single entry")
+				}
+
+				close(release)
+				req.NoError(p.AwaitIdle(time.Second))
+				req.Equal(int32(4), ran.Load())
+				req.Equal(uint64(1), p.Stats().RejectedQueueFull)
+			})
+
+			t.Run("all or nothing queues nothing if the batch doesn't fit", func(t *testing.T) {
+				req := require.New(t)
+				p, release := newBlockedPool(t)
+
+				var ran atomic.Int32
+				accepted, err := p.QueueBatch(newBatch(6, &ran), BatchAllOrNothing)
+				req.ErrorIs(err, QueueFullError)
+				req.Equal(0, accepted)
+				req.Equal(uint32(0), p.GetQueueSize(), "a batch which clearly won't fit shouldn't be partly queued")
+
+				close(release)
+				req.NoError(p.AwaitIdle(time.Second))
+				req.Equal(int32(0), ran.Load())
+
+				accepted, err = p.QueueBatch(newBatch(4, &ran), BatchAllOrNothing)
+				req.NoError(err)
+				req.Equal(4, accepted)
+				req.NoError(p.AwaitIdle(time.Second))
+				req.Equal(int32(4), ran.Load())
+			})
+
+			t.Run("drain doesn't return items of rejected batches", func(t *testing.T) {
+				req := require.New(t)
+				p, release := newBlockedPool(t)
+				defer close(release)
+
+				// a sharded pool's batch can only be partly queued when it loses a race for queue
+				// space, so the rejected item is queued directly. NewPool's pool queues a batch as a
+				// single entry, so never partly queues one
+				if impl, ok := p.(*shardedPool); ok {
+					rejected := newWorkBatch()
+					rejected.decide(false)
+					req.True(impl.shards[0].push(PriorityNormal, shardWork{work: func() {}, batch: rejected}))
+				}
+
+				var ran atomic.Int32
+				accepted, err := p.QueueBatch(newBatch(2, &ran), BatchAllOrNothing)
+				req.NoError(err)
+				req.Equal(2, accepted)
+
+				abandoned, err := p.Drain(time.Millisecond)
+				req.ErrorIs(err, TimeoutError)
+				req.Len(abandoned, 2, "only the accepted batch's items should be returned")
+				req.Equal(uint32(1), p.GetOutstanding(), "only the blocking work should be outstanding")
+			})
+
+			t.Run("workers share a batch", func(t *testing.T) {
+				req := require.New(t)
+				p, err := newPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second})
+				req.NoError(err)
+				defer p.Shutdown()
+
+				// each item waits for the other to start, so the batch only completes if two workers run it
+				var started sync.WaitGroup
+				started.Add(2)
+				bothStarted := make(chan struct{})
+				go func() {
+					started.Wait()
+					close(bothStarted)
+				}()
+				item := func() {
+					started.Done()
+					<-bothStarted
+				}
+
+				accepted, err := p.QueueBatch([]func(){item, item}, BatchAllOrNothing)
+				req.NoError(err)
+				req.Equal(2, accepted)
+				requireClosed(t, bothStarted, "both items of the batch should run at once")
+				req.NoError(p.AwaitIdle(time.Second))
+			})
+
+			t.Run("rejects bad batches", func(t *testing.T) {
+				req := require.New(t)
+				p, release := newBlockedPool(t)
+				close(release)
+
+				accepted, err := p.QueueBatch(nil, BatchAllOrNothing)
+				req.NoError(err)
+				req.Equal(0, accepted)
+
+				_, err = p.QueueBatch([]func(){func() {}}, BatchMode(10))
+				req.Error(err)
+
+				p.Shutdown()
+				_, err = p.QueueBatch([]func(){func() {}}, BatchBestEffort)
+				req.ErrorIs(err, PoolStoppedError)
+			})
+
+			t.Run("run all waits for work and collects errors", func(t *testing.T) {
+				req := require.New(t)
+				p, err := newPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second})
+				req.NoError(err)
+				defer p.Shutdown()
+
+				var ran atomic.Int32
+				var work []func() error
+				for i := 0; i < 100; i++ {
+					work = append(work, func() error {
+						ran.Add(1)
+						return nil
+					})
+				}
+				req.NoError(RunAll(p, work))
+				req.Equal(int32(100), ran.Load())
+
+				// a Pool which isn't a BatchPool has its work queued one item at a time
+				req.NoError(RunAll(struct{ Pool }{p}, work))
+				req.Equal(int32(200), ran.Load())
+
+				failure := errors.New("failed")
+				err = RunAll(p, []func() error{
+					func() error { return nil },
+					func() error { return failure },
+					func() error { panic("boom") },
+				})
+
+				var batchErr *BatchError
+				req.ErrorAs(err, &batchErr)
+				req.Len(batchErr.Errors, 3)
+				req.NoError(batchErr.Errors[0])
+				req.ErrorIs(batchErr.Errors[1], failure)
+				var panicErr *PanicError
+				req.ErrorAs(batchErr.Errors[2], &panicErr)
+				req.Equal("boom", panicErr.Value)
+				req.ErrorIs(err, failure)
+				req.Equal(uint64(0), p.Stats().Panics, "RunAll should recover panics itself")
+
+				p.Shutdown()
+				err = RunAll(p, []func() error{func() error { return nil }})
+				req.ErrorIs(err, PoolStoppedError)
+			})
+
+			t.Run("run all returns when shutdown abandons its work", func(t *testing.T) {
+				req := require.New(t)
+				p, release := newBlockedPool(t)
+				defer close(release)
+
+				var ran atomic.Int32
+				work := []func() error{}
+				for i := 0; i < 3; i++ {
+					work = append(work, func() error {
+						ran.Add(1)
+						return nil
+					})
+				}
+
+				result := make(chan error, 1)
+				go func() {
+					result <- RunAll(p, work)
+				}()
+
+				req.Eventually(func() bool {
+					return p.GetQueueSize() == 3
+				}, time.Second, time.Millisecond)
+				p.Shutdown()
+
+				var err error
+				select {
+				case err = <-result:
+				case <-time.After(time.Second):
+					req.FailNow("RunAll should return once the pool stops")
+				}
+
+				var batchErr *BatchError
+				req.ErrorAs(err, &batchErr)
+				req.Len(batchErr.Errors, 3)
+				for _, itemErr := range batchErr.Errors {
+					req.ErrorIs(itemErr, PoolStoppedError)
+				}
+				req.Equal(int32(0), ran.Load())
+			})
+		})
+	}
+}
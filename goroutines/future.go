@@ -0,0 +1,241 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/openziti/foundation/v2/debugz"
+	"github.com/pkg/errors"
+)
+
+// PanicError is the error a Future returns when the submitted work panics. The panic is recovered
+// by the Future, so it is not passed to the pool's PanicHandler.
+type PanicError struct {
+	// The value passed to panic
+	Value interface{}
+	// The stack of the goroutine which panicked, captured at the point of recovery
+	Stack string
+}
+
+func (self *PanicError) Error() string {
+	return fmt.Sprintf("panic during pool work (%+v)", self.Value)
+}
+
+// Unwrap returns the panic value if it is an error, so errors.Is and errors.As can see through it
+func (self *PanicError) Unwrap() error {
+	if err, ok := self.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// A Future provides access to the result of work submitted to a Pool using Submit
+type Future[T any] interface {
+	// Done returns a channel which is closed once the result is available
+	Done() <-chan struct{}
+
+	// Wait blocks until the result is available and returns it. If the work could not be submitted,
+	// the submission error is returned. If the work panicked, a *PanicError is returned
+	Wait() (T, error)
+
+	// WaitWithTimeout works like Wait, but returns TimeoutError if the result isn't available before
+	// the timeout elapses, as measured by the pool's clock. The work is not cancelled and the Future may
+	// be waited on again
+	WaitWithTimeout(timeout time.Duration) (T, error)
+
+	// WaitCtx works like Wait, but returns the context's error if the context is done before the
+	// result is available. The work is not cancelled and the Future may be waited on again
+	WaitCtx(ctx context.Context) (T, error)
+}
+
+// Submit queues work on the given pool, returning a Future which will hold the work's result. If the
+// work can't be queued, the returned Future is already complete, with the error from Pool.Queue. If
+// the pool is one of this package's and it shuts down before the work starts, the work won't run and
+// the Future completes with PoolStoppedError. This includes work handed back by Drain, which becomes
+// a no-op.
+func Submit[T any](pool Pool, work func() (T, error)) Future[T] {
+	result := newFuture[T](pool)
+	if err := pool.Queue(result.run(work)); err != nil {
+		result.abandon(err)
+	}
+	return result
+}
+
+// SubmitCtx works like Submit, but queues the work with ContextPool.QueueCtx, passing it the given
+// context. If the context is done before the work starts, the work won't run and the Future
+// completes with the context's error.
+func SubmitCtx[T any](pool ContextPool, ctx context.Context, work func(ctx context.Context) (T, error)) Future[T] {
+	result := newFuture[T](pool)
+	result.watch(ctx, func() error { return ctx.Err() })
+	err := pool.QueueCtx(ctx, func(ctx context.Context) {
+		if err := ctx.Err(); err != nil {
+			result.abandon(err)
+			return
+		}
+		result.run(func() (T, error) { return work(ctx) })()
+	})
+	if err != nil {
+		result.abandon(err)
+	}
+	return result
+}
+
+// clockOf returns the clock the given pool uses, or the real clock for pools which don't expose one
+func clockOf(pool Pool) clockz.Clock {
+	if clocked, ok := pool.(interface{ getClock() clockz.Clock }); ok {
+		return clocked.getClock()
+	}
+	return clockz.Real()
+}
+
+// stopContextOf returns a context which is cancelled once the given pool stops, or nil for pools which
+// don't provide one
+func stopContextOf(pool Pool) context.Context {
+	if stoppable, ok := pool.(interface{ getStopContext() context.Context }); ok {
+		return stoppable.getStopContext()
+	}
+	return nil
+}
+
+const (
+	futurePending int32 = iota
+	futureStarted
+	futureAbandoned
+)
+
+type future[T any] struct {
+	clock  clockz.Clock
+	state  atomic.Int32
+	done   chan struct{}
+	result T
+	err    error
+
+	// watchLock guards unwatch, the functions which stop watching for the work being abandoned
+	watchLock sync.Mutex
+	unwatch   []func() bool
+}
+
+func newFuture[T any](pool Pool) *future[T] {
+	result := &future[T]{
+		clock: clockOf(pool),
+		done:  make(chan struct{}),
+	}
+	if stopCtx := stopContextOf(pool); stopCtx != nil {
+		result.watch(stopCtx, func() error { return errors.Wrap(PoolStoppedError, "work abandoned") })
+	}
+	return result
+}
+
+// watch abandons the work with the error from cause if ctx is done before the work starts. No goroutine
+// is used until then
+func (self *future[T]) watch(ctx context.Context, cause func() error) {
+	stop := context.AfterFunc(ctx, func() {
+		self.abandon(cause())
+	})
+
+	self.watchLock.Lock()
+	self.unwatch = append(self.unwatch, stop)
+	self.watchLock.Unlock()
+}
+
+// start returns true if the work should run, which it should unless it has already been abandoned
+func (self *future[T]) start() bool {
+	if !self.state.CompareAndSwap(futurePending, futureStarted) {
+		return false
+	}
+	self.stopWatching()
+	return true
+}
+
+// abandon completes the future with the given error, unless the work has started or was already
+// abandoned
+func (self *future[T]) abandon(err error) {
+	if self.state.CompareAndSwap(futurePending, futureAbandoned) {
+		self.stopWatching()
+		self.complete(*new(T), err)
+	}
+}
+
+func (self *future[T]) stopWatching() {
+	self.watchLock.Lock()
+	defer self.watchLock.Unlock()
+	for _, stop := range self.unwatch {
+		stop()
+	}
+	self.unwatch = nil
+}
+
+func (self *future[T]) run(work func() (T, error)) func() {
+	return func() {
+		if !self.start() {
+			return
+		}
+		defer func() {
+			if val := recover(); val != nil {
+				self.complete(*new(T), &PanicError{
+					Value: val,
+					Stack: debugz.GenerateLocalStack(),
+				})
+			}
+		}()
+		self.complete(work())
+	}
+}
+
+// complete must be called exactly once. The result fields are written before done is closed, so
+// readers which have observed done closed see them
+func (self *future[T]) complete(result T, err error) {
+	self.result = result
+	self.err = err
+	close(self.done)
+}
+
+func (self *future[T]) Done() <-chan struct{} {
+	return self.done
+}
+
+func (self *future[T]) Wait() (T, error) {
+	<-self.done
+	return self.result, self.err
+}
+
+func (self *future[T]) WaitWithTimeout(timeout time.Duration) (T, error) {
+	timer := self.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-self.done:
+		return self.result, self.err
+	case <-timer.C():
+		return *new(T), errors.Wrap(TimeoutError, "timed out waiting for result")
+	}
+}
+
+func (self *future[T]) WaitCtx(ctx context.Context) (T, error) {
+	select {
+	case <-self.done:
+		return self.result, self.err
+	case <-ctx.Done():
+		return *new(T), errors.Wrap(ctx.Err(), "context done waiting for result")
+	}
+}
@@ -0,0 +1,221 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubmit(t *testing.T) {
+	newPool := func(t *testing.T) Pool {
+		p, err := NewPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		require.NoError(t, err)
+		t.Cleanup(p.Shutdown)
+		return p
+	}
+
+	t.Run("returns the work's result", func(t *testing.T) {
+		req := require.New(t)
+		f := Submit(newPool(t), func() (int, error) {
+			return 42, nil
+		})
+		val, err := f.Wait()
+		req.NoError(err)
+		req.Equal(42, val)
+
+		select {
+		case <-f.Done():
+		default:
+			req.FailNow("done should be closed once the result is available")
+		}
+	})
+
+	t.Run("returns the work's error", func(t *testing.T) {
+		req := require.New(t)
+		expected := errors.New("failed")
+		f := Submit(newPool(t), func() (string, error) {
+			return "", expected
+		})
+		_, err := f.Wait()
+		req.ErrorIs(err, expected)
+	})
+
+	t.Run("surfaces panics as errors", func(t *testing.T) {
+		req := require.New(t)
+		cause := errors.New("boom")
+		f := Submit(newPool(t), func() (int, error) {
+			panic(cause)
+		})
+		_, err := f.Wait()
+
+		var panicErr *PanicError
+		req.True(errors.As(err, &panicErr))
+		req.Equal(cause, panicErr.Value)
+		req.Contains(panicErr.Stack, "TestSubmit")
+		req.ErrorIs(err, cause)
+	})
+
+	t.Run("returns submission errors", func(t *testing.T) {
+		req := require.New(t)
+		p := newPool(t)
+		p.Shutdown()
+		_, err := Submit(p, func() (int, error) { return 1, nil }).Wait()
+		req.ErrorIs(err, PoolStoppedError)
+	})
+
+	t.Run("waits can time out or be cancelled", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Hour})
+		started := make(chan struct{})
+		release := make(chan struct{})
+		f := Submit(p, func() (int, error) {
+			close(started)
+			<-release
+			return 7, nil
+		})
+		requireClosed(t, started, "timed out waiting for work to start")
+
+		timers := clock.TimerCount()
+		result := make(chan error, 1)
+		go func() {
+			_, err := f.WaitWithTimeout(10 * time.Millisecond)
+			result <- err
+		}()
+
+		// the wait times out using the pool's clock
+		req.NoError(clock.AwaitTimers(timers+1, time.Second))
+		clock.Advance(10 * time.Millisecond)
+		req.ErrorIs(<-result, TimeoutError)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := f.WaitCtx(ctx)
+		req.ErrorIs(err, context.Canceled)
+
+		close(release)
+		val, err := f.WaitWithTimeout(time.Second)
+		req.NoError(err)
+		req.Equal(7, val)
+	})
+
+	t.Run("completes with PoolStoppedError when shutdown abandons the work", func(t *testing.T) {
+		req := require.New(t)
+		p := newPool(t)
+		release := make(chan struct{})
+		startBlockingWork(t, p, release)
+
+		var ran atomic.Bool
+		f := Submit(p, func() (int, error) {
+			ran.Store(true)
+			return 1, nil
+		})
+		p.Shutdown()
+
+		_, err := f.WaitWithTimeout(time.Second)
+		req.ErrorIs(err, PoolStoppedError)
+		close(release)
+		req.False(ran.Load())
+	})
+
+	t.Run("completes with PoolStoppedError when drain abandons the work", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Hour})
+		release := make(chan struct{})
+		defer close(release)
+		startBlockingWork(t, p, release)
+
+		var ran atomic.Bool
+		f := Submit(p, func() (int, error) {
+			ran.Store(true)
+			return 1, nil
+		})
+
+		timers := clock.TimerCount()
+		abandoned := make(chan []func(), 1)
+		go func() {
+			work, _ := p.Drain(time.Second)
+			abandoned <- work
+		}()
+		req.NoError(clock.AwaitTimers(timers+1, time.Second))
+		clock.Advance(time.Second)
+
+		work := <-abandoned
+		req.Len(work, 1)
+		_, err := f.Wait()
+		req.ErrorIs(err, PoolStoppedError)
+
+		// running work handed back by Drain doesn't run an abandoned submission
+		work[0]()
+		req.False(ran.Load())
+	})
+}
+
+func TestSubmitCtx(t *testing.T) {
+	newPool := func(t *testing.T) fullPool {
+		p, err := newFullPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		require.NoError(t, err)
+		t.Cleanup(p.Shutdown)
+		return p
+	}
+
+	t.Run("passes the context to the work", func(t *testing.T) {
+		req := require.New(t)
+		type ctxKey struct{}
+		ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+		f := SubmitCtx(newPool(t), ctx, func(ctx context.Context) (interface{}, error) {
+			return ctx.Value(ctxKey{}), nil
+		})
+		val, err := f.Wait()
+		req.NoError(err)
+		req.Equal("value", val)
+	})
+
+	t.Run("doesn't run queued work once the context is done", func(t *testing.T) {
+		req := require.New(t)
+		p := newPool(t)
+		release := make(chan struct{})
+		startBlockingWork(t, p, release)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var ran atomic.Bool
+		f := SubmitCtx(p, ctx, func(context.Context) (int, error) {
+			ran.Store(true)
+			return 1, nil
+		})
+		cancel()
+
+		_, err := f.WaitWithTimeout(time.Second)
+		req.ErrorIs(err, context.Canceled)
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+		req.False(ran.Load())
+	})
+
+	t.Run("returns submission errors", func(t *testing.T) {
+		req := require.New(t)
+		p := newPool(t)
+		p.Shutdown()
+		_, err := SubmitCtx(p, context.Background(), func(context.Context) (int, error) { return 1, nil }).Wait()
+		req.ErrorIs(err, PoolStoppedError)
+	})
+}
@@ -0,0 +1,80 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/openziti/foundation/v2/debugz"
+	"github.com/openziti/foundation/v2/logging"
+)
+
+// PanicReport describes a panic in work run by a pool worker
+type PanicReport struct {
+	// The value passed to panic
+	Value interface{}
+	// The stack of the worker goroutine, captured while the panic was being recovered, so it includes
+	// the frames which panicked
+	Stack string
+	// The number of the worker which was running the work
+	WorkerNumber uint32
+	// The name of the pool, which may be empty
+	PoolName string
+	// The metadata the work was submitted with, if any
+	Metadata TaskMetadata
+}
+
+// logChannel is the logging channel panics and stuck tasks are logged to, when a pool has no handler
+// for them
+const logChannel = "goroutines"
+
+// reportPanic builds a report for a recovered panic and passes it on. The report handler is preferred,
+// falling back to the plain handler, which only takes the value. With neither, the report is logged
+func reportPanic(val interface{}, poolName string, state *workerState, handler func(interface{}), reportHandler func(*PanicReport)) {
+	report := &PanicReport{
+		Value:        val,
+		Stack:        debugz.GenerateLocalStack(),
+		WorkerNumber: state.number,
+		PoolName:     poolName,
+		Metadata:     state.task.getMetadata(),
+	}
+
+	switch {
+	case reportHandler != nil:
+		reportHandler(report)
+	case handler != nil:
+		handler(val)
+	default:
+		report.log()
+	}
+}
+
+func (self *PanicReport) log() {
+	attrs := []any{
+		slog.String("pool", self.PoolName),
+		slog.Uint64("worker", uint64(self.WorkerNumber)),
+		slog.String("panic", fmt.Sprintf("%+v", self.Value)),
+	}
+
+	if len(self.Metadata) > 0 {
+		attrs = append(attrs, self.Metadata.logAttr())
+	}
+
+	attrs = append(attrs, slog.String("stack", self.Stack))
+	logging.For(logChannel).Error("panic during pool worker executing", attrs...)
+}
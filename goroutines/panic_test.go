@@ -0,0 +1,156 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/logging"
+	"github.com/stretchr/testify/require"
+)
+
+func panicInPanicTest() {
+	panic("boom")
+}
+
+func panicInPanicTestCtx(context.Context) {
+	panicInPanicTest()
+}
+
+// lockedBuffer lets the test read what a worker goroutine logged
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *lockedBuffer) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *lockedBuffer) Bytes() []byte {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]byte(nil), self.buf.Bytes()...)
+}
+
+func TestPanicReport(t *testing.T) {
+	newPools := map[string]func(config PoolConfig) (fullPool, error){
+		"pool": newFullPool,
+		"sharded": func(config PoolConfig) (fullPool, error) {
+			return NewShardedPool(config)
+		},
+	}
+
+	for name, newPool := range newPools {
+		t.Run(name, func(t *testing.T) {
+			t.Run("reports the stack, worker and metadata", func(t *testing.T) {
+				req := require.New(t)
+
+				reports := make(chan *PanicReport, 1)
+				p, err := newPool(PoolConfig{
+					Name:               "panic-test",
+					QueueSize:          4,
+					MinWorkers:         0,
+					MaxWorkers:         1,
+					IdleTime:           time.Second,
+					PanicReportHandler: func(report *PanicReport) { reports <- report },
+				})
+				req.NoError(err)
+				defer p.Shutdown()
+
+				ctx := WithTaskMetadata(context.Background(), TaskMetadata{"circuitId": "abc"})
+				req.NoError(p.QueueCtx(ctx, panicInPanicTestCtx))
+
+				select {
+				case report := <-reports:
+					req.Equal("boom", report.Value)
+					req.Equal("panic-test", report.PoolName)
+					req.Equal(uint32(1), report.WorkerNumber)
+					req.Equal(TaskMetadata{"circuitId": "abc"}, report.Metadata)
+					req.Contains(report.Stack, "panicInPanicTest")
+				case <-time.After(time.Second):
+					req.FailNow("panic should have been reported")
+				}
+
+				req.NoError(p.AwaitIdle(time.Second))
+				req.Equal(uint64(1), p.Stats().Panics)
+			})
+
+			t.Run("prefers the report handler", func(t *testing.T) {
+				req := require.New(t)
+
+				reports := make(chan *PanicReport, 1)
+				p, err := newPool(PoolConfig{
+					QueueSize:          4,
+					MinWorkers:         0,
+					MaxWorkers:         1,
+					IdleTime:           time.Second,
+					PanicHandler:       func(interface{}) { req.Fail("plain handler should not be called") },
+					PanicReportHandler: func(report *PanicReport) { reports <- report },
+				})
+				req.NoError(err)
+				defer p.Shutdown()
+
+				req.NoError(p.Queue(panicInPanicTest))
+				select {
+				case report := <-reports:
+					req.Nil(report.Metadata)
+				case <-time.After(time.Second):
+					req.FailNow("panic should have been reported")
+				}
+			})
+
+			t.Run("logs when no handler is set", func(t *testing.T) {
+				req := require.New(t)
+
+				registry := logging.DefaultRegistry()
+				out := &lockedBuffer{}
+				prevRoot := registry.Root()
+				registry.SetRoot(slog.NewJSONHandler(out, nil))
+				defer registry.SetRoot(prevRoot)
+
+				p, err := newPool(PoolConfig{Name: "logged", QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+				req.NoError(err)
+				defer p.Shutdown()
+
+				ctx := WithTaskMetadata(context.Background(), TaskMetadata{"circuitId": "abc"})
+				req.NoError(p.QueueCtx(ctx, panicInPanicTestCtx))
+
+				var record map[string]any
+				require.Eventually(t, func() bool {
+					return json.Unmarshal(out.Bytes(), &record) == nil
+				}, time.Second, time.Millisecond)
+
+				req.Equal("ERROR", record["level"])
+				req.Equal(logChannel, record["channel"])
+				req.Equal("logged", record["pool"])
+				req.Equal(float64(1), record["worker"])
+				req.Equal("boom", record["panic"])
+				req.Equal(map[string]any{"circuitId": "abc"}, record["metadata"])
+				req.Contains(record["stack"], "panicInPanicTest")
+			})
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package goroutines
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/openziti/foundation/v2/clockz"
 	"github.com/pkg/errors"
 )
 
@@ -21,20 +24,48 @@ const (
 	PoolStoppedError = strErr("pool shutdown")
 )
 
+// Priority is the scheduling class of a unit of work. Workers take higher priority work first, but
+// a lower priority class with work waiting is given a turn after PriorityBurst items have been taken
+// ahead of it, so lower priority work is delayed but never starved.
+type Priority uint8
+
 const (
-	// shutdownPollInterval is how often ShutdownAndWait re-checks that the pool
-	// has drained. It's coarse because shutdown is one-time and latency-tolerant.
-	shutdownPollInterval = 50 * time.Millisecond
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
 
-	// idlePollInterval is how often AwaitIdle re-checks for outstanding work.
-	// It's short so callers that submit work and immediately wait stay responsive.
-	idlePollInterval = 5 * time.Millisecond
+	numPriorities = 3
 )
 
+// DefaultPriorityBurst is used when PoolConfig.PriorityBurst isn't set
+const DefaultPriorityBurst = 8
+
+func (self Priority) String() string {
+	switch self {
+	case PriorityHigh:
+		return "high"
+	case PriorityNormal:
+		return "normal"
+	case PriorityLow:
+		return "low"
+	}
+	return fmt.Sprintf("priority(%d)", uint8(self))
+}
+
+func (self Priority) validate() error {
+	if self >= numPriorities {
+		return errors.Errorf("invalid priority %v", self)
+	}
+	return nil
+}
+
 // Pool represents a goroutine worker pool that can be configured with a queue size and min and max sizes.
 //
 //	The pool will start with min size goroutines and will add more if the queue isn't staying empty.
 //	After a worker has been idle for a configured time, it will stop
+//
+// The pools returned by NewPool and NewShardedPool also implement PriorityPool, ContextPool, DrainablePool,
+// ResizablePool, InspectablePool, SchedulingPool and BatchPool.
 type Pool interface {
 	// Queue submits a unit of work to the pool. It will return an error if the pool is shutdown
 	Queue(func()) error
@@ -76,10 +107,159 @@ type Pool interface {
 	AwaitIdle(timeout time.Duration) error
 }
 
+// A PriorityPool is a Pool which can queue work with a Priority. Pool.Queue, Pool.QueueWithTimeout and
+// Pool.QueueOrError submit work with PriorityNormal, and Pool.GetQueueSize counts work of every priority
+type PriorityPool interface {
+	Pool
+
+	// QueuePriority works like Queue, but submits the work with the given priority
+	QueuePriority(Priority, func()) error
+
+	// QueuePriorityWithTimeout works like QueueWithTimeout, but submits the work with the given priority
+	QueuePriorityWithTimeout(Priority, func(), time.Duration) error
+
+	// QueuePriorityOrError works like QueueOrError, but submits the work with the given priority
+	QueuePriorityOrError(Priority, func()) error
+
+	// GetPriorityQueueSize returns the current number of work items in the work queue with the given priority
+	GetPriorityQueueSize(Priority) uint32
+}
+
+// A ContextPool is a Pool which can queue and wait using a context
+type ContextPool interface {
+	Pool
+
+	// QueueCtx submits a unit of work to the pool, passing it the given context. It will return an error if
+	// the pool is shutdown or if the context is done before the work can be submitted to the work queue.
+	// If the context is done while the work is queued, the work is skipped rather than run
+	QueueCtx(context.Context, func(context.Context)) error
+
+	// QueuePriorityCtx works like QueueCtx, but submits the work with the given priority
+	QueuePriorityCtx(context.Context, Priority, func(context.Context)) error
+
+	// GetCancelled returns the number of work items submitted with QueueCtx or QueuePriorityCtx which
+	// were not run because their context was done, either before they could be queued or while queued
+	GetCancelled() uint64
+
+	// ShutdownAndWaitCtx works like ShutdownAndWait, but waits until the context is done rather than
+	// for a timeout, returning the context's error if the pool hasn't drained by then
+	ShutdownAndWaitCtx(ctx context.Context) error
+
+	// AwaitIdleCtx works like AwaitIdle, but waits until the context is done rather than for a
+	// timeout, returning the context's error if the pool hasn't become idle by then
+	AwaitIdleCtx(ctx context.Context) error
+}
+
+// A DrainablePool is a Pool which can be shut down gracefully, without abandoning queued work
+type DrainablePool interface {
+	Pool
+
+	// Drain stops the pool from accepting new work, then waits for all queued and in-flight work to
+	// complete before shutting the pool down. If the timeout elapses first, the pool is shut down
+	// anyway, and work which was queued but not yet started is removed from the queue and returned
+	// along with TimeoutError, so the caller can persist or re-route it. Work still running when the
+	// timeout elapses continues to completion.
+	Drain(timeout time.Duration) ([]func(), error)
+}
+
+// A ResizablePool is a Pool whose worker limits and idle time can be changed while it's running
+type ResizablePool interface {
+	Pool
+
+	// SetMinWorkers changes the minimum number of workers. If the minimum is raised, workers are started
+	// to reach it. If it is lowered, workers above the new minimum exit once they've been idle for the
+	// idle time. Returns an error if min would be greater than the current max workers
+	SetMinWorkers(min uint32) error
+
+	// SetMaxWorkers changes the maximum number of workers. If the maximum is raised and work is queued,
+	// workers are started to service it. If it is lowered, workers above the new maximum exit once they
+	// finish their current work. Returns an error if max is less than 1 or less than the current min workers
+	SetMaxWorkers(max uint32) error
+
+	// SetIdleTime changes how long a worker above the minimum may be idle before exiting. Idle workers
+	// restart their idle timer using the new value
+	SetIdleTime(idleTime time.Duration)
+}
+
+// An InspectablePool is a Pool which reports its name, configuration and stats
+type InspectablePool interface {
+	Pool
+
+	// GetName returns the name the pool was configured with, which may be empty
+	GetName() string
+
+	// GetConfig returns the configuration the pool was created with, updated with the current min
+	// workers, max workers and idle time
+	GetConfig() PoolConfig
+
+	// Stats returns a snapshot of the pool's current state and cumulative counters, including queue
+	// wait and run time histograms
+	Stats() *PoolStats
+}
+
+// A SchedulingPool is a Pool which can queue work at a later time
+type SchedulingPool interface {
+	Pool
+
+	// ScheduleAfter queues work on the pool once the delay has elapsed. Scheduled work for a pool is
+	// tracked using a single heap and timer, rather than a timer per task, and is cancelled when the
+	// pool shuts down. Returns an error if the pool is shut down
+	ScheduleAfter(delay time.Duration, work func()) (ScheduledTask, error)
+
+	// ScheduleAt queues work on the pool at the given time, or immediately if the time has passed
+	ScheduleAt(at time.Time, work func()) (ScheduledTask, error)
+
+	// ScheduleEvery queues work on the pool every interval, starting one interval from now, until the
+	// task is cancelled or the pool shuts down. If the previous run hasn't finished when the next is
+	// due, that run is skipped
+	ScheduleEvery(interval time.Duration, work func()) (ScheduledTask, error)
+}
+
+// A BatchPool is a Pool which can queue several work items at once
+type BatchPool interface {
+	Pool
+
+	// QueueBatch submits the work items with PriorityNormal, without waiting for queue space, and returns
+	// the number of items accepted. With BatchAllOrNothing, either every item is accepted or none are.
+	// With BatchBestEffort, items are accepted in order until the queue is full. If any items aren't
+	// accepted, QueueFullError is returned.
+	//
+	// NewPool's pool sends the accepted items to the queue as a single entry, which takes one slot of the
+	// queue but counts against its size item by item. Workers share the items out as they run them. A
+	// sharded pool gives each shard a run of items, taking the shard's lock and waking a worker once per run
+	QueueBatch(work []func(), mode BatchMode) (int, error)
+}
+
+// fullPool is implemented by the pools in this package
+type fullPool interface {
+	PriorityPool
+	ContextPool
+	DrainablePool
+	ResizablePool
+	InspectablePool
+	SchedulingPool
+	BatchPool
+}
+
+var _ fullPool = (*pool)(nil)
+
 // PoolConfig is used to configure a new Pool
 type PoolConfig struct {
-	// The size of the channel feeding the worker pool
+	// An optional name for the pool. If set, the pool is added to Registry under this name, and
+	// removed when it shuts down
+	Name string
+	// The registry a named pool is added to. If nil, DefaultPoolRegistry is used
+	Registry *PoolRegistry
+	// The size of the channel feeding the worker pool. Each priority has its own channel, which is this
+	// size unless overridden by HighPriorityQueueSize or LowPriorityQueueSize
 	QueueSize uint32
+	// The size of the channel holding PriorityHigh work. If zero, QueueSize is used
+	HighPriorityQueueSize uint32
+	// The size of the channel holding PriorityLow work. If zero, QueueSize is used
+	LowPriorityQueueSize uint32
+	// How many higher priority work items may be taken ahead of waiting lower priority work before
+	// the lower priority work gets a turn. If zero, DefaultPriorityBurst is used
+	PriorityBurst uint32
 	// The minimum number of goroutines
 	MinWorkers uint32
 	// The maximum number of workers
@@ -89,9 +269,21 @@ type PoolConfig struct {
 	// Provides a way to join shutdown of the pool with other components.
 	// The pool also be shut down independently using the Shutdown method
 	CloseNotify <-chan struct{}
-	// Provides a way to specify what happens if a worker encounters a panic
-	// if no PanicHandler is provided, panics will not be caught
+	// Provides a way to specify what happens if a worker encounters a panic.
+	// If neither PanicHandler nor PanicReportHandler is provided, panics are logged
 	PanicHandler func(err interface{})
+	// Like PanicHandler, but is given a report including the stack, worker and task metadata.
+	// Takes precedence over PanicHandler
+	PanicReportHandler func(report *PanicReport)
+	// A soft deadline for each work item. Work which runs longer is reported to StuckTaskHandler and
+	// counted in the pool stats, but isn't interrupted. Work submitted with a context can have its own
+	// deadline, see WithTaskDeadline. If zero, only work with its own deadline is watched
+	TaskDeadline time.Duration
+	// Called when work runs past its deadline. If not provided, the work is logged
+	StuckTaskHandler func(report *StuckTaskReport)
+	// If set, workers running work past its deadline don't count against MaxWorkers until the work
+	// completes, so the pool can start replacements for them. Not supported by sharded pools
+	ReplaceStuckWorkers bool
 	// Optional callback which is called whenever work completes, with the
 	// time the work took to complete
 	OnWorkCallback func(workTime time.Duration)
@@ -99,6 +291,9 @@ type PoolConfig struct {
 	OnCreate func(Pool)
 	// A function to identify the pool type. WorkerFunction must call embedded function to start the worker
 	WorkerFunction func(uint32, func())
+	// The clock used for idle time, timeouts, deadlines and scheduled work. If nil, the real clock is used.
+	// Tests can provide a clockz.FakeClock to control timing
+	Clock clockz.Clock
 }
 
 func (self *PoolConfig) Validate() error {
@@ -116,37 +311,66 @@ func NewPool(config PoolConfig) (Pool, error) {
 		return nil, err
 	}
 
-	if config.MinWorkers > math.MaxInt32 {
-		return nil, fmt.Errorf("min workers must be less than or equal to %v", math.MaxInt32)
+	if err := validateWorkerLimit("min", config.MinWorkers); err != nil {
+		return nil, err
 	}
 
-	if config.MaxWorkers > math.MaxInt32 {
-		return nil, fmt.Errorf("max workers must be less than or equal to %v", math.MaxInt32)
+	if err := validateWorkerLimit("max", config.MaxWorkers); err != nil {
+		return nil, err
 	}
 
+	queueSizes := [numPriorities]uint32{config.HighPriorityQueueSize, config.QueueSize, config.LowPriorityQueueSize}
+
 	result := &pool{
-		queue:               make(chan func(), int(config.QueueSize)),
-		minWorkers:          int32(config.MinWorkers),
-		maxWorkers:          int32(config.MaxWorkers),
-		maxIdle:             config.IdleTime,
+		config:              config,
+		clock:               clockz.OrReal(config.Clock),
+		priorityBurst:       config.PriorityBurst,
 		externalCloseNotify: config.CloseNotify,
 		closeNotify:         make(chan struct{}),
+		drainNotify:         make(chan struct{}),
 		panicHandler:        config.PanicHandler,
+		panicReportHandler:  config.PanicReportHandler,
 		onWorkCallback:      config.OnWorkCallback,
 		workF:               config.WorkerFunction,
 	}
 
+	result.minWorkers.Store(int32(config.MinWorkers))
+	result.maxWorkers.Store(int32(config.MaxWorkers))
+	result.maxIdle.Store(int64(config.IdleTime))
+	resizeNotify := make(chan struct{})
+	result.resizeNotify.Store(&resizeNotify)
+
+	for i, size := range queueSizes {
+		if size == 0 {
+			size = config.QueueSize
+		}
+		result.queues[i] = make(chan queuedWork, int(size))
+	}
+
+	if result.priorityBurst == 0 {
+		result.priorityBurst = DefaultPriorityBurst
+	}
+
+	result.taskScheduler = newTaskScheduler(result.clock, result.Queue, result.QueueOrError, result.closeNotify, config.CloseNotify)
+	result.stuckStacks = newStuckStacks(result.clock)
+
 	if result.workF == nil {
 		result.workF = func(workerNumber uint32, worker func()) {
 			worker()
 		}
 	}
 
+	registry, err := joinRegistry(result, &config, result.closeNotify)
+	if err != nil {
+		return nil, err
+	}
+	result.registry = registry
+
 	if config.OnCreate != nil {
 		config.OnCreate(result)
 	}
 
-	for i := int32(0); i < result.minWorkers; i++ {
+	for i := uint32(0); i < config.MinWorkers; i++ {
 		result.tryAddWorker()
 	}
 
@@ -154,75 +378,233 @@ func NewPool(config PoolConfig) (Pool, error) {
 }
 
 type pool struct {
-	queue               chan func()
-	queueSize           uint32
+	*taskScheduler
+	config              PoolConfig
+	clock               clockz.Clock
+	registry            *PoolRegistry
+	workers             sync.Map
+	queues              [numPriorities]chan queuedWork
+	queueSizes          [numPriorities]uint32
+	skipped             [numPriorities]atomic.Uint32
+	priorityBurst       uint32
 	outstanding         int32
 	count               int32
-	minWorkers          int32
-	maxWorkers          int32
+	minWorkers          atomic.Int32
+	maxWorkers          atomic.Int32
 	busyWorkers         uint32
-	maxIdle             time.Duration
+	cancelled           atomic.Uint64
+	counters            poolCounters
+	stuckStacks         *stuckStacks
+	stopCtx             stopContext
+	groups              sync.Map
+	maxIdle             atomic.Int64
+	resizeLock          sync.Mutex
+	resizeNotify        atomic.Pointer[chan struct{}]
+	idleSignal          zeroSignal
+	noWorkersSignal     zeroSignal
 	stopped             atomic.Bool
+	draining            atomic.Bool
+	drainNotify         chan struct{}
 	externalCloseNotify <-chan struct{}
 	closeNotify         chan struct{}
 	panicHandler        func(err interface{})
+	panicReportHandler  func(report *PanicReport)
 	onWorkCallback      func(workTime time.Duration)
 	workF               func(uint32, func())
 }
 
+// queuedWork is a unit of work along with the time it was queued, so queue wait time can be tracked
+type queuedWork struct {
+	work     func()
+	queuedAt time.Time
+	// the context the work was queued with, if any. Work whose context is done by the time it would
+	// run is skipped
+	ctx     context.Context
+	options *taskOptions
+	// set instead of work for a batch queued with QueueBatch
+	group *workGroup
+}
+
 func (self *pool) Queue(work func()) error {
-	return self.queueImpl(work, nil)
+	return self.queueImpl(context.Background(), PriorityNormal, work, nil)
 }
 
 func (self *pool) QueueWithTimeout(work func(), timeout time.Duration) error {
-	return self.queueImpl(work, time.After(timeout))
+	timer := self.clock.NewTimer(timeout)
+	defer timer.Stop()
+	return self.queueImpl(context.Background(), PriorityNormal, work, timer.C())
 }
 
-func (self *pool) queueImpl(work func(), timeoutC <-chan time.Time) error {
+func (self *pool) QueuePriority(priority Priority, work func()) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+	return self.queueImpl(context.Background(), priority, work, nil)
+}
+
+func (self *pool) QueuePriorityWithTimeout(priority Priority, work func(), timeout time.Duration) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+	timer := self.clock.NewTimer(timeout)
+	defer timer.Stop()
+	return self.queueImpl(context.Background(), priority, work, timer.C())
+}
+
+func (self *pool) QueueCtx(ctx context.Context, work func(context.Context)) error {
+	return self.QueuePriorityCtx(ctx, PriorityNormal, work)
+}
+
+func (self *pool) QueuePriorityCtx(ctx context.Context, priority Priority, work func(context.Context)) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		self.cancelled.Add(1)
+		return errors.Wrap(err, "cannot queue")
+	}
+
+	return self.queueImpl(ctx, priority, func() { work(ctx) }, nil)
+}
+
+func (self *pool) queueImpl(ctx context.Context, priority Priority, work func(), timeoutC <-chan time.Time) error {
+	if self.stopped.Load() {
+		return errors.Wrap(PoolStoppedError, "cannot queue")
+	}
+
+	if self.draining.Load() {
+		return errors.Wrap(PoolStoppedError, "cannot queue, pool draining")
+	}
+
 	self.ensureNoStarvation()
 	// Count the work as outstanding before it can be picked up by a worker, so a
 	// worker can never complete-and-decrement before this increment lands. Undo it
 	// on any path where the work isn't actually enqueued.
 	self.incrOutstanding()
 	select {
-	case self.queue <- work:
-		self.incrQueueSize()
+	case self.queues[priority] <- queuedWork{work: work, queuedAt: self.clock.Now(), ctx: ctx, options: taskOptionsFrom(ctx)}:
+		self.incrQueueSize(priority)
 		self.ensureNoStarvation()
 		return nil
 	case <-self.closeNotify:
 		self.decrOutstanding()
 		return errors.Wrap(PoolStoppedError, "cannot queue")
+	case <-self.drainNotify:
+		self.decrOutstanding()
+		return errors.Wrap(PoolStoppedError, "cannot queue, pool draining")
 	case <-self.externalCloseNotify:
 		self.decrOutstanding()
 		return errors.Wrap(PoolStoppedError, "cannot queue, pool stopped externally")
 	case <-timeoutC:
 		self.decrOutstanding()
+		self.counters.rejectedTimeout.Add(1)
 		return errors.Wrap(TimeoutError, "cannot queue")
+	case <-ctx.Done():
+		self.decrOutstanding()
+		self.cancelled.Add(1)
+		return errors.Wrap(ctx.Err(), "cannot queue")
 	}
 }
 
 func (self *pool) QueueOrError(work func()) error {
+	return self.queueOrErrorImpl(PriorityNormal, work)
+}
+
+func (self *pool) QueuePriorityOrError(priority Priority, work func()) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+	return self.queueOrErrorImpl(priority, work)
+}
+
+func (self *pool) queueOrErrorImpl(priority Priority, work func()) error {
+	if self.stopped.Load() {
+		return errors.Wrap(PoolStoppedError, "cannot queue")
+	}
+
+	if self.draining.Load() {
+		return errors.Wrap(PoolStoppedError, "cannot queue, pool draining")
+	}
+
 	// See queueImpl: count as outstanding before enqueue, undo if not enqueued.
 	self.incrOutstanding()
 	select {
-	case self.queue <- work:
-		self.incrQueueSize()
+	case self.queues[priority] <- queuedWork{work: work, queuedAt: self.clock.Now()}:
+		self.incrQueueSize(priority)
 		self.ensureNoStarvation()
 		return nil
 	case <-self.closeNotify:
 		self.decrOutstanding()
 		return errors.Wrap(PoolStoppedError, "cannot queue")
+	case <-self.drainNotify:
+		self.decrOutstanding()
+		return errors.Wrap(PoolStoppedError, "cannot queue, pool draining")
 	case <-self.externalCloseNotify:
 		self.decrOutstanding()
 		return errors.Wrap(PoolStoppedError, "cannot queue, pool stopped externally")
 	default:
 		self.decrOutstanding()
+		self.counters.rejectedQueueFull.Add(1)
 		return errors.Wrap(QueueFullError, "cannot queue")
 	}
 }
 
+func (self *pool) QueueBatch(work []func(), mode BatchMode) (int, error) {
+	if err := mode.validate(); err != nil {
+		return 0, err
+	}
+
+	if self.stopped.Load() {
+		return 0, errors.Wrap(PoolStoppedError, "cannot queue")
+	}
+
+	if self.draining.Load() {
+		return 0, errors.Wrap(PoolStoppedError, "cannot queue, pool draining")
+	}
+
+	if len(work) == 0 {
+		return 0, nil
+	}
+
+	// the batch takes a single slot in the queue, but counts against the queue size item by item
+	queue := self.queues[PriorityNormal]
+	space := max(0, cap(queue)-int(self.GetPriorityQueueSize(PriorityNormal)))
+
+	accepted := min(len(work), space)
+	if mode == BatchAllOrNothing && accepted < len(work) {
+		accepted = 0
+	}
+
+	if accepted > 0 {
+		group := newWorkGroup(work[:accepted], self.clock.Now())
+
+		// See queueImpl: count as outstanding before enqueue, undo if it can't be queued
+		self.addOutstanding(int32(accepted))
+		self.groups.Store(group, struct{}{})
+
+		select {
+		case queue <- queuedWork{group: group}:
+			self.addQueueSize(PriorityNormal, uint32(accepted))
+			self.ensureNoStarvation()
+		default:
+			// another submitter took the last slot
+			self.groups.Delete(group)
+			self.addOutstanding(-int32(accepted))
+			accepted = 0
+		}
+	}
+
+	if accepted < len(work) {
+		self.counters.rejectedQueueFull.Add(1)
+		return accepted, errors.Wrapf(QueueFullError, "cannot queue batch, %v of %v items accepted", accepted, len(work))
+	}
+
+	return accepted, nil
+}
+
 func (self *pool) ensureNoStarvation() {
-	if self.minWorkers == 0 && self.GetWorkerCount() == 0 {
+	if self.minWorkers.Load() == 0 && self.GetWorkerCount() == 0 {
 		self.tryAddWorker()
 	}
 }
@@ -230,68 +612,145 @@ func (self *pool) ensureNoStarvation() {
 func (self *pool) Shutdown() {
 	if self.stopped.CompareAndSwap(false, true) {
 		close(self.closeNotify)
+		if self.registry != nil {
+			self.registry.remove(self)
+		}
 	}
 }
 
 func (self *pool) ShutdownAndWait(timeout time.Duration) error {
+	ctx, cancel := clockz.WithTimeout(context.Background(), self.clock, timeout)
+	defer cancel()
+
+	if err := self.shutdownAndWait(ctx); err != nil {
+		return errors.Wrap(TimeoutError, "timed out waiting for in-flight work to complete")
+	}
+	return nil
+}
+
+func (self *pool) ShutdownAndWaitCtx(ctx context.Context) error {
+	if err := self.shutdownAndWait(ctx); err != nil {
+		return errors.Wrap(err, "context done waiting for in-flight work to complete")
+	}
+	return nil
+}
+
+func (self *pool) shutdownAndWait(ctx context.Context) error {
 	self.Shutdown()
 
 	// Wait for every worker to exit, which means all in-flight work has
 	// completed. Workers stop pulling from the queue and new workers stop being
 	// spawned once the pool is shut down, so the worker count drains to zero.
-	return self.awaitCondition(timeout, shutdownPollInterval, "timed out waiting for in-flight work to complete", func() bool {
+	return self.noWorkersSignal.await(ctx, func() bool {
 		return self.GetWorkerCount() == 0
 	})
 }
 
-func (self *pool) AwaitIdle(timeout time.Duration) error {
-	// Wait until no work is outstanding (nothing queued, nothing running).
-	return self.awaitCondition(timeout, idlePollInterval, "timed out waiting for pool to become idle", func() bool {
-		return self.GetOutstanding() == 0
-	})
-}
+func (self *pool) Drain(timeout time.Duration) ([]func(), error) {
+	if self.draining.CompareAndSwap(false, true) {
+		close(self.drainNotify)
+	}
 
-// awaitCondition returns nil once done reports true, or wraps TimeoutError with
-// msg if the timeout elapses first. It waits on channels rather than sleeping,
-// and the deadline timer fires exactly at the timeout, so the wait doesn't
-// overshoot by a poll interval.
-func (self *pool) awaitCondition(timeout, pollInterval time.Duration, msg string, done func() bool) error {
-	if done() {
-		return nil
+	// with min workers of zero, the queue may have work but no workers to run it
+	self.ensureNoStarvation()
+
+	ctx, cancel := clockz.WithTimeout(context.Background(), self.clock, timeout)
+	defer cancel()
+
+	var err error
+	if self.idleSignal.await(ctx, self.isIdle) != nil {
+		err = errors.Wrap(TimeoutError, "timed out waiting for queued work to drain")
 	}
 
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+	self.Shutdown()
 
-	ticker := time.NewTicker(pollInterval)
-	defer ticker.Stop()
+	// Once shut down, workers stop pulling from the queue, so anything left is abandoned. A
+	// submission which raced with the start of the drain may also have landed here.
+	return self.removeQueued(), err
+}
 
-	for {
-		select {
-		case <-timer.C:
-			return errors.Wrap(TimeoutError, msg)
-		case <-ticker.C:
-			if done() {
-				return nil
+// removeQueued empties the work queues, returning the removed work
+func (self *pool) removeQueued() []func() {
+	var result []func()
+	for priority := PriorityHigh; priority < numPriorities; priority++ {
+		for done := false; !done; {
+			select {
+			case work := <-self.queues[priority]:
+				// batches are collected below, including any which aren't on the queue
+				if work.group == nil {
+					self.decrQueueSize(priority)
+					self.decrOutstanding()
+					result = append(result, work.work)
+				}
+			default:
+				done = true
+			}
+		}
+	}
+
+	self.groups.Range(func(key, _ any) bool {
+		group := key.(*workGroup)
+		for {
+			item, ok := self.claim(group)
+			if !ok {
+				break
 			}
+			self.decrOutstanding()
+			result = append(result, item)
 		}
+		return true
+	})
+
+	return result
+}
+
+func (self *pool) AwaitIdle(timeout time.Duration) error {
+	ctx, cancel := clockz.WithTimeout(context.Background(), self.clock, timeout)
+	defer cancel()
+
+	if err := self.idleSignal.await(ctx, self.isIdle); err != nil {
+		return errors.Wrap(TimeoutError, "timed out waiting for pool to become idle")
 	}
+	return nil
 }
 
-func (self *pool) worker(initialWork func()) {
+func (self *pool) AwaitIdleCtx(ctx context.Context) error {
+	if err := self.idleSignal.await(ctx, self.isIdle); err != nil {
+		return errors.Wrap(err, "context done waiting for pool to become idle")
+	}
+	return nil
+}
+
+// isIdle returns true if no work is outstanding (nothing queued, nothing running)
+func (self *pool) isIdle() bool {
+	return self.GetOutstanding() == 0
+}
+
+func (self *pool) worker(workerNumber uint32, initialWork queuedWork) {
+	state := &workerState{
+		number:      workerNumber,
+		goroutineId: currentGoroutineId(),
+	}
+	self.workers.Store(state, struct{}{})
+	defer self.workers.Delete(state)
+
 	defer func() {
 		if err := recover(); err != nil {
-			if self.panicHandler != nil {
-				self.panicHandler(err)
-			} else {
-				fmt.Printf("panic during pool worker executing (%+v)\n", err)
-			}
+			self.counters.panics.Add(1)
+			reportPanic(err, self.config.Name, state, self.panicHandler, self.panicReportHandler)
 			self.tryAddWorker()
 		}
 	}()
 
+	retired := false
+
 	defer func() {
-		newCount := self.decrementCount()
+		// a retired worker has already been removed from the count by tryRetire
+		newCount := self.getWorkerCount()
+		if !retired {
+			newCount = self.decrementCount()
+		}
+		self.counters.workersRetired.Add(1)
 
 		if self.stopped.Load() {
 			// Pool is shutting down. Don't respawn workers. The count is still
@@ -307,30 +766,57 @@ func (self *pool) worker(initialWork func()) {
 		// There's another race condition where if minWorkers is 1, multiple can exit
 		// at the same time and the count can drop to 0. If that happens, start a new
 		// worker
-		if newCount < self.minWorkers {
+		if newCount < self.minWorkers.Load() {
 			self.addWorkerIfBelowMin()
 		} else if newCount == 0 {
-			time.AfterFunc(100*time.Millisecond, self.startExtraWorkerIfQueueBusy)
+			self.clock.AfterFunc(100*time.Millisecond, self.startExtraWorkerIfQueueBusy)
 		}
 	}()
 
-	if initialWork != nil {
-		self.runWork(initialWork)
+	if initialWork.work != nil || initialWork.group != nil {
+		self.runWork(state, initialWork)
 	}
 
+	idleTimer := self.clock.NewTimer(self.getIdleTime())
+	defer idleTimer.Stop()
+
 	// Once shut down, finish the current work (already done by this point)
 	// and exit without pulling more from the queue. Queued-but-not-started
 	// work is intentionally abandoned.
 	for !self.stopped.Load() {
+		if self.tryRetire() {
+			retired = true
+			return
+		}
+
+		if work, ok := self.pollWork(); ok {
+			self.startExtraWorkerIfQueueBusy()
+			self.runWork(state, work)
+			continue
+		}
+
+		// nothing queued, so wait for whichever priority gets work first
+		idleTimer.Reset(self.getIdleTime())
+
 		select {
-		case work := <-self.queue:
-			self.decrQueueSize()
+		case work := <-self.queues[PriorityHigh]:
+			self.received(PriorityHigh, work)
 			self.startExtraWorkerIfQueueBusy()
-			self.runWork(work)
-		case <-time.After(self.maxIdle):
-			if self.getWorkerCount() > self.minWorkers {
+			self.runWork(state, work)
+		case work := <-self.queues[PriorityNormal]:
+			self.received(PriorityNormal, work)
+			self.startExtraWorkerIfQueueBusy()
+			self.runWork(state, work)
+		case work := <-self.queues[PriorityLow]:
+			self.received(PriorityLow, work)
+			self.startExtraWorkerIfQueueBusy()
+			self.runWork(state, work)
+		case <-idleTimer.C():
+			if self.getWorkerCount() > self.minWorkers.Load() {
 				return
 			}
+		case <-self.getResizeNotify():
+			// limits or idle time changed, so check for retirement and restart the idle timer
 		case <-self.closeNotify:
 			return
 		case <-self.externalCloseNotify:
@@ -340,19 +826,116 @@ func (self *pool) worker(initialWork func()) {
 	}
 }
 
+// pollWork takes the next work item without blocking, preferring higher priorities. Before that,
+// any lower priority class which has had PriorityBurst items taken ahead of it gets a turn. The skip
+// counters are updated without a lock, so the burst is approximate under contention, but a class
+// with work waiting is always eventually served.
+func (self *pool) pollWork() (queuedWork, bool) {
+	for priority := Priority(numPriorities - 1); priority > PriorityHigh; priority-- {
+		if self.skipped[priority].Load() >= self.priorityBurst {
+			self.skipped[priority].Store(0)
+			select {
+			case work := <-self.queues[priority]:
+				self.received(priority, work)
+				return work, true
+			default:
+			}
+		}
+	}
+
+	for priority := PriorityHigh; priority < numPriorities; priority++ {
+		select {
+		case work := <-self.queues[priority]:
+			self.received(priority, work)
+			for lower := priority + 1; lower < numPriorities; lower++ {
+				if len(self.queues[lower]) > 0 {
+					self.skipped[lower].Add(1)
+				}
+			}
+			return work, true
+		default:
+		}
+	}
+
+	// a batch may have items left which aren't on the queue, if it couldn't be put back on a full queue
+	// or the worker running it stopped
+	if group := self.unfinishedGroup(); group != nil {
+		return queuedWork{group: group}, true
+	}
+
+	return queuedWork{}, false
+}
+
+// received updates the queue size for work taken from the queue. The items of a batch are counted as
+// they're claimed instead
+func (self *pool) received(priority Priority, work queuedWork) {
+	if work.group != nil {
+		work.group.queued.Store(false)
+	} else {
+		self.decrQueueSize(priority)
+	}
+}
+
+// unfinishedGroup returns a batch with unclaimed items, if there is one
+func (self *pool) unfinishedGroup() *workGroup {
+	var result *workGroup
+	self.groups.Range(func(key, _ any) bool {
+		result = key.(*workGroup)
+		return false
+	})
+	return result
+}
+
+// claim takes the next item of a batch, returning false once every item has been claimed
+func (self *pool) claim(group *workGroup) (func(), bool) {
+	item, last, ok := group.claim()
+	if ok {
+		self.decrQueueSize(PriorityNormal)
+		if last {
+			self.groups.Delete(group)
+		}
+	}
+	return item, ok
+}
+
+// requeueGroup puts a batch with unclaimed items back on the queue, so other workers can help run it.
+// A batch is only on the queue once at a time, and if the queue is full it stays with its worker
+func (self *pool) requeueGroup(group *workGroup) {
+	if group.remaining() == 0 || !group.queued.CompareAndSwap(false, true) {
+		return
+	}
+
+	select {
+	case self.queues[PriorityNormal] <- queuedWork{group: group}:
+	default:
+		group.queued.Store(false)
+	}
+}
+
+// runGroup runs the items of a batch until they've all been claimed, or the pool stops
+func (self *pool) runGroup(state *workerState, group *workGroup) {
+	// if the work panics, the rest of the batch is handed on
+	defer self.requeueGroup(group)
+
+	for !self.stopped.Load() {
+		item, ok := self.claim(group)
+		if !ok {
+			return
+		}
+		self.requeueGroup(group)
+		self.runWork(state, queuedWork{work: item, queuedAt: group.queuedAt})
+	}
+}
+
 func (self *pool) startExtraWorkerIfQueueBusy() {
 	if self.stopped.Load() {
 		return
 	}
-	if self.getWorkerCount() < self.maxWorkers {
-		if workerNumber := self.incrementCount(); workerNumber <= self.maxWorkers {
-			select {
-			case work := <-self.queue:
-				self.decrQueueSize()
-				go self.workF(uint32(workerNumber), func() {
-					self.worker(work)
-				})
-			default:
+	if maxWorkers := self.getMaxWorkers(); self.getWorkerCount() < maxWorkers {
+		if workerNumber := self.incrementCount(); workerNumber <= maxWorkers {
+			if work, ok := self.pollWork(); ok {
+				self.startWorker(workerNumber, work)
+			} else {
 				self.decrementCount()
 			}
 		} else {
@@ -365,11 +948,9 @@ func (self *pool) tryAddWorker() {
 	if self.stopped.Load() {
 		return
 	}
-	if self.getWorkerCount() < self.maxWorkers {
-		if workerNumber := self.incrementCount(); workerNumber <= self.maxWorkers {
-			go self.workF(uint32(workerNumber), func() {
-				self.worker(nil)
-			})
+	if maxWorkers := self.getMaxWorkers(); self.getWorkerCount() < maxWorkers {
+		if workerNumber := self.incrementCount(); workerNumber <= maxWorkers {
+			self.startWorker(workerNumber, queuedWork{})
 		} else {
 			self.decrementCount()
 		}
@@ -380,26 +961,186 @@ func (self *pool) addWorkerIfBelowMin() {
 	if self.stopped.Load() {
 		return
 	}
-	if workerNumber := self.incrementCount(); workerNumber <= self.minWorkers {
-		go self.workF(uint32(workerNumber), func() {
-			self.worker(nil)
-		})
+	if workerNumber := self.incrementCount(); workerNumber <= self.minWorkers.Load() {
+		self.startWorker(workerNumber, queuedWork{})
 	} else {
 		self.decrementCount()
 	}
 }
 
-func (self *pool) runWork(work func()) {
+func (self *pool) SetMinWorkers(min uint32) error {
+	if err := validateWorkerLimit("min", min); err != nil {
+		return err
+	}
+
+	self.resizeLock.Lock()
+	defer self.resizeLock.Unlock()
+
+	if maxWorkers := uint32(self.maxWorkers.Load()); min > maxWorkers {
+		return fmt.Errorf("min workers must be less than or equal to max workers. min workers=%v, max workers=%v", min, maxWorkers)
+	}
+
+	self.minWorkers.Store(int32(min))
+
+	// addWorkerIfBelowMin only starts a worker if the count stays within the minimum, so if
+	// the count isn't below min after the attempt, either we're done or another path got there first
+	for self.getWorkerCount() < int32(min) && !self.stopped.Load() {
+		self.addWorkerIfBelowMin()
+	}
+
+	self.notifyResized()
+	return nil
+}
+
+func (self *pool) SetMaxWorkers(max uint32) error {
+	if max < 1 {
+		return fmt.Errorf("max workers must be at least 1")
+	}
+
+	if err := validateWorkerLimit("max", max); err != nil {
+		return err
+	}
+
+	self.resizeLock.Lock()
+	defer self.resizeLock.Unlock()
+
+	if minWorkers := uint32(self.minWorkers.Load()); max < minWorkers {
+		return fmt.Errorf("min workers must be less than or equal to max workers. min workers=%v, max workers=%v", minWorkers, max)
+	}
+
+	self.maxWorkers.Store(int32(max))
+
+	// if work is backed up, start workers for it up to the new max. Each new worker takes an item,
+	// so this stops when the queue empties or the max is reached
+	for self.GetQueueSize() > 0 && self.getWorkerCount() < int32(max) && !self.stopped.Load() {
+		before := self.getWorkerCount()
+		self.startExtraWorkerIfQueueBusy()
+		if self.getWorkerCount() <= before {
+			break
+		}
+	}
+
+	// wake idle workers so any above the new max can retire
+	self.notifyResized()
+	return nil
+}
+
+func (self *pool) SetIdleTime(idleTime time.Duration) {
+	self.maxIdle.Store(int64(idleTime))
+	self.notifyResized()
+}
+
+func (self *pool) getIdleTime() time.Duration {
+	return time.Duration(self.maxIdle.Load())
+}
+
+// getResizeNotify returns a channel which will be closed the next time the pool limits or idle time change
+func (self *pool) getResizeNotify() <-chan struct{} {
+	return *self.resizeNotify.Load()
+}
+
+func (self *pool) notifyResized() {
+	next := make(chan struct{})
+	close(*self.resizeNotify.Swap(&next))
+}
+
+// getMaxWorkers returns the number of workers the pool may have. With ReplaceStuckWorkers set, workers
+// running work past its deadline are allowed on top of the max
+func (self *pool) getMaxWorkers() int32 {
+	result := self.maxWorkers.Load()
+	if self.config.ReplaceStuckWorkers {
+		result += max(self.counters.stuckWorkers.Load(), 0)
+	}
+	return result
+}
+
+// tryRetire removes the calling worker from the count if the pool has more workers than the current max,
+// returning true if the worker should exit. Using compare and swap means that concurrent retirements
+// can't take the count below max
+func (self *pool) tryRetire() bool {
+	for {
+		current := self.getWorkerCount()
+		if current <= self.getMaxWorkers() {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&self.count, current, current-1) {
+			return true
+		}
+	}
+}
+
+func validateWorkerLimit(name string, limit uint32) error {
+	if limit > math.MaxInt32 {
+		return fmt.Errorf("%v workers must be less than or equal to %v", name, math.MaxInt32)
+	}
+	return nil
+}
+
+// startWorker starts a worker goroutine. The caller must already have added the worker to the count
+func (self *pool) startWorker(workerNumber int32, initialWork queuedWork) {
+	self.counters.workersSpawned.Add(1)
+	go self.workF(uint32(workerNumber), func() {
+		self.worker(uint32(workerNumber), initialWork)
+	})
+}
+
+func (self *pool) runWork(state *workerState, work queuedWork) {
+	if work.group != nil {
+		self.runGroup(state, work.group)
+		return
+	}
+
+	// work cancelled while queued is only counted as cancelled, not as completed work
+	if work.ctx != nil && work.ctx.Err() != nil {
+		self.cancelled.Add(1)
+		self.decrOutstanding()
+		return
+	}
+
 	self.incrBusyWorkers()
 	defer self.decrBusyWorkers()
 	defer self.decrOutstanding()
+
+	start := self.clock.Now()
+	self.counters.queueWait.record(start.Sub(work.queuedAt))
+
+	state.busySince.Store(start.UnixNano())
+	defer state.busySince.Store(0)
+
+	// record the run time even if the work panics
+	defer func() {
+		self.counters.runTime.record(self.clock.Since(start))
+	}()
+
+	deadline := work.options.getDeadline(self.config.TaskDeadline)
+	watch := watchTask(self.clock, deadline, func() {
+		self.taskOverdue(state, work.options, deadline, start)
+	})
+	defer func() {
+		if watch.finish() {
+			self.counters.stuckWorkers.Add(-1)
+		}
+	}()
+
+	// left in place if the work panics, so the panic report can include it
+	state.task = work.options
+	work.work()
+	state.task = nil
+
 	if self.onWorkCallback != nil {
-		start := time.Now()
-		work()
-		self.onWorkCallback(time.Since(start))
-	} else {
-		work()
+		self.onWorkCallback(self.clock.Since(start))
+	}
+}
+
+// taskOverdue is called when work is still running after its deadline. With ReplaceStuckWorkers set, the
+// stuck worker stops counting against the max, so a replacement can be started
+func (self *pool) taskOverdue(state *workerState, options *taskOptions, deadline time.Duration, started time.Time) {
+	self.counters.deadlinesExceeded.Add(1)
+	self.counters.stuckWorkers.Add(1)
+	if self.config.ReplaceStuckWorkers {
+		self.tryAddWorker()
 	}
+	reportStuckTask(self.config.Name, self.stuckStacks, state, options, deadline, started, self.config.StuckTaskHandler)
 }
 
 func (self *pool) GetWorkerCount() uint32 {
@@ -415,19 +1156,49 @@ func (self *pool) incrementCount() int32 {
 }
 
 func (self *pool) decrementCount() int32 {
-	return atomic.AddInt32(&self.count, -1)
+	result := atomic.AddInt32(&self.count, -1)
+	if result == 0 {
+		self.noWorkersSignal.signal()
+	}
+	return result
 }
 
 func (self *pool) GetQueueSize() uint32 {
-	return atomic.LoadUint32(&self.queueSize)
+	var result uint32
+	for i := range self.queueSizes {
+		result += atomic.LoadUint32(&self.queueSizes[i])
+	}
+	return result
 }
 
-func (self *pool) incrQueueSize() uint32 {
-	return atomic.AddUint32(&self.queueSize, 1)
+func (self *pool) GetPriorityQueueSize(priority Priority) uint32 {
+	if priority >= numPriorities {
+		return 0
+	}
+	return atomic.LoadUint32(&self.queueSizes[priority])
 }
 
-func (self *pool) decrQueueSize() uint32 {
-	return atomic.AddUint32(&self.queueSize, ^uint32(0))
+func (self *pool) incrQueueSize(priority Priority) uint32 {
+	return self.addQueueSize(priority, 1)
+}
+
+func (self *pool) addQueueSize(priority Priority, delta uint32) uint32 {
+	result := atomic.AddUint32(&self.queueSizes[priority], delta)
+
+	// A worker can take work and decrement before the submitter increments, so a size may briefly
+	// wrap below zero. Treat sizes as signed, so that doesn't register as a huge peak
+	var total int64
+	for i := range self.queueSizes {
+		total += int64(int32(atomic.LoadUint32(&self.queueSizes[i])))
+	}
+	if total > 0 {
+		self.counters.updatePeakQueueSize(uint32(total))
+	}
+	return result
+}
+
+func (self *pool) decrQueueSize(priority Priority) uint32 {
+	return atomic.AddUint32(&self.queueSizes[priority], ^uint32(0))
 }
 
 func (self *pool) GetOutstanding() uint32 {
@@ -440,12 +1211,118 @@ func (self *pool) GetOutstanding() uint32 {
 	return 0
 }
 
+func (self *pool) GetCancelled() uint64 {
+	return self.cancelled.Load()
+}
+
+func (self *pool) GetName() string {
+	return self.config.Name
+}
+
+func (self *pool) GetConfig() PoolConfig {
+	result := self.config
+	result.MinWorkers = uint32(self.minWorkers.Load())
+	result.MaxWorkers = uint32(self.maxWorkers.Load())
+	result.IdleTime = self.getIdleTime()
+	return result
+}
+
+func (self *pool) getClock() clockz.Clock {
+	return self.clock
+}
+
+// stopContext lazily provides a context which is cancelled once a pool stops, so work waiting on the
+// pool can notice it stopping without a goroutine of its own. The goroutine which cancels it is only
+// started once the context is first requested
+type stopContext struct {
+	once sync.Once
+	ctx  context.Context
+}
+
+func (self *stopContext) get(closeNotify, externalCloseNotify <-chan struct{}) context.Context {
+	self.once.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		self.ctx = ctx
+		go func() {
+			select {
+			case <-closeNotify:
+			case <-externalCloseNotify:
+			}
+			cancel()
+		}()
+	})
+	return self.ctx
+}
+
+// isStopped returns true once the pool has shut down, or its CloseNotify has been closed
+func (self *pool) isStopped() bool {
+	if self.stopped.Load() {
+		return true
+	}
+	select {
+	case <-self.externalCloseNotify:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDraining returns true while a Drain is waiting for queued work, before the pool shuts down
+func (self *pool) isDraining() bool {
+	return self.draining.Load() && !self.isStopped()
+}
+
+// getStopContext returns a context which is cancelled once the pool stops
+func (self *pool) getStopContext() context.Context {
+	return self.stopCtx.get(self.closeNotify, self.externalCloseNotify)
+}
+
+func (self *pool) getBusyWorkers() []*workerState {
+	var result []*workerState
+	self.workers.Range(func(key, _ any) bool {
+		if state := key.(*workerState); state.busySince.Load() != 0 {
+			result = append(result, state)
+		}
+		return true
+	})
+	return result
+}
+
+func (self *pool) Stats() *PoolStats {
+	return &PoolStats{
+		Workers:           self.GetWorkerCount(),
+		BusyWorkers:       self.GetBusyWorkers(),
+		QueueSize:         self.GetQueueSize(),
+		PeakQueueSize:     self.counters.peakQueueSize.Load(),
+		Outstanding:       self.GetOutstanding(),
+		StuckWorkers:      uint32(max(self.counters.stuckWorkers.Load(), 0)),
+		Completed:         self.counters.runTime.count.Load(),
+		RejectedQueueFull: self.counters.rejectedQueueFull.Load(),
+		RejectedTimeout:   self.counters.rejectedTimeout.Load(),
+		Cancelled:         self.GetCancelled(),
+		Panics:            self.counters.panics.Load(),
+		WorkersSpawned:    self.counters.workersSpawned.Load(),
+		WorkersRetired:    self.counters.workersRetired.Load(),
+		DeadlinesExceeded: self.counters.deadlinesExceeded.Load(),
+		QueueWait:         self.counters.queueWait.snapshot(),
+		RunTime:           self.counters.runTime.snapshot(),
+	}
+}
+
 func (self *pool) incrOutstanding() int32 {
 	return atomic.AddInt32(&self.outstanding, 1)
 }
 
 func (self *pool) decrOutstanding() int32 {
-	return atomic.AddInt32(&self.outstanding, -1)
+	return self.addOutstanding(-1)
+}
+
+func (self *pool) addOutstanding(delta int32) int32 {
+	result := atomic.AddInt32(&self.outstanding, delta)
+	if result == 0 {
+		self.idleSignal.signal()
+	}
+	return result
 }
 
 func (self *pool) GetBusyWorkers() uint32 {
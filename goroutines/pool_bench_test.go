@@ -0,0 +1,143 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func benchPoolConfig() PoolConfig {
+	workers := uint32(runtime.GOMAXPROCS(0))
+	return PoolConfig{
+		QueueSize:  1024,
+		MinWorkers: workers,
+		MaxWorkers: workers,
+		IdleTime:   time.Minute,
+	}
+}
+
+// runQueueBenchmark submits b.N small work items from parallel submitters, then waits for them to run
+func runQueueBenchmark(b *testing.B, queue func(i int, work func()) error) {
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	work := func() {
+		wg.Done()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var counter int
+	var lock sync.Mutex
+	b.RunParallel(func(pb *testing.PB) {
+		lock.Lock()
+		id := counter
+		counter++
+		lock.Unlock()
+
+		for i := 0; pb.Next(); i++ {
+			if err := queue(id*1_000_000+i, work); err != nil {
+				b.Error(err)
+				wg.Done()
+			}
+		}
+	})
+	wg.Wait()
+}
+
+func BenchmarkPoolQueue(b *testing.B) {
+	p, err := newFullPool(benchPoolConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	runQueueBenchmark(b, func(_ int, work func()) error {
+		return p.Queue(work)
+	})
+}
+
+func BenchmarkShardedPoolQueue(b *testing.B) {
+	p, err := NewShardedPool(benchPoolConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	runQueueBenchmark(b, func(_ int, work func()) error {
+		return p.Queue(work)
+	})
+}
+
+func BenchmarkShardedPoolQueueKeyed(b *testing.B) {
+	p, err := NewShardedPool(benchPoolConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	keys := make([]string, 256)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+
+	runQueueBenchmark(b, func(i int, work func()) error {
+		return p.QueueKeyed(keys[i%len(keys)], work)
+	})
+}
+
+// BenchmarkPoolQueueBatch submits b.N small work items in batches, for comparison with BenchmarkPoolQueue
+func BenchmarkPoolQueueBatch(b *testing.B) {
+	p, err := newFullPool(benchPoolConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	const batchSize = 64
+
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	work := func() {
+		wg.Done()
+	}
+
+	batch := make([]func(), batchSize)
+	for i := range batch {
+		batch[i] = work
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for remaining := b.N; remaining > 0; {
+		size := min(remaining, batchSize)
+		queued, _ := p.QueueBatch(batch[:size], BatchBestEffort)
+		// whatever didn't fit is queued one item at a time, waiting for space
+		for i := queued; i < size; i++ {
+			if err := p.Queue(work); err != nil {
+				b.Fatal(err)
+			}
+		}
+		remaining -= size
+	}
+	wg.Wait()
+}
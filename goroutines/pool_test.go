@@ -1,12 +1,15 @@
 package goroutines
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/openziti/foundation/v2/clockz"
 	concurrenz2 "github.com/openziti/foundation/v2/concurrenz"
 	"github.com/stretchr/testify/require"
 )
@@ -14,7 +17,7 @@ import (
 const maxIterations = 10
 
 func TestPoolWithMinTwo(t *testing.T) {
-	val, err := NewPool(PoolConfig{
+	p, clock := newFakeClockPool(t, PoolConfig{
 		QueueSize:   100,
 		MinWorkers:  2,
 		MaxWorkers:  10,
@@ -25,16 +28,13 @@ func TestPoolWithMinTwo(t *testing.T) {
 		},
 	})
 
-	require.NoError(t, err)
-	p := val.(*pool)
-
 	for i := 0; i < maxIterations; i++ {
-		RunPoolTest(t, p)
+		RunPoolTest(t, p, clock)
 	}
 }
 
 func TestPoolWithMinZero(t *testing.T) {
-	val, err := NewPool(PoolConfig{
+	p, clock := newFakeClockPool(t, PoolConfig{
 		QueueSize:   100,
 		MinWorkers:  0,
 		MaxWorkers:  10,
@@ -45,16 +45,13 @@ func TestPoolWithMinZero(t *testing.T) {
 		},
 	})
 
-	require.NoError(t, err)
-	p := val.(*pool)
-
 	for i := 0; i < maxIterations; i++ {
-		RunPoolTest(t, p)
+		RunPoolTest(t, p, clock)
 	}
 }
 
 func TestPoolWithMinOne(t *testing.T) {
-	val, err := NewPool(PoolConfig{
+	p, clock := newFakeClockPool(t, PoolConfig{
 		QueueSize:   100,
 		MinWorkers:  1,
 		MaxWorkers:  10,
@@ -65,81 +62,86 @@ func TestPoolWithMinOne(t *testing.T) {
 		},
 	})
 
-	require.NoError(t, err)
-	p := val.(*pool)
-
 	for i := 0; i < maxIterations; i++ {
-		RunPoolTest(t, p)
+		RunPoolTest(t, p, clock)
 	}
 }
 
-func RunPoolTest(t *testing.T, p *pool) {
+func RunPoolTest(t *testing.T, p *pool, clock *clockz.FakeClock) {
 	req := require.New(t)
-	busyWork := &poolBusier{workPool: p}
+	busyWork := &poolBusier{workPool: p, clock: clock}
+
+	req.Equal(int(p.minWorkers.Load()), int(p.GetWorkerCount()))
 
-	req.Equal(int(p.minWorkers), int(p.GetWorkerCount()))
+	// moves the clock along in work sized steps, so the busy work keeps cycling, until check passes
+	awaitWorkerCount := func(t *testing.T, check func(count uint32) bool) uint32 {
+		require.Eventually(t, func() bool {
+			clock.Advance(busyWorkTime)
+			return check(p.GetWorkerCount())
+		}, time.Second, time.Millisecond)
+		return p.GetWorkerCount()
+	}
+
+	// workers may go idle just after the clock moves, so keep moving it until they've all idled out
+	awaitIdleOut := func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			clock.Advance(p.getIdleTime())
+			return int(p.GetWorkerCount()) == int(p.minWorkers.Load())
+		}, time.Second, time.Millisecond)
+	}
 
 	t.Run("test 2 workers", func(t *testing.T) {
 		busyWork.KeepBusy(2, 0)
-		time.Sleep(50 * time.Millisecond)
-		count := p.GetWorkerCount()
-		req.True(count == 2 || count == 3, "count should be within 1 of min. was %v", count)
-		req.NoError(busyWork.CloseAndWait())
-		time.Sleep(5 * time.Millisecond)
+		count := awaitWorkerCount(t, func(count uint32) bool { return count >= 2 })
+		require.True(t, count == 2 || count == 3, "count should be within 1 of min. was %v", count)
+		require.NoError(t, busyWork.CloseAndWait())
 
-		time.Sleep(150 * time.Millisecond)
-		req.Equal(int(p.minWorkers), int(p.GetWorkerCount()))
+		awaitIdleOut(t)
 	})
 
 	t.Run("test 8 workers", func(t *testing.T) {
 		busyWork.KeepBusy(8, 0)
-
-		for i := 0; i < 10; i++ {
-			if p.GetWorkerCount() == 8 {
-				break
-			}
-			time.Sleep(10 * time.Millisecond)
-		}
-
-		count := p.GetWorkerCount()
-		req.True(count >= 7 && count <= 9, "count should be within 1 of 8 was %v", count)
-		req.NoError(busyWork.CloseAndWait())
-
-		time.Sleep(50 * time.Millisecond)
-		req.True(count >= 7 && count <= 9, "count should be within 1 of 8 was %v", count)
-
-		time.Sleep(150 * time.Millisecond)
-		req.Equal(int(p.minWorkers), int(p.GetWorkerCount()))
+		count := awaitWorkerCount(t, func(count uint32) bool { return count >= 7 })
+		require.True(t, count >= 7 && count <= 9, "count should be within 1 of 8 was %v", count)
+
+		// workers kept busy past the idle time shouldn't retire. The work is held once its busy time is
+		// up, so no more is queued and the count can't grow while the clock moves past the idle time
+		release := busyWork.Hold()
+		defer release()
+		require.Eventually(t, func() bool {
+			clock.Advance(busyWorkTime)
+			// with 7 workers, the last item stays queued
+			held := busyWork.held.Load()
+			return held >= 7 && held == int32(p.GetBusyWorkers())
+		}, time.Second, time.Millisecond)
+		clock.Advance(p.getIdleTime())
+		count = p.GetWorkerCount()
+		require.True(t, count >= 7 && count <= 9, "count should still be within 1 of 8 was %v", count)
+		release()
+		require.NoError(t, busyWork.CloseAndWait())
+
+		awaitIdleOut(t)
 	})
 
 	t.Run("test busy queue", func(t *testing.T) {
 		busyWork.KeepBusy(15, 0)
-		for i := 0; i < 10; i++ {
-			if p.GetWorkerCount() == 10 {
-				break
-			}
-			time.Sleep(10 * time.Millisecond)
-		}
-		req.Equal(10, int(p.GetWorkerCount()))
-		req.NoError(busyWork.CloseAndWait())
+		awaitWorkerCount(t, func(count uint32) bool { return count == 10 })
+		require.NoError(t, busyWork.CloseAndWait())
 
-		time.Sleep(150 * time.Millisecond)
-		req.Equal(int(p.minWorkers), int(p.GetWorkerCount()))
+		awaitIdleOut(t)
 	})
 
 	t.Run("test busy queue with panics", func(t *testing.T) {
 		busyWork.KeepBusy(15, 12)
-		time.Sleep(50 * time.Millisecond)
-		req.Equal(10, int(p.GetWorkerCount()))
-		req.NoError(busyWork.CloseAndWait())
+		awaitWorkerCount(t, func(count uint32) bool { return count == 10 })
+		require.NoError(t, busyWork.CloseAndWait())
 
-		time.Sleep(150 * time.Millisecond)
-		req.Equal(int(p.minWorkers), int(p.GetWorkerCount()))
+		awaitIdleOut(t)
 	})
 }
 
 func TestQueueOrError(t *testing.T) {
-	val, err := NewPool(PoolConfig{
+	val, err := newFullPool(PoolConfig{
 		QueueSize:   1,
 		MinWorkers:  1,
 		MaxWorkers:  1,
@@ -151,12 +153,15 @@ func TestQueueOrError(t *testing.T) {
 	})
 	req := require.New(t)
 	req.NoError(err)
+	defer val.Shutdown()
 
 	running := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
 
 	err = val.QueueOrError(func() {
 		close(running)
-		time.Sleep(100 * time.Millisecond)
+		<-release
 	})
 	req.NoError(err)
 
@@ -166,23 +171,39 @@ func TestQueueOrError(t *testing.T) {
 		req.FailNow("timed out waiting for first task to run")
 	}
 
-	err = val.QueueOrError(func() {
-		time.Sleep(100 * time.Millisecond)
-	})
+	err = val.QueueOrError(func() {})
 	req.NoError(err)
 
-	err = val.QueueOrError(func() {
-		time.Sleep(100 * time.Millisecond)
-	})
+	err = val.QueueOrError(func() {})
 	req.Error(err)
 	req.ErrorIs(err, QueueFullError)
 }
 
+const busyWorkTime = 20 * time.Millisecond
+
+// poolBusier keeps a number of work items in the pool, each of which takes busyWorkTime on the fake clock
 type poolBusier struct {
 	workPool Pool
+	clock    *clockz.FakeClock
 	stopped  atomic.Bool
 	errorC   chan error
 	done     chan struct{}
+	hold     atomic.Pointer[chan struct{}]
+	held     atomic.Int32
+}
+
+// Hold makes work wait once its busy time is up, still occupying its worker, until release is called
+func (self *poolBusier) Hold() (release func()) {
+	gate := make(chan struct{})
+	self.held.Store(0)
+	self.hold.Store(&gate)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			self.hold.Store(nil)
+			close(gate)
+		})
+	}
 }
 
 func (self *poolBusier) KeepBusy(count int, panicCount int) {
@@ -203,7 +224,11 @@ func (self *poolBusier) KeepBusy(count int, panicCount int) {
 				})
 			} else {
 				err = self.workPool.Queue(func() {
-					time.Sleep(20 * time.Millisecond)
+					self.clock.Sleep(busyWorkTime)
+					if gate := self.hold.Load(); gate != nil {
+						self.held.Add(1)
+						<-*gate
+					}
 					sema.Release()
 				})
 			}
@@ -215,27 +240,33 @@ func (self *poolBusier) KeepBusy(count int, panicCount int) {
 	}()
 }
 
+// CloseAndWait stops queueing work, moving the clock along until in-flight work lets the queueing loop exit
 func (self *poolBusier) CloseAndWait() error {
 	self.stopped.Store(true)
-	<-self.done
-	select {
-	case err := <-self.errorC:
-		return err
-	default:
-		return nil
+	for {
+		select {
+		case <-self.done:
+			select {
+			case err := <-self.errorC:
+				return err
+			default:
+				return nil
+			}
+		case <-time.After(time.Millisecond):
+			self.clock.Advance(busyWorkTime)
+		}
 	}
 }
 
 func TestShutdownAndWait(t *testing.T) {
 	t.Run("waits for in-flight work and abandons queued work", func(t *testing.T) {
 		req := require.New(t)
-		p, err := NewPool(PoolConfig{
+		p, clock := newFakeClockPool(t, PoolConfig{
 			QueueSize:  5,
 			MinWorkers: 0,
 			MaxWorkers: 1,
 			IdleTime:   time.Second,
 		})
-		req.NoError(err)
 
 		started := make(chan struct{})
 		release := make(chan struct{})
@@ -259,14 +290,16 @@ func TestShutdownAndWait(t *testing.T) {
 			req.NoError(p.QueueOrError(func() { ran.Add(1) }))
 		}
 
+		timers := clock.TimerCount()
 		done := make(chan error, 1)
 		go func() { done <- p.ShutdownAndWait(5*time.Second) }()
 
 		// must not return while the in-flight work is still running
+		req.NoError(clock.AwaitTimers(timers+1, time.Second))
 		select {
 		case <-done:
 			req.FailNow("ShutdownAndWait returned before in-flight work completed")
-		case <-time.After(100 * time.Millisecond):
+		default:
 		}
 
 		close(release)
@@ -283,33 +316,32 @@ func TestShutdownAndWait(t *testing.T) {
 
 	t.Run("returns immediately when no workers are running", func(t *testing.T) {
 		req := require.New(t)
-		p, err := NewPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		p, err := newFullPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
 		req.NoError(err)
 		req.NoError(p.ShutdownAndWait(time.Second))
 	})
 
 	t.Run("times out when in-flight work does not complete", func(t *testing.T) {
 		req := require.New(t)
-		p, err := NewPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
-		req.NoError(err)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Hour})
 
-		started := make(chan struct{})
 		release := make(chan struct{})
-		req.NoError(p.QueueOrError(func() {
-			close(started)
-			<-release
-		}))
+		startBlockingWork(t, p, release)
+
+		result := make(chan error, 1)
+		go func() { result <- p.ShutdownAndWait(time.Minute) }()
+
+		// the worker's idle timer, and the shutdown timeout
+		req.NoError(clock.AwaitTimers(2, time.Second))
+		clock.Advance(time.Minute)
 
 		select {
-		case <-started:
+		case err := <-result:
+			req.ErrorIs(err, TimeoutError)
 		case <-time.After(time.Second):
-			req.FailNow("timed out waiting for in-flight work to start")
+			req.FailNow("ShutdownAndWait should have timed out")
 		}
 
-		err = p.ShutdownAndWait(100 * time.Millisecond)
-		req.Error(err)
-		req.ErrorIs(err, TimeoutError)
-
 		close(release) // let the worker exit cleanly
 	})
 }
@@ -317,24 +349,25 @@ func TestShutdownAndWait(t *testing.T) {
 func TestAwaitIdle(t *testing.T) {
 	t.Run("waits until submitted work completes", func(t *testing.T) {
 		req := require.New(t)
-		p, err := NewPool(PoolConfig{QueueSize: 5, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
-		req.NoError(err)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 5, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
 
 		release := make(chan struct{})
 		var completed atomic.Bool
+		startBlockingWork(t, p, release)
 		req.NoError(p.QueueOrError(func() {
-			<-release
 			completed.Store(true)
 		}))
 
+		timers := clock.TimerCount()
 		got := make(chan error, 1)
 		go func() { got <- p.AwaitIdle(5 * time.Second) }()
 
 		// must not return while the work is still running
+		req.NoError(clock.AwaitTimers(timers+1, time.Second))
 		select {
 		case <-got:
 			req.FailNow("AwaitIdle returned before work completed")
-		case <-time.After(100 * time.Millisecond):
+		default:
 		}
 
 		close(release)
@@ -350,29 +383,44 @@ func TestAwaitIdle(t *testing.T) {
 
 	t.Run("returns immediately when no work is outstanding", func(t *testing.T) {
 		req := require.New(t)
-		p, err := NewPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		p, err := newFullPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
 		req.NoError(err)
 		req.NoError(p.AwaitIdle(time.Second))
 	})
 
 	t.Run("times out when work does not complete", func(t *testing.T) {
 		req := require.New(t)
-		p, err := NewPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
-		req.NoError(err)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Hour})
 
 		release := make(chan struct{})
-		req.NoError(p.QueueOrError(func() { <-release }))
+		defer close(release)
+		startBlockingWork(t, p, release)
 
-		err = p.AwaitIdle(100 * time.Millisecond)
-		req.Error(err)
-		req.ErrorIs(err, TimeoutError)
+		result := make(chan error, 1)
+		go func() { result <- p.AwaitIdle(time.Minute) }()
 
-		close(release)
+		// the worker's idle timer, and the wait timeout
+		req.NoError(clock.AwaitTimers(2, time.Second))
+
+		clock.Advance(time.Minute - time.Nanosecond)
+		select {
+		case <-result:
+			req.FailNow("AwaitIdle returned before its timeout")
+		default:
+		}
+
+		clock.Advance(time.Nanosecond)
+		select {
+		case err := <-result:
+			req.ErrorIs(err, TimeoutError)
+		case <-time.After(time.Second):
+			req.FailNow("AwaitIdle should have timed out")
+		}
 	})
 
 	t.Run("rejected submissions do not leak outstanding work", func(t *testing.T) {
 		req := require.New(t)
-		p, err := NewPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		p, err := newFullPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
 		req.NoError(err)
 
 		started := make(chan struct{})
@@ -399,3 +447,523 @@ func TestAwaitIdle(t *testing.T) {
 		req.Equal(uint32(0), p.GetOutstanding())
 	})
 }
+
+func TestPriorityQueueing(t *testing.T) {
+	req := require.New(t)
+	p, _ := newFakeClockPool(t, PoolConfig{
+		QueueSize:     10,
+		MinWorkers:    0,
+		MaxWorkers:    1,
+		IdleTime:      time.Second,
+		PriorityBurst: 2,
+	})
+
+	release := make(chan struct{})
+	startBlockingWork(t, p, release)
+
+	var order []string
+	record := func(s string) func() {
+		return func() {
+			order = append(order, s)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		req.NoError(p.QueuePriorityOrError(PriorityLow, record("low")))
+	}
+	for i := 0; i < 6; i++ {
+		req.NoError(p.QueuePriorityOrError(PriorityHigh, record("high")))
+	}
+	req.NoError(p.QueuePriorityOrError(PriorityNormal, record("normal")))
+
+	req.Equal(uint32(9), p.GetQueueSize())
+	req.Equal(uint32(6), p.GetPriorityQueueSize(PriorityHigh))
+	req.Equal(uint32(1), p.GetPriorityQueueSize(PriorityNormal))
+	req.Equal(uint32(2), p.GetPriorityQueueSize(PriorityLow))
+
+	req.Error(p.QueuePriority(Priority(numPriorities), func() {}))
+
+	close(release)
+	req.NoError(p.AwaitIdle(time.Second))
+
+	// high priority work goes first, but waiting lower priority work gets a turn every PriorityBurst items
+	req.Equal([]string{"high", "high", "low", "normal", "high", "high", "low", "high", "high"}, order)
+}
+
+func TestQueueCtx(t *testing.T) {
+	newBlockedPool := func(t *testing.T) (*pool, *clockz.FakeClock, chan struct{}) {
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		release := make(chan struct{})
+		startBlockingWork(t, p, release)
+		return p, clock, release
+	}
+
+	t.Run("passes the context to the work", func(t *testing.T) {
+		req := require.New(t)
+		p, err := newFullPool(PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		req.NoError(err)
+		defer p.Shutdown()
+
+		type ctxKey struct{}
+		ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+		result := make(chan interface{}, 1)
+		req.NoError(p.QueueCtx(ctx, func(ctx context.Context) {
+			result <- ctx.Value(ctxKey{})
+		}))
+		req.Equal("value", <-result)
+	})
+
+	t.Run("skips queued work whose context is done", func(t *testing.T) {
+		req := require.New(t)
+		p, _, release := newBlockedPool(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var ran atomic.Bool
+		req.NoError(p.QueueCtx(ctx, func(context.Context) {
+			ran.Store(true)
+		}))
+		cancel()
+
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+		req.False(ran.Load())
+		req.Equal(uint64(1), p.GetCancelled())
+
+		stats := p.Stats()
+		req.Equal(uint64(1), stats.Cancelled)
+		req.Equal(uint64(1), stats.Completed, "only the blocking work should be counted as completed")
+		req.Equal(uint64(1), stats.QueueWait.Count)
+	})
+
+	t.Run("stops waiting for queue space when the context is done", func(t *testing.T) {
+		req := require.New(t)
+		p, clock, release := newBlockedPool(t)
+		defer close(release)
+
+		// fill the single queue slot
+		req.NoError(p.QueueOrError(func() {}))
+
+		ctx, cancel := clockz.WithTimeout(context.Background(), clock, 20*time.Millisecond)
+		defer cancel()
+		result := make(chan error, 1)
+		go func() { result <- p.QueueCtx(ctx, func(context.Context) {}) }()
+
+		clock.Advance(20 * time.Millisecond)
+		req.ErrorIs(<-result, context.DeadlineExceeded)
+		req.Equal(uint64(1), p.GetCancelled())
+		req.Equal(uint32(2), p.GetOutstanding())
+
+		err := p.QueueCtx(ctx, func(context.Context) {})
+		req.ErrorIs(err, context.DeadlineExceeded)
+		req.Equal(uint64(2), p.GetCancelled())
+	})
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("runs queued work before shutting down", func(t *testing.T) {
+		req := require.New(t)
+		p, err := newFullPool(PoolConfig{QueueSize: 5, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		req.NoError(err)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var ran atomic.Int32
+		req.NoError(p.QueueOrError(func() {
+			ran.Add(1)
+			close(started)
+			<-release
+		}))
+
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			req.FailNow("timed out waiting for in-flight work to start")
+		}
+
+		for i := 0; i < 3; i++ {
+			req.NoError(p.QueueOrError(func() { ran.Add(1) }))
+		}
+
+		type drainResult struct {
+			abandoned []func()
+			err       error
+		}
+		done := make(chan drainResult, 1)
+		go func() {
+			abandoned, err := p.Drain(5 * time.Second)
+			done <- drainResult{abandoned, err}
+		}()
+
+		// new work is rejected once draining starts
+		require.Eventually(t, func() bool {
+			return errors.Is(p.QueueOrError(func() {}), PoolStoppedError)
+		}, time.Second, time.Millisecond)
+		req.ErrorIs(p.Queue(func() {}), PoolStoppedError)
+
+		close(release)
+
+		select {
+		case result := <-done:
+			req.NoError(result.err)
+			req.Empty(result.abandoned)
+		case <-time.After(time.Second):
+			req.FailNow("Drain did not return after queued work completed")
+		}
+
+		req.Equal(int32(4), ran.Load(), "queued work should run during a drain")
+	})
+
+	t.Run("returns abandoned work on timeout", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 5, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		defer close(release)
+		startBlockingWork(t, p, release)
+
+		var ran atomic.Int32
+		for i := 0; i < 2; i++ {
+			req.NoError(p.QueuePriorityOrError(PriorityLow, func() { ran.Add(1) }))
+		}
+
+		type drainResult struct {
+			abandoned []func()
+			err       error
+		}
+		timers := clock.TimerCount()
+		done := make(chan drainResult, 1)
+		go func() {
+			abandoned, err := p.Drain(50 * time.Millisecond)
+			done <- drainResult{abandoned, err}
+		}()
+
+		req.NoError(clock.AwaitTimers(timers+1, time.Second))
+		clock.Advance(50 * time.Millisecond)
+		result := <-done
+		req.ErrorIs(result.err, TimeoutError)
+		abandoned := result.abandoned
+		req.Len(abandoned, 2)
+		req.Equal(uint32(0), p.GetQueueSize())
+		req.Equal(uint32(1), p.GetOutstanding(), "only the in-flight work should be outstanding")
+
+		for _, work := range abandoned {
+			work()
+		}
+		req.Equal(int32(2), ran.Load())
+	})
+}
+
+func TestAwaitCtx(t *testing.T) {
+	t.Run("AwaitIdleCtx wakes when work completes", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 5, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		req.NoError(p.QueueOrError(func() { <-release }))
+
+		ctx, cancel := clockz.WithTimeout(context.Background(), clock, 20*time.Millisecond)
+		defer cancel()
+		timedOut := make(chan error, 1)
+		go func() { timedOut <- p.AwaitIdleCtx(ctx) }()
+		clock.Advance(20 * time.Millisecond)
+		req.ErrorIs(<-timedOut, context.DeadlineExceeded)
+
+		got := make(chan error, 1)
+		go func() { got <- p.AwaitIdleCtx(context.Background()) }()
+
+		close(release)
+		select {
+		case err := <-got:
+			req.NoError(err)
+		case <-time.After(time.Second):
+			req.FailNow("AwaitIdleCtx did not return after work completed")
+		}
+	})
+
+	t.Run("ShutdownAndWaitCtx wakes when workers exit", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 5, MinWorkers: 2, MaxWorkers: 2, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		startBlockingWork(t, p, release)
+
+		ctx, cancel := clockz.WithTimeout(context.Background(), clock, 20*time.Millisecond)
+		defer cancel()
+		timedOut := make(chan error, 1)
+		go func() { timedOut <- p.ShutdownAndWaitCtx(ctx) }()
+		clock.Advance(20 * time.Millisecond)
+		req.ErrorIs(<-timedOut, context.DeadlineExceeded)
+
+		close(release)
+		req.NoError(p.ShutdownAndWaitCtx(context.Background()))
+		req.Equal(uint32(0), p.GetWorkerCount())
+	})
+}
+
+func TestResize(t *testing.T) {
+	t.Run("raising min starts workers and lowering it lets them idle out", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 1, MaxWorkers: 10, IdleTime: 50 * time.Millisecond})
+
+		req.NoError(p.SetMinWorkers(5))
+		req.Equal(uint32(5), p.GetWorkerCount())
+
+		req.NoError(p.SetMinWorkers(2))
+		require.Eventually(t, func() bool {
+			clock.Advance(50 * time.Millisecond)
+			return p.GetWorkerCount() == 2
+		}, time.Second, time.Millisecond)
+
+		// workers at the minimum don't idle out
+		req.NoError(clock.AwaitTimers(2, time.Second))
+		clock.Advance(150 * time.Millisecond)
+		req.NoError(clock.AwaitTimers(2, time.Second))
+		req.Equal(uint32(2), p.GetWorkerCount())
+	})
+
+	t.Run("raising max starts workers for queued work", func(t *testing.T) {
+		req := require.New(t)
+		p, err := newFullPool(PoolConfig{QueueSize: 10, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		req.NoError(err)
+		defer p.Shutdown()
+
+		release := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			req.NoError(p.Queue(func() { <-release }))
+		}
+		require.Eventually(t, func() bool {
+			return p.GetBusyWorkers() == 1
+		}, time.Second, time.Millisecond)
+		req.Equal(uint32(3), p.GetQueueSize())
+
+		req.NoError(p.SetMaxWorkers(4))
+		require.Eventually(t, func() bool {
+			return p.GetBusyWorkers() == 4
+		}, time.Second, time.Millisecond)
+		req.Equal(uint32(4), p.GetWorkerCount())
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+	})
+
+	t.Run("lowering max retires workers after their current work", func(t *testing.T) {
+		req := require.New(t)
+		p, err := newFullPool(PoolConfig{QueueSize: 10, MinWorkers: 4, MaxWorkers: 4, IdleTime: time.Minute})
+		req.NoError(err)
+		defer p.Shutdown()
+
+		release := make(chan struct{})
+		req.NoError(p.Queue(func() { <-release }))
+		require.Eventually(t, func() bool {
+			return p.GetBusyWorkers() == 1
+		}, time.Second, time.Millisecond)
+
+		req.NoError(p.SetMinWorkers(0))
+		req.NoError(p.SetMaxWorkers(1))
+
+		// the three idle workers retire immediately, the busy one keeps running
+		require.Eventually(t, func() bool {
+			return p.GetWorkerCount() == 1
+		}, time.Second, time.Millisecond)
+		req.Equal(uint32(1), p.GetBusyWorkers())
+
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+
+		for i := 0; i < 5; i++ {
+			req.NoError(p.Queue(func() {}))
+		}
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal(uint32(1), p.GetWorkerCount())
+	})
+
+	t.Run("idle time changes apply to idle workers", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Minute})
+
+		req.NoError(p.Queue(func() {}))
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal(uint32(1), p.GetWorkerCount())
+
+		// the idle worker restarts its timer using the new idle time
+		p.SetIdleTime(10 * time.Millisecond)
+		require.Eventually(t, func() bool {
+			clock.Advance(10 * time.Millisecond)
+			return p.GetWorkerCount() == 0
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("rejects limits which would cross", func(t *testing.T) {
+		req := require.New(t)
+		p, err := newFullPool(PoolConfig{QueueSize: 1, MinWorkers: 2, MaxWorkers: 4, IdleTime: time.Second})
+		req.NoError(err)
+		defer p.Shutdown()
+
+		req.Error(p.SetMinWorkers(5))
+		req.Error(p.SetMaxWorkers(1))
+		req.Error(p.SetMaxWorkers(0))
+		req.NoError(p.SetMaxWorkers(2))
+		req.NoError(p.SetMinWorkers(2))
+	})
+}
+
+// newFakeClockPool returns a pool whose timing is controlled by a fake clock
+func newFakeClockPool(t *testing.T, config PoolConfig) (*pool, *clockz.FakeClock) {
+	clock := clockz.NewFakeClock(time.Now())
+	config.Clock = clock
+	p, err := newFullPool(config)
+	require.NoError(t, err)
+	t.Cleanup(p.Shutdown)
+	return p.(*pool), clock
+}
+
+// advanceUntilReceived moves the clock along in steps until a value can be received from c
+func advanceUntilReceived[T any](t *testing.T, clock *clockz.FakeClock, step time.Duration, c <-chan T) T {
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case val := <-c:
+			return val
+		case <-deadline:
+			require.FailNow(t, "timed out moving the clock along")
+		case <-time.After(time.Millisecond):
+			clock.Advance(step)
+		}
+	}
+}
+
+func TestNewPoolImplementsOptionalInterfaces(t *testing.T) {
+	p, err := NewPool(PoolConfig{QueueSize: 1, MaxWorkers: 1})
+	require.NoError(t, err)
+	defer p.Shutdown()
+
+	require.Implements(t, (*PriorityPool)(nil), p)
+	require.Implements(t, (*ContextPool)(nil), p)
+	require.Implements(t, (*DrainablePool)(nil), p)
+	require.Implements(t, (*ResizablePool)(nil), p)
+	require.Implements(t, (*InspectablePool)(nil), p)
+	require.Implements(t, (*SchedulingPool)(nil), p)
+	require.Implements(t, (*BatchPool)(nil), p)
+}
+
+// newFullPool creates a pool with NewPool, returning it as the fullPool it always is
+func newFullPool(config PoolConfig) (fullPool, error) {
+	p, err := NewPool(config)
+	if err != nil {
+		return nil, err
+	}
+	return p.(fullPool), nil
+}
+
+// startBlockingWork queues work which runs until release is closed, and waits for it to start
+func startBlockingWork(t *testing.T, p Pool, release <-chan struct{}) {
+	started := make(chan struct{})
+	require.NoError(t, p.Queue(func() {
+		close(started)
+		<-release
+	}))
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		require.FailNow(t, "timed out waiting for blocking work to start")
+	}
+}
+
+func TestPoolTiming(t *testing.T) {
+	t.Run("idle workers above min exit after the idle time", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 4, MinWorkers: 2, MaxWorkers: 2, IdleTime: time.Minute})
+		req.NoError(p.SetMinWorkers(1))
+
+		// both workers are idle, each with an idle timer
+		req.NoError(clock.AwaitTimers(2, time.Second))
+		clock.Advance(time.Minute - time.Nanosecond)
+		req.Equal(uint32(2), p.GetWorkerCount())
+
+		clock.Advance(time.Nanosecond)
+		require.Eventually(t, func() bool {
+			return p.GetWorkerCount() == 1
+		}, time.Second, time.Millisecond)
+
+		// the remaining worker is at min, so it stays
+		req.NoError(clock.AwaitTimers(1, time.Second))
+		clock.Advance(time.Hour)
+		req.NoError(clock.AwaitTimers(1, time.Second))
+		req.Equal(uint32(1), p.GetWorkerCount())
+	})
+
+	t.Run("work queued as the last worker exits is picked up", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Minute})
+
+		req.NoError(p.Queue(func() {}))
+		req.NoError(p.AwaitIdle(time.Second))
+		req.NoError(clock.AwaitTimers(1, time.Second))
+		clock.Advance(time.Minute)
+
+		// the last worker to exit schedules a check for work which raced with its exit
+		require.Eventually(t, func() bool {
+			return p.GetWorkerCount() == 0
+		}, time.Second, time.Millisecond)
+		req.NoError(clock.AwaitTimers(1, time.Second))
+
+		// queue work the way a submitter which raced with the exit would have, after its check for workers
+		done := make(chan struct{})
+		p.incrOutstanding()
+		p.queues[PriorityNormal] <- queuedWork{work: func() { close(done) }, queuedAt: clock.Now()}
+		p.incrQueueSize(PriorityNormal)
+
+		clock.Advance(99 * time.Millisecond)
+		select {
+		case <-done:
+			req.FailNow("no worker should be running yet")
+		default:
+		}
+
+		clock.Advance(time.Millisecond)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			req.FailNow("a worker should have been started for the queued work")
+		}
+	})
+
+	t.Run("QueueWithTimeout times out when the queue stays full", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Hour})
+
+		release := make(chan struct{})
+		defer close(release)
+		startBlockingWork(t, p, release)
+		req.NoError(p.QueueOrError(func() {}))
+
+		result := make(chan error, 1)
+		go func() { result <- p.QueueWithTimeout(func() {}, time.Second) }()
+
+		// the worker's idle timer, and the queue timeout
+		req.NoError(clock.AwaitTimers(2, time.Second))
+		clock.Advance(time.Second)
+
+		select {
+		case err := <-result:
+			req.ErrorIs(err, TimeoutError)
+		case <-time.After(time.Second):
+			req.FailNow("QueueWithTimeout should have timed out")
+		}
+		req.Equal(uint64(1), p.Stats().RejectedTimeout)
+	})
+
+	t.Run("queue wait and run time use the clock", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Hour})
+
+		req.NoError(p.Queue(func() { clock.Sleep(time.Second) }))
+		req.NoError(clock.AwaitTimers(2, time.Second))
+		clock.Advance(time.Second)
+		req.NoError(p.AwaitIdle(time.Second))
+
+		stats := p.Stats()
+		req.Equal(time.Second, stats.RunTime.Max)
+		req.Equal(time.Duration(0), stats.QueueWait.Max)
+	})
+}
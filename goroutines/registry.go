@@ -0,0 +1,305 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/openziti/foundation/v2/debugz"
+	"github.com/pkg/errors"
+)
+
+// DefaultPoolRegistry is the registry named pools are added to, unless PoolConfig.Registry is set. Its
+// contents are included in debugz.GenerateDebugDump.
+var DefaultPoolRegistry = NewPoolRegistry()
+
+func init() {
+	debugz.AddDebugDumpSource("goroutine pools", DefaultPoolRegistry.Dump)
+}
+
+// A PoolRegistry tracks named pools, so every pool in a process can be listed and inspected from one
+// place. Pools are added when they're created with PoolConfig.Name set, and removed when they shut down.
+type PoolRegistry struct {
+	lock  sync.Mutex
+	pools map[string]registeredPool
+}
+
+// registeredPool is implemented by pools which can be added to a PoolRegistry
+type registeredPool interface {
+	InspectablePool
+	getBusyWorkers() []*workerState
+	getClock() clockz.Clock
+}
+
+// PoolInfo describes a registered pool, as returned by PoolRegistry.Inspect
+type PoolInfo struct {
+	Name string
+	// The pool's configuration, with the current min workers, max workers and idle time
+	Config PoolConfig
+	Stats  *PoolStats
+	// The workers which are currently running work, ordered by worker number
+	BusyWorkers []BusyWorkerInfo
+}
+
+// BusyWorkerInfo describes a worker which is running work
+type BusyWorkerInfo struct {
+	WorkerNumber uint32
+	// When the worker started running its current work
+	BusySince time.Time
+	// How long the worker has been running its current work, measured with the pool's clock
+	BusyFor time.Duration
+	// The worker goroutine's stack. Only populated if stacks were requested
+	Stack string
+}
+
+func NewPoolRegistry() *PoolRegistry {
+	return &PoolRegistry{
+		pools: map[string]registeredPool{},
+	}
+}
+
+// joinRegistry adds a named pool to its configured registry, returning the registry, or nil if the pool
+// isn't named. A pool shut down using CloseNotify only notices once a worker sees it, so this also makes
+// sure the pool leaves the registry even if it has no workers.
+func joinRegistry(pool registeredPool, config *PoolConfig, closeNotify <-chan struct{}) (*PoolRegistry, error) {
+	if config.Name == "" {
+		return nil, nil
+	}
+
+	registry := config.Registry
+	if registry == nil {
+		registry = DefaultPoolRegistry
+	}
+
+	if err := registry.add(pool); err != nil {
+		return nil, err
+	}
+
+	if config.CloseNotify != nil {
+		go func() {
+			select {
+			case <-config.CloseNotify:
+				pool.Shutdown()
+			case <-closeNotify:
+			}
+		}()
+	}
+
+	return registry, nil
+}
+
+func (self *PoolRegistry) add(pool registeredPool) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, found := self.pools[pool.GetName()]; found {
+		return errors.Errorf("a pool named '%v' is already registered", pool.GetName())
+	}
+	self.pools[pool.GetName()] = pool
+	return nil
+}
+
+func (self *PoolRegistry) remove(pool registeredPool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// only remove the entry if it's this pool, not a newer pool which has reused the name
+	if current, found := self.pools[pool.GetName()]; found && current == pool {
+		delete(self.pools, pool.GetName())
+	}
+}
+
+// List returns the names of the registered pools, in order
+func (self *PoolRegistry) List() []string {
+	self.lock.Lock()
+	result := make([]string, 0, len(self.pools))
+	for name := range self.pools {
+		result = append(result, name)
+	}
+	self.lock.Unlock()
+
+	sort.Strings(result)
+	return result
+}
+
+// Get returns the pool registered with the given name, or nil if there isn't one
+func (self *PoolRegistry) Get(name string) Pool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if pool, found := self.pools[name]; found {
+		return pool
+	}
+	return nil
+}
+
+// Inspect returns information on the pool registered with the given name, or nil if there isn't one.
+// If includeStacks is true, the stacks of the pool's busy workers are included.
+func (self *PoolRegistry) Inspect(name string, includeStacks bool) *PoolInfo {
+	self.lock.Lock()
+	pool, found := self.pools[name]
+	self.lock.Unlock()
+
+	if !found {
+		return nil
+	}
+
+	var stacks map[uint64]string
+	if includeStacks {
+		stacks = parseGoroutineStacks(debugz.GenerateStack())
+	}
+	return inspectPool(pool, stacks)
+}
+
+// InspectAll returns information on every registered pool, ordered by name. If includeStacks is true,
+// the stacks of each pool's busy workers are included.
+func (self *PoolRegistry) InspectAll(includeStacks bool) []*PoolInfo {
+	self.lock.Lock()
+	pools := make([]registeredPool, 0, len(self.pools))
+	for _, pool := range self.pools {
+		pools = append(pools, pool)
+	}
+	self.lock.Unlock()
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].GetName() < pools[j].GetName()
+	})
+
+	// take one stack dump for all the pools
+	var stacks map[uint64]string
+	if includeStacks {
+		stacks = parseGoroutineStacks(debugz.GenerateStack())
+	}
+
+	result := make([]*PoolInfo, 0, len(pools))
+	for _, pool := range pools {
+		result = append(result, inspectPool(pool, stacks))
+	}
+	return result
+}
+
+// Dump writes a human-readable description of every registered pool, including busy worker stacks
+func (self *PoolRegistry) Dump(w io.Writer) {
+	for _, info := range self.InspectAll(true) {
+		config := &info.Config
+		stats := info.Stats
+
+		_, _ = fmt.Fprintf(w, "pool %v: min workers=%v, max workers=%v, idle time=%v, queue size=%v\n",
+			info.Name, config.MinWorkers, config.MaxWorkers, config.IdleTime, config.QueueSize)
+		_, _ = fmt.Fprintf(w, "  workers=%v, busy=%v, queued=%v, peak queued=%v, outstanding=%v\n",
+			stats.Workers, stats.BusyWorkers, stats.QueueSize, stats.PeakQueueSize, stats.Outstanding)
+		_, _ = fmt.Fprintf(w, "  completed=%v, rejected queue full=%v, rejected timeout=%v, cancelled=%v, panics=%v\n",
+			stats.Completed, stats.RejectedQueueFull, stats.RejectedTimeout, stats.Cancelled, stats.Panics)
+		_, _ = fmt.Fprintf(w, "  workers spawned=%v, retired=%v, stuck=%v, deadlines exceeded=%v\n",
+			stats.WorkersSpawned, stats.WorkersRetired, stats.StuckWorkers, stats.DeadlinesExceeded)
+		_, _ = fmt.Fprintf(w, "  queue wait mean=%v, p99=%v, max=%v\n",
+			stats.QueueWait.Mean(), stats.QueueWait.Quantile(0.99), stats.QueueWait.Max)
+		_, _ = fmt.Fprintf(w, "  run time mean=%v, p99=%v, max=%v\n",
+			stats.RunTime.Mean(), stats.RunTime.Quantile(0.99), stats.RunTime.Max)
+
+		for _, worker := range info.BusyWorkers {
+			_, _ = fmt.Fprintf(w, "  worker %v busy for %v\n", worker.WorkerNumber, worker.BusyFor)
+			for _, line := range strings.Split(strings.TrimSpace(worker.Stack), "\n") {
+				_, _ = fmt.Fprintf(w, "    %v\n", line)
+			}
+		}
+	}
+}
+
+func inspectPool(pool registeredPool, stacks map[uint64]string) *PoolInfo {
+	result := &PoolInfo{
+		Name:   pool.GetName(),
+		Config: pool.GetConfig(),
+		Stats:  pool.Stats(),
+	}
+
+	now := pool.getClock().Now()
+	for _, worker := range pool.getBusyWorkers() {
+		// the worker may have finished since it was listed
+		busySince := worker.busySince.Load()
+		if busySince == 0 {
+			continue
+		}
+		result.BusyWorkers = append(result.BusyWorkers, BusyWorkerInfo{
+			WorkerNumber: worker.number,
+			BusySince:    time.Unix(0, busySince),
+			BusyFor:      now.Sub(time.Unix(0, busySince)),
+			Stack:        stacks[worker.goroutineId],
+		})
+	}
+
+	sort.Slice(result.BusyWorkers, func(i, j int) bool {
+		return result.BusyWorkers[i].WorkerNumber < result.BusyWorkers[j].WorkerNumber
+	})
+
+	return result
+}
+
+// workerState tracks a worker goroutine, so busy workers can be found and matched to their stacks
+type workerState struct {
+	number      uint32
+	goroutineId uint64
+	// when the worker started its current work, in unix nanos, or zero if the worker is idle
+	busySince atomic.Int64
+	// the options of the worker's current work. Only accessed by the worker goroutine
+	task *taskOptions
+}
+
+// currentGoroutineId returns the id of the calling goroutine, as shown in stack traces. The runtime
+// doesn't expose it, so it's parsed from the header of the goroutine's stack
+func currentGoroutineId() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	id, _ := parseGoroutineHeader(buf)
+	return id
+}
+
+// parseGoroutineHeader parses the id from a stack header of the form 'goroutine 123 [running]:'
+func parseGoroutineHeader(header []byte) (uint64, bool) {
+	rest, found := bytes.CutPrefix(header, []byte("goroutine "))
+	if !found {
+		return 0, false
+	}
+	idBytes, _, found := bytes.Cut(rest, []byte(" "))
+	if !found {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(string(idBytes), 10, 64)
+	return id, err == nil
+}
+
+// parseGoroutineStacks splits a full stack dump, as returned by debugz.GenerateStack, into the stacks of
+// individual goroutines, keyed by goroutine id
+func parseGoroutineStacks(dump string) map[uint64]string {
+	result := map[uint64]string{}
+	for _, stack := range strings.Split(dump, "\n\n") {
+		if id, ok := parseGoroutineHeader([]byte(stack)); ok {
+			result[id] = stack
+		}
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/debugz"
+	"github.com/stretchr/testify/require"
+)
+
+func blockInRegistryTest(release <-chan struct{}) {
+	<-release
+}
+
+func TestPoolRegistry(t *testing.T) {
+	req := require.New(t)
+	registry := NewPoolRegistry()
+
+	newPool := func(name string, closeNotify <-chan struct{}) fullPool {
+		p, err := newFullPool(PoolConfig{
+			Name:        name,
+			Registry:    registry,
+			QueueSize:   4,
+			MinWorkers:  0,
+			MaxWorkers:  2,
+			IdleTime:    time.Second,
+			CloseNotify: closeNotify,
+		})
+		req.NoError(err)
+		return p
+	}
+
+	closeNotify := make(chan struct{})
+	first := newPool("first", nil)
+	second := newPool("second", closeNotify)
+	req.Equal([]string{"first", "second"}, registry.List())
+	req.Equal(first, registry.Get("first"))
+	req.Equal(second, registry.Get("second"))
+	req.Nil(registry.Get("third"))
+
+	_, err := newFullPool(PoolConfig{Name: "first", Registry: registry, MaxWorkers: 1})
+	req.Error(err, "names must be unique within a registry")
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	req.NoError(first.Queue(func() {
+		close(started)
+		blockInRegistryTest(release)
+	}))
+	<-started
+
+	info := registry.Inspect("first", true)
+	req.NotNil(info)
+	req.Equal("first", info.Name)
+	req.Equal(uint32(2), info.Config.MaxWorkers)
+	req.Equal(uint32(1), info.Stats.BusyWorkers)
+	req.Len(info.BusyWorkers, 1)
+	req.Equal(uint32(1), info.BusyWorkers[0].WorkerNumber)
+	req.Contains(info.BusyWorkers[0].Stack, "blockInRegistryTest")
+
+	req.NoError(first.SetMaxWorkers(3))
+	info = registry.Inspect("first", false)
+	req.Equal(uint32(3), info.Config.MaxWorkers)
+	req.Empty(info.BusyWorkers[0].Stack)
+
+	all := registry.InspectAll(true)
+	req.Len(all, 2)
+	req.Equal("second", all[1].Name)
+	req.Empty(all[1].BusyWorkers)
+
+	out := &strings.Builder{}
+	registry.Dump(out)
+	req.Contains(out.String(), "pool first: min workers=0, max workers=3")
+	req.Contains(out.String(), "pool second:")
+	req.Contains(out.String(), "blockInRegistryTest")
+
+	// pools leave the registry on shutdown, whether direct or through CloseNotify
+	first.Shutdown()
+	req.Equal([]string{"second"}, registry.List())
+
+	close(closeNotify)
+	require.Eventually(t, func() bool {
+		return len(registry.List()) == 0
+	}, time.Second, time.Millisecond)
+
+	// the name can be reused once the original pool has left
+	newPool("first", nil).Shutdown()
+}
+
+func TestPoolRegistryDumpUsesPoolClock(t *testing.T) {
+	req := require.New(t)
+	registry := NewPoolRegistry()
+	p, clock := newFakeClockPool(t, PoolConfig{Name: "clocked", Registry: registry, QueueSize: 1, MaxWorkers: 1})
+
+	release := make(chan struct{})
+	defer close(release)
+	startBlockingWork(t, p, release)
+
+	clock.Advance(90 * time.Second)
+	info := registry.Inspect("clocked", false)
+	req.Len(info.BusyWorkers, 1)
+	req.Equal(90*time.Second, info.BusyWorkers[0].BusyFor)
+
+	out := &strings.Builder{}
+	registry.Dump(out)
+	req.Contains(out.String(), "worker 1 busy for 1m30s")
+}
+
+func TestDefaultPoolRegistryDebugDump(t *testing.T) {
+	req := require.New(t)
+
+	p, err := newFullPool(PoolConfig{Name: "debug-dump-test", QueueSize: 1, MaxWorkers: 1, IdleTime: time.Second})
+	req.NoError(err)
+	defer p.Shutdown()
+
+	dump := debugz.GenerateDebugDump()
+	req.Contains(dump, "=== goroutine pools ===")
+	req.Contains(dump, "pool debug-dump-test:")
+	req.Contains(dump, "=== goroutines ===")
+}
@@ -0,0 +1,339 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/pkg/errors"
+)
+
+// A ScheduledTask is a handle to work scheduled with ScheduleAfter, ScheduleAt or ScheduleEvery
+type ScheduledTask interface {
+	// Cancel stops the task from being queued again. Returns true if this call cancelled the task, or
+	// false if it was already cancelled, had already been queued for the last time, or the pool has
+	// shut down. A run which has already been queued on the pool is not affected
+	Cancel() bool
+
+	// Done returns a channel which is closed once the task won't be queued again, because it was
+	// cancelled, it was a one-time task which came due and has been handed to the pool, or the pool
+	// shut down
+	Done() <-chan struct{}
+
+	// Err returns the error from the last time the task's work was handed to the pool, or nil if the
+	// pool accepted it. If the task was cancelled because the pool shut down, PoolStoppedError is
+	// returned. For a one-time task, the result is final once Done is closed
+	Err() error
+}
+
+// taskScheduler holds work scheduled on a pool in a single heap ordered by due time, serviced by one
+// goroutine and one timer. The goroutine is started when work is first scheduled, and exits when the
+// pool shuts down, at which point all scheduled tasks are cancelled.
+type taskScheduler struct {
+	lock                sync.Mutex
+	clock               clockz.Clock
+	tasks               scheduledTaskHeap
+	started             bool
+	stopped             bool
+	changed             chan struct{}
+	closeNotify         <-chan struct{}
+	externalCloseNotify <-chan struct{}
+	queue               func(func()) error
+	queueOrError        func(func()) error
+}
+
+func newTaskScheduler(clock clockz.Clock, queue, queueOrError func(func()) error, closeNotify, externalCloseNotify <-chan struct{}) *taskScheduler {
+	return &taskScheduler{
+		clock:               clock,
+		changed:             make(chan struct{}, 1),
+		closeNotify:         closeNotify,
+		externalCloseNotify: externalCloseNotify,
+		queue:               queue,
+		queueOrError:        queueOrError,
+	}
+}
+
+func (self *taskScheduler) ScheduleAfter(delay time.Duration, work func()) (ScheduledTask, error) {
+	return self.schedule(self.clock.Now().Add(delay), 0, work)
+}
+
+func (self *taskScheduler) ScheduleAt(at time.Time, work func()) (ScheduledTask, error) {
+	return self.schedule(at, 0, work)
+}
+
+func (self *taskScheduler) ScheduleEvery(interval time.Duration, work func()) (ScheduledTask, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive, was %v", interval)
+	}
+	return self.schedule(self.clock.Now().Add(interval), interval, work)
+}
+
+func (self *taskScheduler) schedule(at time.Time, interval time.Duration, work func()) (ScheduledTask, error) {
+	task := &scheduledTask{
+		scheduler: self,
+		at:        at,
+		interval:  interval,
+		work:      work,
+		done:      make(chan struct{}),
+		index:     -1,
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.stopped || self.isPoolStopped() {
+		return nil, errors.Wrap(PoolStoppedError, "cannot schedule")
+	}
+
+	if !self.started {
+		self.started = true
+		go self.run()
+	}
+
+	heap.Push(&self.tasks, task)
+	if task.index == 0 {
+		self.notifyChanged()
+	}
+
+	return task, nil
+}
+
+func (self *taskScheduler) isPoolStopped() bool {
+	select {
+	case <-self.closeNotify:
+		return true
+	case <-self.externalCloseNotify:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *taskScheduler) notifyChanged() {
+	select {
+	case self.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (self *taskScheduler) run() {
+	timer := self.clock.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		if next, ok := self.dispatchDue(self.clock.Now()); ok {
+			timer.Reset(self.clock.Until(next))
+		} else {
+			timer.Stop()
+		}
+
+		select {
+		case <-timer.C():
+		case <-self.changed:
+		case <-self.closeNotify:
+			self.stop()
+			return
+		case <-self.externalCloseNotify:
+			self.stop()
+			return
+		}
+	}
+}
+
+// dispatchDue queues all tasks which are due, returning when the next task is due, if there is one
+func (self *taskScheduler) dispatchDue(now time.Time) (time.Time, bool) {
+	self.lock.Lock()
+	var due []*scheduledTask
+	for len(self.tasks) > 0 && !self.tasks[0].at.After(now) {
+		task := self.tasks[0]
+		due = append(due, task)
+		if task.interval > 0 {
+			// schedule from the previous due time, so runs don't drift, but skip any missed runs
+			task.at = task.at.Add(task.interval)
+			if !task.at.After(now) {
+				task.at = now.Add(task.interval)
+			}
+			heap.Fix(&self.tasks, 0)
+		} else {
+			// a one-time task is finished once dispatch has handed it to the pool
+			heap.Pop(&self.tasks)
+		}
+	}
+
+	var next time.Time
+	hasNext := len(self.tasks) > 0
+	if hasNext {
+		next = self.tasks[0].at
+	}
+	self.lock.Unlock()
+
+	for _, task := range due {
+		self.dispatch(task)
+	}
+
+	return next, hasNext
+}
+
+// dispatch queues a task's work on the pool. If the pool's queue is full, the work is queued from a
+// new goroutine, so that one busy pool doesn't delay every other scheduled task. The outcome is recorded
+// on the task, and a one-time task is finished once it's known
+func (self *taskScheduler) dispatch(task *scheduledTask) {
+	work := task.work
+	if task.interval > 0 {
+		// a periodic task stays in the heap, so it may have been cancelled since it was found to be due
+		self.lock.Lock()
+		cancelled := task.index < 0
+		self.lock.Unlock()
+
+		if cancelled || !task.running.CompareAndSwap(false, true) {
+			return
+		}
+		work = func() {
+			defer task.running.Store(false)
+			task.work()
+		}
+	}
+
+	err := self.queueOrError(work)
+	if errors.Is(err, QueueFullError) {
+		go func() {
+			task.dispatched(self.queue(work))
+		}()
+	} else {
+		task.dispatched(err)
+	}
+}
+
+// stop cancels all scheduled tasks once the pool has shut down
+func (self *taskScheduler) stop() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.stopped = true
+	for _, task := range self.tasks {
+		task.index = -1
+		task.setErr(errors.Wrap(PoolStoppedError, "task cancelled"))
+		task.finishLocked()
+	}
+	self.tasks = nil
+}
+
+type scheduledTask struct {
+	scheduler *taskScheduler
+	at        time.Time
+	interval  time.Duration
+	work      func()
+	// set while a run of a periodic task is queued or running
+	running atomic.Bool
+	done    chan struct{}
+	// the error from the last time the task's work was handed to the pool
+	err atomic.Pointer[error]
+	// the task's position in the heap, or -1 if it isn't in the heap. Guarded by the scheduler lock
+	index int
+}
+
+func (self *scheduledTask) Cancel() bool {
+	self.scheduler.lock.Lock()
+	defer self.scheduler.lock.Unlock()
+
+	if self.index < 0 {
+		return false
+	}
+
+	heap.Remove(&self.scheduler.tasks, self.index)
+	self.finishLocked()
+	return true
+}
+
+func (self *scheduledTask) Done() <-chan struct{} {
+	return self.done
+}
+
+func (self *scheduledTask) Err() error {
+	if err := self.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (self *scheduledTask) setErr(err error) {
+	if err == nil {
+		self.err.Store(nil)
+	} else {
+		self.err.Store(&err)
+	}
+}
+
+// dispatched records the outcome of handing the task's work to the pool. A periodic run which wasn't
+// queued no longer counts as running, and a one-time task is finished
+func (self *scheduledTask) dispatched(err error) {
+	self.setErr(err)
+	if self.interval > 0 {
+		if err != nil {
+			self.running.Store(false)
+		}
+		return
+	}
+
+	self.scheduler.lock.Lock()
+	self.finishLocked()
+	self.scheduler.lock.Unlock()
+}
+
+// finishLocked marks the task as never being queued again. The caller must hold the scheduler lock,
+// and must already have removed the task from the heap
+func (self *scheduledTask) finishLocked() {
+	close(self.done)
+}
+
+// scheduledTaskHeap implements heap.Interface, ordering tasks by due time
+type scheduledTaskHeap []*scheduledTask
+
+func (self scheduledTaskHeap) Len() int {
+	return len(self)
+}
+
+func (self scheduledTaskHeap) Less(i, j int) bool {
+	return self[i].at.Before(self[j].at)
+}
+
+func (self scheduledTaskHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].index = i
+	self[j].index = j
+}
+
+func (self *scheduledTaskHeap) Push(x any) {
+	task := x.(*scheduledTask)
+	task.index = len(*self)
+	*self = append(*self, task)
+}
+
+func (self *scheduledTaskHeap) Pop() any {
+	old := *self
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	*self = old[:n-1]
+	return task
+}
@@ -0,0 +1,240 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/stretchr/testify/require"
+)
+
+func requireClosed(t *testing.T, c <-chan struct{}, msg string) {
+	select {
+	case <-c:
+	case <-time.After(time.Second):
+		require.FailNow(t, msg)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	newPools := map[string]func(config PoolConfig) (fullPool, error){
+		"pool": newFullPool,
+		"sharded": func(config PoolConfig) (fullPool, error) {
+			return NewShardedPool(config)
+		},
+	}
+
+	for name, newPool := range newPools {
+		t.Run(name, func(t *testing.T) {
+			newTestPool := func(t *testing.T) (fullPool, *clockz.FakeClock) {
+				clock := clockz.NewFakeClock(time.Now())
+				p, err := newPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second, Clock: clock})
+				require.NoError(t, err)
+				t.Cleanup(p.Shutdown)
+				return p, clock
+			}
+
+			t.Run("runs one-time tasks in due order", func(t *testing.T) {
+				req := require.New(t)
+				p, clock := newTestPool(t)
+
+				var lock sync.Mutex
+				var order []int
+				record := func(val int) func() {
+					return func() {
+						lock.Lock()
+						order = append(order, val)
+						lock.Unlock()
+					}
+				}
+
+				third, err := p.ScheduleAt(clock.Now().Add(60*time.Millisecond), record(3))
+				req.NoError(err)
+				first, err := p.ScheduleAfter(20*time.Millisecond, record(1))
+				req.NoError(err)
+				second, err := p.ScheduleAfter(40*time.Millisecond, record(2))
+				req.NoError(err)
+
+				// done closes when a task is queued, so wait for each to run before the next comes due
+				clock.Advance(20 * time.Millisecond)
+				requireClosed(t, first.Done(), "task should have come due")
+				req.NoError(p.AwaitIdle(time.Second))
+				clock.Advance(20 * time.Millisecond)
+				requireClosed(t, second.Done(), "task should have come due")
+				req.NoError(p.AwaitIdle(time.Second))
+
+				select {
+				case <-third.Done():
+					req.FailNow("task shouldn't come due early")
+				default:
+				}
+
+				clock.Advance(20 * time.Millisecond)
+				requireClosed(t, third.Done(), "task should have come due")
+				req.False(third.Cancel(), "a task which has come due can't be cancelled")
+				req.NoError(third.Err())
+
+				req.NoError(p.AwaitIdle(time.Second))
+				req.Equal([]int{1, 2, 3}, order)
+			})
+
+			t.Run("cancels tasks before they are due", func(t *testing.T) {
+				req := require.New(t)
+				p, clock := newTestPool(t)
+
+				var ran atomic.Bool
+				task, err := p.ScheduleAfter(20*time.Millisecond, func() { ran.Store(true) })
+				req.NoError(err)
+				req.True(task.Cancel())
+				req.False(task.Cancel())
+				requireClosed(t, task.Done(), "cancelled task should be done")
+
+				// tasks are dispatched in due order, so once a later task has run, the cancelled one would have too
+				later, err := p.ScheduleAfter(40*time.Millisecond, func() {})
+				req.NoError(err)
+				clock.Advance(40 * time.Millisecond)
+				requireClosed(t, later.Done(), "later task should have come due")
+				req.NoError(p.AwaitIdle(time.Second))
+				req.False(ran.Load())
+			})
+
+			t.Run("runs periodic tasks until cancelled", func(t *testing.T) {
+				req := require.New(t)
+				p, clock := newTestPool(t)
+
+				var runs atomic.Int32
+				task, err := p.ScheduleEvery(5*time.Millisecond, func() { runs.Add(1) })
+				req.NoError(err)
+
+				require.Eventually(t, func() bool {
+					clock.Advance(5 * time.Millisecond)
+					return runs.Load() >= 3
+				}, time.Second, time.Millisecond)
+
+				req.True(task.Cancel())
+				requireClosed(t, task.Done(), "cancelled task should be done")
+				req.NoError(p.AwaitIdle(time.Second))
+
+				count := runs.Load()
+				later, err := p.ScheduleAfter(20*time.Millisecond, func() {})
+				req.NoError(err)
+				clock.Advance(20 * time.Millisecond)
+				requireClosed(t, later.Done(), "later task should have come due")
+				req.NoError(p.AwaitIdle(time.Second))
+				req.Equal(count, runs.Load(), "no runs should be queued after cancel")
+
+				_, err = p.ScheduleEvery(0, func() {})
+				req.Error(err)
+			})
+
+			t.Run("skips periodic runs while the previous run is busy", func(t *testing.T) {
+				req := require.New(t)
+				p, clock := newTestPool(t)
+
+				var active, maxActive, runs atomic.Int32
+				task, err := p.ScheduleEvery(2*time.Millisecond, func() {
+					if n := active.Add(1); n > maxActive.Load() {
+						maxActive.Store(n)
+					}
+					runs.Add(1)
+					clock.Sleep(10 * time.Millisecond)
+					active.Add(-1)
+				})
+				req.NoError(err)
+
+				require.Eventually(t, func() bool {
+					clock.Advance(2 * time.Millisecond)
+					return runs.Load() >= 3
+				}, time.Second, time.Millisecond)
+				task.Cancel()
+
+				req.Equal(int32(1), maxActive.Load())
+			})
+
+			t.Run("records when the pool rejects a task", func(t *testing.T) {
+				req := require.New(t)
+				p, clock := newTestPool(t)
+
+				release := make(chan struct{})
+				startBlockingWork(t, p, release)
+
+				var ran atomic.Bool
+				task, err := p.ScheduleAfter(time.Second, func() { ran.Store(true) })
+				req.NoError(err)
+
+				// a draining pool rejects new work, but hasn't shut down, so the task comes due
+				drained := make(chan error, 1)
+				go func() {
+					_, err := p.Drain(time.Hour)
+					drained <- err
+				}()
+				req.Eventually(p.(statefulPool).isDraining, time.Second, time.Millisecond)
+
+				clock.Advance(time.Second)
+				requireClosed(t, task.Done(), "task should have come due")
+				req.ErrorIs(task.Err(), PoolStoppedError)
+
+				close(release)
+				req.NoError(<-drained)
+				req.False(ran.Load())
+			})
+
+			t.Run("cancels tasks on shutdown", func(t *testing.T) {
+				req := require.New(t)
+				p, _ := newTestPool(t)
+
+				var ran atomic.Bool
+				once, err := p.ScheduleAfter(time.Hour, func() { ran.Store(true) })
+				req.NoError(err)
+				periodic, err := p.ScheduleEvery(time.Hour, func() { ran.Store(true) })
+				req.NoError(err)
+
+				p.Shutdown()
+				requireClosed(t, once.Done(), "one-time task should be done after shutdown")
+				requireClosed(t, periodic.Done(), "periodic task should be done after shutdown")
+				req.False(once.Cancel())
+				req.False(ran.Load())
+				req.ErrorIs(once.Err(), PoolStoppedError)
+				req.ErrorIs(periodic.Err(), PoolStoppedError)
+
+				_, err = p.ScheduleAfter(time.Millisecond, func() {})
+				req.ErrorIs(err, PoolStoppedError)
+			})
+		})
+	}
+
+	t.Run("stops on close notify", func(t *testing.T) {
+		req := require.New(t)
+		closeNotify := make(chan struct{})
+		p, err := newFullPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second, CloseNotify: closeNotify})
+		req.NoError(err)
+		defer p.Shutdown()
+
+		task, err := p.ScheduleEvery(time.Hour, func() {})
+		req.NoError(err)
+
+		close(closeNotify)
+		requireClosed(t, task.Done(), "task should be done after close notify")
+
+		_, err = p.ScheduleAfter(time.Millisecond, func() {})
+		req.ErrorIs(err, PoolStoppedError)
+	})
+}
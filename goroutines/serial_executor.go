@@ -0,0 +1,268 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/openziti/foundation/v2/logging"
+	"github.com/pkg/errors"
+)
+
+// A SerialExecutor runs work on a Pool, in submission order for each key, with work for different keys
+// running in parallel. At most one work item per key runs at a time, so a key never occupies more than
+// one of the pool's workers. A key's queue is removed as soon as it's empty.
+type SerialExecutor interface {
+	// Execute queues work for the given key. It runs once all previously queued work for the key has
+	// completed. Returns QueueFullError if the key already has MaxQueuedPerKey items queued,
+	// PoolStoppedError if the pool has shut down, or the pool's error if the key's queue can't be
+	// started on the pool
+	Execute(key string, work func()) error
+
+	// GetKeyCount returns the number of keys which have work queued or running
+	GetKeyCount() uint32
+
+	// GetQueuedCount returns the number of work items queued for the given key, not including any
+	// which is running
+	GetQueuedCount(key string) uint32
+}
+
+// SerialExecutorConfig is used to configure a new SerialExecutor
+type SerialExecutorConfig struct {
+	// The pool which runs the work
+	Pool Pool
+	// The maximum number of work items which may be queued for a single key. If zero, the number of
+	// queued items is unlimited
+	MaxQueuedPerKey uint32
+	// Called with work which was accepted for a key, but can't be run because the pool rejected the
+	// key's queue or shut down, along with the pool's error. The handler can run the work elsewhere or
+	// persist it. If not provided, the abandoned work is logged
+	AbandonedWorkHandler func(key string, work []func(), err error)
+}
+
+func (self *SerialExecutorConfig) Validate() error {
+	if self.Pool == nil {
+		return fmt.Errorf("pool must be provided")
+	}
+	return nil
+}
+
+func NewSerialExecutor(config SerialExecutorConfig) (SerialExecutor, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &serialExecutor{
+		pool:             config.Pool,
+		maxQueuedPerKey:  int(config.MaxQueuedPerKey),
+		abandonedHandler: config.AbandonedWorkHandler,
+		queues:           map[string]*serialQueue{},
+	}, nil
+}
+
+type serialExecutor struct {
+	lock             sync.Mutex
+	pool             Pool
+	maxQueuedPerKey  int
+	abandonedHandler func(key string, work []func(), err error)
+	queues           map[string]*serialQueue
+}
+
+// statefulPool is implemented by this package's pools. It lets the executor tell a draining pool, which
+// still runs the work it has accepted, from one which has shut down and abandons it
+type statefulPool interface {
+	isStopped() bool
+	isDraining() bool
+}
+
+// serialQueue holds the work for one key. It's guarded by the executor lock. While it has work, exactly
+// one task which runs it is either queued on the pool or running, and running is true
+type serialQueue struct {
+	key     string
+	work    []func()
+	running bool
+}
+
+func (self *serialExecutor) Execute(key string, work func()) error {
+	if self.poolStopped() {
+		return errors.Wrapf(PoolStoppedError, "cannot queue for key %v", key)
+	}
+
+	self.lock.Lock()
+	queue, found := self.queues[key]
+	if !found {
+		queue = &serialQueue{key: key}
+		self.queues[key] = queue
+	}
+
+	if self.maxQueuedPerKey > 0 && len(queue.work) >= self.maxQueuedPerKey {
+		self.lock.Unlock()
+		return errors.Wrapf(QueueFullError, "cannot queue for key %v", key)
+	}
+
+	queue.work = append(queue.work, work)
+	idx := len(queue.work) - 1
+	start := !queue.running
+	queue.running = true
+	self.lock.Unlock()
+
+	if !start {
+		return nil
+	}
+
+	if err := self.pool.Queue(func() { self.run(queue) }); err != nil {
+		// Nothing runs the queue while running is set, so this call's work is still where it was added.
+		// It's returned to the caller through the error. Work queued for the key by other calls since
+		// then was accepted, so it's handed to the abandoned work handler rather than dropped
+		self.lock.Lock()
+		queue.work = append(queue.work[:idx], queue.work[idx+1:]...)
+		self.lock.Unlock()
+		self.abandon(queue, err)
+		return err
+	}
+
+	return nil
+}
+
+// run runs the key's next work item, then hands the rest of the key's work back to the pool, so that
+// other keys get a turn. If the pool won't take it because its queue is full or it's draining, it
+// keeps going on this worker instead, which is still only one worker for the key. A draining pool
+// waits for the running work, so the key's accepted work all runs. Once the pool has shut down, the
+// key's remaining work is abandoned, as the pool abandons its own queued work
+func (self *serialExecutor) run(queue *serialQueue) {
+	for {
+		self.runNext(queue)
+
+		if !self.hasMore(queue) {
+			return
+		}
+
+		err := self.pool.QueueOrError(func() { self.run(queue) })
+		if err == nil {
+			return
+		}
+		if !self.canContinue(err) {
+			self.abandon(queue, err)
+			return
+		}
+	}
+}
+
+// canContinue returns true if the key's work can keep running on the current worker after the pool
+// rejected its continuation with the given error
+func (self *serialExecutor) canContinue(err error) bool {
+	if errors.Is(err, QueueFullError) {
+		return true
+	}
+	if stateful, ok := self.pool.(statefulPool); ok {
+		return errors.Is(err, PoolStoppedError) && stateful.isDraining()
+	}
+	return false
+}
+
+// poolStopped returns true if the pool is known to have shut down
+func (self *serialExecutor) poolStopped() bool {
+	stateful, ok := self.pool.(statefulPool)
+	return ok && stateful.isStopped()
+}
+
+func (self *serialExecutor) runNext(queue *serialQueue) {
+	self.lock.Lock()
+	work := queue.work[0]
+	queue.work[0] = nil
+	queue.work = queue.work[1:]
+	self.lock.Unlock()
+
+	completed := false
+	defer func() {
+		if !completed {
+			// The work panicked and this worker is going away. Hand off the key's remaining work before
+			// the panic continues on to the pool's panic handling. Queue may block, so it's done from a
+			// new goroutine rather than tying up the dying worker
+			go self.continueAfterPanic(queue)
+		}
+	}()
+
+	work()
+	completed = true
+}
+
+func (self *serialExecutor) continueAfterPanic(queue *serialQueue) {
+	if !self.hasMore(queue) {
+		return
+	}
+
+	if err := self.pool.Queue(func() { self.run(queue) }); err != nil {
+		self.abandon(queue, err)
+	}
+}
+
+// hasMore returns true if the key has more work. Otherwise the key's queue is removed, and the next
+// Execute for the key will start a new one
+func (self *serialExecutor) hasMore(queue *serialQueue) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(queue.work) > 0 {
+		return true
+	}
+
+	queue.running = false
+	delete(self.queues, queue.key)
+	return false
+}
+
+// abandon removes the key's remaining work, once the pool has rejected the key's queue, and passes it
+// to the abandoned work handler, or logs it if there's no handler
+func (self *serialExecutor) abandon(queue *serialQueue, err error) {
+	self.lock.Lock()
+	work := queue.work
+	queue.work = nil
+	queue.running = false
+	delete(self.queues, queue.key)
+	self.lock.Unlock()
+
+	if len(work) == 0 {
+		return
+	}
+
+	if self.abandonedHandler != nil {
+		self.abandonedHandler(queue.key, work, err)
+		return
+	}
+
+	logging.For(logChannel).Error("serial executor abandoned work the pool rejected",
+		slog.String("key", queue.key), slog.Int("count", len(work)), slog.String("error", err.Error()))
+}
+
+func (self *serialExecutor) GetKeyCount() uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return uint32(len(self.queues))
+}
+
+func (self *serialExecutor) GetQueuedCount(key string) uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if queue, found := self.queues[key]; found {
+		return uint32(len(queue.work))
+	}
+	return 0
+}
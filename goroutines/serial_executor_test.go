@@ -0,0 +1,320 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerialExecutor(t *testing.T) {
+	newExecutor := func(t *testing.T, poolConfig PoolConfig, maxQueuedPerKey uint32) (Pool, SerialExecutor) {
+		p, err := NewPool(poolConfig)
+		require.NoError(t, err)
+		t.Cleanup(p.Shutdown)
+
+		executor, err := NewSerialExecutor(SerialExecutorConfig{Pool: p, MaxQueuedPerKey: maxQueuedPerKey})
+		require.NoError(t, err)
+		return p, executor
+	}
+
+	t.Run("runs work in order per key, one at a time", func(t *testing.T) {
+		req := require.New(t)
+		p, executor := newExecutor(t, PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 4, IdleTime: time.Second}, 0)
+
+		const keys = 8
+		const perKey = 100
+
+		var lock sync.Mutex
+		results := map[string][]int{}
+		active := map[string]int{}
+		var overlaps atomic.Int32
+
+		var wg sync.WaitGroup
+		for k := 0; k < keys; k++ {
+			wg.Add(1)
+			key := fmt.Sprintf("circuit-%d", k)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perKey; i++ {
+					val := i
+					req.NoError(executor.Execute(key, func() {
+						lock.Lock()
+						active[key]++
+						if active[key] > 1 {
+							overlaps.Add(1)
+						}
+						lock.Unlock()
+
+						time.Sleep(10 * time.Microsecond)
+
+						lock.Lock()
+						active[key]--
+						results[key] = append(results[key], val)
+						lock.Unlock()
+					}))
+				}
+			}()
+		}
+		wg.Wait()
+
+		req.NoError(p.AwaitIdle(5 * time.Second))
+		req.Equal(int32(0), overlaps.Load(), "work for a key must not run concurrently")
+		req.Len(results, keys)
+		for key, vals := range results {
+			req.Len(vals, perKey)
+			for i, val := range vals {
+				req.Equal(i, val, "work for %v ran out of order", key)
+			}
+		}
+		req.Equal(uint32(0), executor.GetKeyCount(), "idle keys should be cleaned up")
+	})
+
+	t.Run("runs keys in parallel", func(t *testing.T) {
+		req := require.New(t)
+		_, executor := newExecutor(t, PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second}, 0)
+
+		release := make(chan struct{})
+		started := make(chan string, 2)
+		for _, key := range []string{"a", "b"} {
+			req.NoError(executor.Execute(key, func() {
+				started <- key
+				<-release
+			}))
+		}
+
+		for i := 0; i < 2; i++ {
+			select {
+			case <-started:
+			case <-time.After(time.Second):
+				req.FailNow("work for different keys should run in parallel")
+			}
+		}
+		req.Equal(uint32(2), executor.GetKeyCount())
+		close(release)
+	})
+
+	t.Run("limits queued work per key", func(t *testing.T) {
+		req := require.New(t)
+		p, executor := newExecutor(t, PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second}, 2)
+
+		release := make(chan struct{})
+		started := make(chan struct{})
+		req.NoError(executor.Execute("a", func() {
+			close(started)
+			<-release
+		}))
+		<-started
+
+		req.NoError(executor.Execute("a", func() {}))
+		req.NoError(executor.Execute("a", func() {}))
+		req.ErrorIs(executor.Execute("a", func() {}), QueueFullError)
+		req.Equal(uint32(2), executor.GetQueuedCount("a"))
+		req.NoError(executor.Execute("b", func() {}))
+
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal(uint32(0), executor.GetQueuedCount("a"))
+		req.Equal(uint32(0), executor.GetKeyCount())
+	})
+
+	t.Run("keeps going when the pool queue is full", func(t *testing.T) {
+		req := require.New(t)
+		p, executor := newExecutor(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second}, 0)
+
+		var ran atomic.Int32
+		release := make(chan struct{})
+		req.NoError(executor.Execute("a", func() { <-release }))
+		for i := 0; i < 5; i++ {
+			req.NoError(executor.Execute("a", func() { ran.Add(1) }))
+		}
+
+		// fill the pool's queue, so the key's continuation can't be queued
+		req.NoError(p.Queue(func() {}))
+		close(release)
+
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal(int32(5), ran.Load())
+	})
+
+	t.Run("continues after a panic", func(t *testing.T) {
+		req := require.New(t)
+		p, executor := newExecutor(t, PoolConfig{
+			QueueSize:    4,
+			MinWorkers:   0,
+			MaxWorkers:   1,
+			IdleTime:     time.Second,
+			PanicHandler: func(interface{}) {},
+		}, 0)
+
+		done := make(chan struct{})
+		req.NoError(executor.Execute("a", func() { panic("boom") }))
+		req.NoError(executor.Execute("a", func() { close(done) }))
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			req.FailNow("work queued after a panic should still run")
+		}
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal(uint32(0), executor.GetKeyCount())
+	})
+
+	t.Run("returns pool errors", func(t *testing.T) {
+		req := require.New(t)
+		p, executor := newExecutor(t, PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second}, 0)
+		p.Shutdown()
+
+		req.ErrorIs(executor.Execute("a", func() {}), PoolStoppedError)
+		req.Equal(uint32(0), executor.GetKeyCount())
+	})
+
+	t.Run("runs accepted work when the pool drains", func(t *testing.T) {
+		req := require.New(t)
+		p, err := newFullPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		req.NoError(err)
+		t.Cleanup(p.Shutdown)
+		executor, err := NewSerialExecutor(SerialExecutorConfig{Pool: p})
+		req.NoError(err)
+
+		var ran atomic.Int32
+		release := make(chan struct{})
+		req.NoError(executor.Execute("a", func() { <-release }))
+		for i := 0; i < 3; i++ {
+			req.NoError(executor.Execute("a", func() { ran.Add(1) }))
+		}
+
+		drained := make(chan error, 1)
+		go func() {
+			remaining, err := p.Drain(time.Second)
+			req.Empty(remaining)
+			drained <- err
+		}()
+		require.Eventually(t, p.(*pool).draining.Load, time.Second, time.Millisecond)
+
+		// the pool won't take the key's continuation, so the key's work finishes on its current worker
+		close(release)
+		req.NoError(<-drained)
+		req.Equal(int32(3), ran.Load())
+		req.Equal(uint32(0), executor.GetKeyCount())
+	})
+
+	t.Run("abandons queued work when the pool shuts down", func(t *testing.T) {
+		req := require.New(t)
+		p, err := NewPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		req.NoError(err)
+		t.Cleanup(p.Shutdown)
+
+		abandoned := make(chan []func(), 1)
+		executor, err := NewSerialExecutor(SerialExecutorConfig{
+			Pool: p,
+			AbandonedWorkHandler: func(key string, work []func(), err error) {
+				req.ErrorIs(err, PoolStoppedError)
+				abandoned <- work
+			},
+		})
+		req.NoError(err)
+
+		release := make(chan struct{})
+		started := make(chan struct{})
+		req.NoError(executor.Execute("a", func() {
+			close(started)
+			<-release
+		}))
+		requireClosed(t, started, "timed out waiting for work to start")
+
+		var ran atomic.Int32
+		for i := 0; i < 2; i++ {
+			req.NoError(executor.Execute("a", func() { ran.Add(1) }))
+		}
+
+		p.Shutdown()
+		req.ErrorIs(executor.Execute("a", func() { ran.Add(1) }), PoolStoppedError)
+
+		close(release)
+		select {
+		case work := <-abandoned:
+			req.Len(work, 2)
+		case <-time.After(time.Second):
+			req.FailNow("queued work should be abandoned once the pool has shut down")
+		}
+		req.Equal(int32(0), ran.Load())
+		req.Equal(uint32(0), executor.GetKeyCount())
+	})
+
+	t.Run("hands off work accepted while the pool was rejecting the key", func(t *testing.T) {
+		req := require.New(t)
+		p, err := NewPool(PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+		req.NoError(err)
+		t.Cleanup(p.Shutdown)
+
+		queueCalled := make(chan struct{})
+		rejectQueue := make(chan struct{})
+		rejecting := &rejectingPool{Pool: p, called: queueCalled, reject: rejectQueue}
+
+		var abandonedKey string
+		var abandoned []func()
+		executor, err := NewSerialExecutor(SerialExecutorConfig{
+			Pool: rejecting,
+			AbandonedWorkHandler: func(key string, work []func(), err error) {
+				req.ErrorIs(err, PoolStoppedError)
+				abandonedKey, abandoned = key, work
+			},
+		})
+		req.NoError(err)
+
+		first := make(chan error, 1)
+		go func() { first <- executor.Execute("a", func() {}) }()
+		<-queueCalled
+
+		// accepted, since the key's queue looks like it's being started
+		var ran atomic.Bool
+		req.NoError(executor.Execute("a", func() { ran.Store(true) }))
+
+		close(rejectQueue)
+		req.ErrorIs(<-first, PoolStoppedError)
+		req.Equal("a", abandonedKey)
+		req.Len(abandoned, 1)
+		abandoned[0]()
+		req.True(ran.Load(), "the handler should get the accepted work")
+		req.Equal(uint32(0), executor.GetKeyCount())
+	})
+
+	t.Run("requires a pool", func(t *testing.T) {
+		_, err := NewSerialExecutor(SerialExecutorConfig{})
+		require.Error(t, err)
+	})
+}
+
+// rejectingPool closes called when Queue is first called, then fails it with PoolStoppedError once
+// reject is closed. Queue may only be called once
+type rejectingPool struct {
+	Pool
+	called chan struct{}
+	reject chan struct{}
+}
+
+func (self *rejectingPool) Queue(func()) error {
+	close(self.called)
+	<-self.reject
+	return PoolStoppedError
+}
@@ -0,0 +1,1189 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/pkg/errors"
+)
+
+// A ShardedPool is a Pool which gives each worker its own queue, rather than having every submitter
+// and worker contend on a shared channel. Work is spread across the shards, and a worker with an empty
+// queue steals work from the others. Work submitted with a key always goes to the same shard and is
+// never stolen, so work for the same key runs in submission order, on one worker at a time.
+//
+// Each shard has at most one worker, so the number of shards is the pool's max workers, which is
+// fixed at creation. Priorities are honored within each shard, not across the pool.
+type ShardedPool interface {
+	PriorityPool
+	ContextPool
+	DrainablePool
+	ResizablePool
+	InspectablePool
+	SchedulingPool
+	BatchPool
+
+	// QueueKeyed submits work which runs after any previously submitted work with the same key has
+	// completed. It will return an error if the pool is shutdown. Keyed work has PriorityNormal
+	QueueKeyed(key string, work func()) error
+
+	// QueueKeyedOrError works like QueueKeyed, but returns QueueFullError if the key's shard is full,
+	// rather than waiting for space
+	QueueKeyedOrError(key string, work func()) error
+
+	// QueueKeyedCtx works like QueueKeyed, but passes the work the given context. See ContextPool.QueueCtx
+	QueueKeyedCtx(ctx context.Context, key string, work func(context.Context)) error
+}
+
+// NewShardedPool creates a ShardedPool. MaxWorkers sets the number of shards, and QueueSize,
+// HighPriorityQueueSize and LowPriorityQueueSize set the capacity of each shard's queues, so QueueSize
+// must be at least 1. Workers for the first MinWorkers shards are started immediately and never exit
+// for being idle. ReplaceStuckWorkers isn't supported. Other fields are used as they are by NewPool.
+func NewShardedPool(config PoolConfig) (ShardedPool, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := validateWorkerLimit("max", config.MaxWorkers); err != nil {
+		return nil, err
+	}
+
+	if config.QueueSize < 1 {
+		return nil, fmt.Errorf("queue size must be at least 1 for a sharded pool")
+	}
+
+	// a replacement worker for a shard would start the shard's next work, which may have the same key
+	if config.ReplaceStuckWorkers {
+		return nil, fmt.Errorf("sharded pools do not support replacing stuck workers")
+	}
+
+	result := &shardedPool{
+		config:              config,
+		clock:               clockz.OrReal(config.Clock),
+		shards:              make([]*shard, config.MaxWorkers),
+		seed:                maphash.MakeSeed(),
+		priorityBurst:       config.PriorityBurst,
+		externalCloseNotify: config.CloseNotify,
+		closeNotify:         make(chan struct{}),
+		drainNotify:         make(chan struct{}),
+		panicHandler:        config.PanicHandler,
+		panicReportHandler:  config.PanicReportHandler,
+		onWorkCallback:      config.OnWorkCallback,
+		workF:               config.WorkerFunction,
+	}
+
+	result.minWorkers.Store(int32(config.MinWorkers))
+	result.maxIdle.Store(int64(config.IdleTime))
+
+	if result.priorityBurst == 0 {
+		result.priorityBurst = DefaultPriorityBurst
+	}
+
+	result.taskScheduler = newTaskScheduler(result.clock, result.Queue, result.QueueOrError, result.closeNotify, config.CloseNotify)
+	result.stuckStacks = newStuckStacks(result.clock)
+
+	if result.workF == nil {
+		result.workF = func(workerNumber uint32, worker func()) {
+			worker()
+		}
+	}
+
+	queueSizes := [numPriorities]uint32{config.HighPriorityQueueSize, config.QueueSize, config.LowPriorityQueueSize}
+	for i := range result.shards {
+		s := &shard{
+			pool:  result,
+			index: i,
+			wake:  make(chan struct{}, 1),
+		}
+		for priority, size := range queueSizes {
+			if size == 0 {
+				size = config.QueueSize
+			}
+			s.queues[priority].items = make([]shardWork, size)
+		}
+		result.shards[i] = s
+	}
+
+	registry, err := joinRegistry(result, &config, result.closeNotify)
+	if err != nil {
+		return nil, err
+	}
+	result.registry = registry
+
+	if config.OnCreate != nil {
+		config.OnCreate(result)
+	}
+
+	for i := uint32(0); i < config.MinWorkers; i++ {
+		result.shards[i].ensureWorker()
+	}
+
+	return result, nil
+}
+
+type shardedPool struct {
+	*taskScheduler
+	config              PoolConfig
+	clock               clockz.Clock
+	registry            *PoolRegistry
+	stuckStacks         *stuckStacks
+	stopCtx             stopContext
+	shards              []*shard
+	seed                maphash.Seed
+	priorityBurst       uint32
+	count               atomic.Int32
+	minWorkers          atomic.Int32
+	maxIdle             atomic.Int64
+	parked              atomic.Int32
+	cancelled           atomic.Uint64
+	spaceWaiters        atomic.Int32
+	spaceSignal         zeroSignal
+	idleSignal          zeroSignal
+	noWorkersSignal     zeroSignal
+	stopped             atomic.Bool
+	draining            atomic.Bool
+	drainNotify         chan struct{}
+	externalCloseNotify <-chan struct{}
+	closeNotify         chan struct{}
+	panicHandler        func(err interface{})
+	panicReportHandler  func(report *PanicReport)
+	onWorkCallback      func(workTime time.Duration)
+	workF               func(uint32, func())
+}
+
+func (self *shardedPool) Queue(work func()) error {
+	return self.submit(context.Background(), PriorityNormal, nil, work, nil, true)
+}
+
+func (self *shardedPool) QueueWithTimeout(work func(), timeout time.Duration) error {
+	timer := self.clock.NewTimer(timeout)
+	defer timer.Stop()
+	return self.submit(context.Background(), PriorityNormal, nil, work, timer.C(), true)
+}
+
+func (self *shardedPool) QueueOrError(work func()) error {
+	return self.submit(context.Background(), PriorityNormal, nil, work, nil, false)
+}
+
+func (self *shardedPool) QueuePriority(priority Priority, work func()) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+	return self.submit(context.Background(), priority, nil, work, nil, true)
+}
+
+func (self *shardedPool) QueuePriorityWithTimeout(priority Priority, work func(), timeout time.Duration) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+	timer := self.clock.NewTimer(timeout)
+	defer timer.Stop()
+	return self.submit(context.Background(), priority, nil, work, timer.C(), true)
+}
+
+func (self *shardedPool) QueuePriorityOrError(priority Priority, work func()) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+	return self.submit(context.Background(), priority, nil, work, nil, false)
+}
+
+// QueueBatch spreads the batch across the shards, starting from a random shard. Each shard is given a
+// contiguous run of items, taking its lock and waking a worker once for the run. See BatchPool.QueueBatch
+func (self *shardedPool) QueueBatch(work []func(), mode BatchMode) (int, error) {
+	if err := mode.validate(); err != nil {
+		return 0, err
+	}
+
+	if err := self.checkAccepting(); err != nil {
+		return 0, err
+	}
+
+	if len(work) == 0 {
+		return 0, nil
+	}
+
+	start := rand.IntN(len(self.shards))
+
+	var batch *workBatch
+	if mode == BatchAllOrNothing {
+		// other submitters may take the space first, which the batch handles, but this avoids queuing
+		// part of a batch which clearly won't fit
+		if self.space(PriorityNormal) < len(work) {
+			self.shards[start].counters.rejectedQueueFull.Add(1)
+			return 0, errors.Wrap(QueueFullError, "cannot queue batch")
+		}
+		batch = newWorkBatch()
+	}
+
+	// The first pass splits what's left evenly over the remaining shards. A shard which is short of space
+	// leaves more for those after it, and the second pass offers whatever is still left to each shard.
+	// Items are always taken in order, so the accepted items are a prefix of the batch
+	queued := 0
+	for pass := 0; pass < 2 && queued < len(work); pass++ {
+		for i := 0; i < len(self.shards) && queued < len(work); i++ {
+			count := len(work) - queued
+			if pass == 0 {
+				shardsLeft := len(self.shards) - i
+				count = (count + shardsLeft - 1) / shardsLeft
+			}
+			s := self.shards[(start+i)%len(self.shards)]
+			queued += s.pushBatch(PriorityNormal, work[queued:queued+count], batch)
+		}
+	}
+
+	accepted := queued
+	if batch != nil {
+		// abandoned items are still queued, and stay outstanding until a worker discards them
+		batch.decide(queued == len(work))
+		if queued < len(work) {
+			accepted = 0
+		}
+	}
+
+	if queued < len(work) {
+		self.shards[start].counters.rejectedQueueFull.Add(1)
+		return accepted, errors.Wrapf(QueueFullError, "cannot queue batch, %v of %v items accepted", accepted, len(work))
+	}
+
+	return accepted, nil
+}
+
+// space returns the free space for work of the given priority, across all shards
+func (self *shardedPool) space(priority Priority) int {
+	result := 0
+	for _, s := range self.shards {
+		result += s.space(priority)
+	}
+	return result
+}
+
+func (self *shardedPool) QueueCtx(ctx context.Context, work func(context.Context)) error {
+	return self.QueuePriorityCtx(ctx, PriorityNormal, work)
+}
+
+func (self *shardedPool) QueuePriorityCtx(ctx context.Context, priority Priority, work func(context.Context)) error {
+	if err := priority.validate(); err != nil {
+		return err
+	}
+	return self.submitCtx(ctx, priority, nil, work)
+}
+
+func (self *shardedPool) QueueKeyed(key string, work func()) error {
+	return self.submit(context.Background(), PriorityNormal, &key, work, nil, true)
+}
+
+func (self *shardedPool) QueueKeyedOrError(key string, work func()) error {
+	return self.submit(context.Background(), PriorityNormal, &key, work, nil, false)
+}
+
+func (self *shardedPool) QueueKeyedCtx(ctx context.Context, key string, work func(context.Context)) error {
+	return self.submitCtx(ctx, PriorityNormal, &key, work)
+}
+
+func (self *shardedPool) submitCtx(ctx context.Context, priority Priority, key *string, work func(context.Context)) error {
+	if err := ctx.Err(); err != nil {
+		self.cancelled.Add(1)
+		return errors.Wrap(err, "cannot queue")
+	}
+
+	return self.submit(ctx, priority, key, func() { work(ctx) }, nil, true)
+}
+
+// submit adds work to a shard. Keyed work must go to the key's shard. Other work goes to a random shard,
+// or the next one with space if that shard is full. If every candidate shard is full and block is set,
+// submit waits for a worker to take some work, then tries again.
+func (self *shardedPool) submit(ctx context.Context, priority Priority, key *string, work func(), timeoutC <-chan time.Time, block bool) error {
+	if err := self.checkAccepting(); err != nil {
+		return err
+	}
+
+	item := shardWork{work: work, keyed: key != nil, ctx: ctx, options: taskOptionsFrom(ctx)}
+
+	start, attempts := rand.IntN(len(self.shards)), len(self.shards)
+	if key != nil {
+		start, attempts = int(maphash.String(self.seed, *key)%uint64(len(self.shards))), 1
+	}
+
+	if self.tryPush(start, attempts, priority, item) {
+		return nil
+	}
+
+	counters := &self.shards[start].counters
+
+	if !block {
+		counters.rejectedQueueFull.Add(1)
+		return errors.Wrap(QueueFullError, "cannot queue")
+	}
+
+	self.spaceWaiters.Add(1)
+	defer self.spaceWaiters.Add(-1)
+
+	for {
+		// take the notification channel before trying, so space freed after the attempt isn't missed
+		spaceC := self.spaceSignal.notifyC()
+
+		if err := self.checkAccepting(); err != nil {
+			return err
+		}
+
+		if self.tryPush(start, attempts, priority, item) {
+			return nil
+		}
+
+		select {
+		case <-spaceC:
+		case <-self.closeNotify:
+			return errors.Wrap(PoolStoppedError, "cannot queue")
+		case <-self.drainNotify:
+			return errors.Wrap(PoolStoppedError, "cannot queue, pool draining")
+		case <-self.externalCloseNotify:
+			return errors.Wrap(PoolStoppedError, "cannot queue, pool stopped externally")
+		case <-timeoutC:
+			counters.rejectedTimeout.Add(1)
+			return errors.Wrap(TimeoutError, "cannot queue")
+		case <-ctx.Done():
+			self.cancelled.Add(1)
+			return errors.Wrap(ctx.Err(), "cannot queue")
+		}
+	}
+}
+
+func (self *shardedPool) checkAccepting() error {
+	if self.stopped.Load() {
+		return errors.Wrap(PoolStoppedError, "cannot queue")
+	}
+	if self.draining.Load() {
+		return errors.Wrap(PoolStoppedError, "cannot queue, pool draining")
+	}
+	return nil
+}
+
+func (self *shardedPool) tryPush(start, attempts int, priority Priority, item shardWork) bool {
+	for i := 0; i < attempts; i++ {
+		if self.shards[(start+i)%len(self.shards)].push(priority, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// wakeThief wakes a parked worker so it can steal work from a shard whose worker is busy. If no worker
+// is parked, the work waits for its own shard's worker.
+func (self *shardedPool) wakeThief(busy *shard) {
+	if self.parked.Load() == 0 {
+		return
+	}
+
+	for i := 1; i < len(self.shards); i++ {
+		s := self.shards[(busy.index+i)%len(self.shards)]
+		if s.isParked.Load() && s.wakeIfParked() {
+			return
+		}
+	}
+}
+
+// steal takes unkeyed work from another shard, for a worker whose own shard is empty
+func (self *shardedPool) steal(thief *shard) (shardWork, bool) {
+	for i := 1; i < len(self.shards); i++ {
+		victim := self.shards[(thief.index+i)%len(self.shards)]
+		if victim.queued.Load() == 0 {
+			continue
+		}
+		if item, ok := victim.stealFrom(); ok {
+			return item, true
+		}
+	}
+	return shardWork{}, false
+}
+
+// notifySpace wakes submitters waiting for queue space, if there are any
+func (self *shardedPool) notifySpace() {
+	if self.spaceWaiters.Load() > 0 {
+		self.spaceSignal.signal()
+	}
+}
+
+func (self *shardedPool) startWorker(s *shard) {
+	self.count.Add(1)
+	s.counters.workersSpawned.Add(1)
+	go self.workF(uint32(s.index+1), func() {
+		self.worker(s)
+	})
+}
+
+func (self *shardedPool) worker(s *shard) {
+	state := &workerState{
+		number:      uint32(s.index + 1),
+		goroutineId: currentGoroutineId(),
+	}
+	s.worker.Store(state)
+
+	idleExit := false
+
+	defer func() {
+		s.worker.CompareAndSwap(state, nil)
+
+		if err := recover(); err != nil {
+			s.counters.panics.Add(1)
+			reportPanic(err, self.config.Name, state, self.panicHandler, self.panicReportHandler)
+		}
+
+		s.counters.workersRetired.Add(1)
+
+		// An idle exit has already released the shard. Otherwise the worker is exiting because of a
+		// panic or shutdown, and the shard gets a replacement worker if it still needs one
+		if !idleExit {
+			s.releaseAfterExit()
+		}
+
+		if self.count.Add(-1) == 0 {
+			self.noWorkersSignal.signal()
+		}
+	}()
+
+	idleTimer := self.clock.NewTimer(self.getIdleTime())
+	defer idleTimer.Stop()
+
+	for !self.stopped.Load() {
+		item, ok := s.pop()
+		if !ok {
+			item, ok = self.steal(s)
+		}
+
+		if ok {
+			self.runWork(s, state, item)
+			continue
+		}
+
+		if !s.park() {
+			continue
+		}
+
+		idleTimer.Reset(self.getIdleTime())
+
+		select {
+		case <-s.wake:
+		case <-idleTimer.C():
+			if s.retireIfIdle() {
+				idleExit = true
+				return
+			}
+		case <-self.closeNotify:
+			return
+		case <-self.externalCloseNotify:
+			self.Shutdown()
+			return
+		}
+
+		s.unpark()
+	}
+}
+
+func (self *shardedPool) runWork(s *shard, state *workerState, item shardWork) {
+	if !item.batch.shouldRun() {
+		self.complete(item)
+		return
+	}
+
+	// work cancelled while queued is only counted as cancelled, not as completed work
+	if item.ctx != nil && item.ctx.Err() != nil {
+		self.cancelled.Add(1)
+		self.complete(item)
+		return
+	}
+
+	s.busy.Store(true)
+	defer s.busy.Store(false)
+	defer self.complete(item)
+
+	start := self.clock.Now()
+	s.counters.queueWait.record(start.Sub(item.queuedAt))
+
+	state.busySince.Store(start.UnixNano())
+	defer state.busySince.Store(0)
+
+	// record the run time even if the work panics
+	defer func() {
+		s.counters.runTime.record(self.clock.Since(start))
+	}()
+
+	deadline := item.options.getDeadline(self.config.TaskDeadline)
+	watch := watchTask(self.clock, deadline, func() {
+		s.counters.deadlinesExceeded.Add(1)
+		s.counters.stuckWorkers.Add(1)
+		reportStuckTask(self.config.Name, self.stuckStacks, state, item.options, deadline, start, self.config.StuckTaskHandler)
+	})
+	defer func() {
+		if watch.finish() {
+			s.counters.stuckWorkers.Add(-1)
+		}
+	}()
+
+	// left in place if the work panics, so the panic report can include it
+	state.task = item.options
+	item.work()
+	state.task = nil
+
+	if self.onWorkCallback != nil {
+		self.onWorkCallback(self.clock.Since(start))
+	}
+}
+
+// complete marks work as no longer outstanding. Outstanding work is counted against the shard it was
+// queued on, even if it was stolen, so that the total is never briefly understated while work moves
+func (self *shardedPool) complete(item shardWork) {
+	if item.origin.outstanding.Add(-1) == 0 {
+		self.idleSignal.signal()
+	}
+}
+
+func (self *shardedPool) Shutdown() {
+	if self.stopped.CompareAndSwap(false, true) {
+		close(self.closeNotify)
+		if self.registry != nil {
+			self.registry.remove(self)
+		}
+	}
+}
+
+func (self *shardedPool) ShutdownAndWait(timeout time.Duration) error {
+	ctx, cancel := clockz.WithTimeout(context.Background(), self.clock, timeout)
+	defer cancel()
+
+	if err := self.shutdownAndWait(ctx); err != nil {
+		return errors.Wrap(TimeoutError, "timed out waiting for in-flight work to complete")
+	}
+	return nil
+}
+
+func (self *shardedPool) ShutdownAndWaitCtx(ctx context.Context) error {
+	if err := self.shutdownAndWait(ctx); err != nil {
+		return errors.Wrap(err, "context done waiting for in-flight work to complete")
+	}
+	return nil
+}
+
+func (self *shardedPool) shutdownAndWait(ctx context.Context) error {
+	self.Shutdown()
+	return self.noWorkersSignal.await(ctx, func() bool {
+		return self.GetWorkerCount() == 0
+	})
+}
+
+func (self *shardedPool) Drain(timeout time.Duration) ([]func(), error) {
+	if self.draining.CompareAndSwap(false, true) {
+		close(self.drainNotify)
+	}
+
+	ctx, cancel := clockz.WithTimeout(context.Background(), self.clock, timeout)
+	defer cancel()
+
+	var err error
+	if self.idleSignal.await(ctx, self.isIdle) != nil {
+		err = errors.Wrap(TimeoutError, "timed out waiting for queued work to drain")
+	}
+
+	self.Shutdown()
+
+	var result []func()
+	for _, s := range self.shards {
+		result = s.removeQueued(result)
+	}
+	return result, err
+}
+
+func (self *shardedPool) AwaitIdle(timeout time.Duration) error {
+	ctx, cancel := clockz.WithTimeout(context.Background(), self.clock, timeout)
+	defer cancel()
+
+	if err := self.idleSignal.await(ctx, self.isIdle); err != nil {
+		return errors.Wrap(TimeoutError, "timed out waiting for pool to become idle")
+	}
+	return nil
+}
+
+func (self *shardedPool) AwaitIdleCtx(ctx context.Context) error {
+	if err := self.idleSignal.await(ctx, self.isIdle); err != nil {
+		return errors.Wrap(err, "context done waiting for pool to become idle")
+	}
+	return nil
+}
+
+func (self *shardedPool) isIdle() bool {
+	return self.GetOutstanding() == 0
+}
+
+func (self *shardedPool) SetMinWorkers(min uint32) error {
+	if min > uint32(len(self.shards)) {
+		return fmt.Errorf("min workers must be less than or equal to max workers. min workers=%v, max workers=%v", min, len(self.shards))
+	}
+
+	self.minWorkers.Store(int32(min))
+	for i := uint32(0); i < min; i++ {
+		self.shards[i].ensureWorker()
+	}
+	return nil
+}
+
+// SetMaxWorkers only accepts the current max workers, since a sharded pool's max workers is its number
+// of shards, and keyed work relies on the number of shards staying the same
+func (self *shardedPool) SetMaxWorkers(max uint32) error {
+	if max != uint32(len(self.shards)) {
+		return fmt.Errorf("max workers of a sharded pool is its number of shards and can't be changed. max workers=%v", len(self.shards))
+	}
+	return nil
+}
+
+func (self *shardedPool) SetIdleTime(idleTime time.Duration) {
+	self.maxIdle.Store(int64(idleTime))
+
+	// parked workers restart their idle timers when woken
+	for _, s := range self.shards {
+		if s.isParked.Load() {
+			s.nudge()
+		}
+	}
+}
+
+func (self *shardedPool) getIdleTime() time.Duration {
+	return time.Duration(self.maxIdle.Load())
+}
+
+func (self *shardedPool) GetWorkerCount() uint32 {
+	return uint32(self.count.Load())
+}
+
+func (self *shardedPool) GetQueueSize() uint32 {
+	var result int32
+	for _, s := range self.shards {
+		result += s.queued.Load()
+	}
+	return uint32(max(result, 0))
+}
+
+func (self *shardedPool) GetPriorityQueueSize(priority Priority) uint32 {
+	if priority >= numPriorities {
+		return 0
+	}
+
+	var result uint32
+	for _, s := range self.shards {
+		s.lock.Lock()
+		result += uint32(s.queues[priority].size)
+		s.lock.Unlock()
+	}
+	return result
+}
+
+func (self *shardedPool) GetBusyWorkers() uint32 {
+	var result uint32
+	for _, s := range self.shards {
+		if s.busy.Load() {
+			result++
+		}
+	}
+	return result
+}
+
+func (self *shardedPool) GetOutstanding() uint32 {
+	var result int32
+	for _, s := range self.shards {
+		result += s.outstanding.Load()
+	}
+	return uint32(max(result, 0))
+}
+
+func (self *shardedPool) GetCancelled() uint64 {
+	return self.cancelled.Load()
+}
+
+func (self *shardedPool) GetName() string {
+	return self.config.Name
+}
+
+func (self *shardedPool) GetConfig() PoolConfig {
+	result := self.config
+	result.MinWorkers = uint32(self.minWorkers.Load())
+	result.IdleTime = self.getIdleTime()
+	return result
+}
+
+func (self *shardedPool) getClock() clockz.Clock {
+	return self.clock
+}
+
+// isStopped returns true once the pool has shut down, or its CloseNotify has been closed
+func (self *shardedPool) isStopped() bool {
+	if self.stopped.Load() {
+		return true
+	}
+	select {
+	case <-self.externalCloseNotify:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDraining returns true while a Drain is waiting for queued work, before the pool shuts down
+func (self *shardedPool) isDraining() bool {
+	return self.draining.Load() && !self.isStopped()
+}
+
+// getStopContext returns a context which is cancelled once the pool stops
+func (self *shardedPool) getStopContext() context.Context {
+	return self.stopCtx.get(self.closeNotify, self.externalCloseNotify)
+}
+
+func (self *shardedPool) getBusyWorkers() []*workerState {
+	var result []*workerState
+	for _, s := range self.shards {
+		if state := s.worker.Load(); state != nil && state.busySince.Load() != 0 {
+			result = append(result, state)
+		}
+	}
+	return result
+}
+
+// Stats returns the combined stats of all shards. Each shard tracks its own peak queue size, so
+// PeakQueueSize is the sum of the shard peaks, which may be higher than the pool ever reached at once
+func (self *shardedPool) Stats() *PoolStats {
+	result := &PoolStats{
+		Workers:     self.GetWorkerCount(),
+		BusyWorkers: self.GetBusyWorkers(),
+		QueueSize:   self.GetQueueSize(),
+		Outstanding: self.GetOutstanding(),
+		Cancelled:   self.GetCancelled(),
+	}
+
+	for _, s := range self.shards {
+		counters := &s.counters
+		result.PeakQueueSize += counters.peakQueueSize.Load()
+		result.Completed += counters.runTime.count.Load()
+		result.RejectedQueueFull += counters.rejectedQueueFull.Load()
+		result.RejectedTimeout += counters.rejectedTimeout.Load()
+		result.Panics += counters.panics.Load()
+		result.WorkersSpawned += counters.workersSpawned.Load()
+		result.WorkersRetired += counters.workersRetired.Load()
+		result.StuckWorkers += uint32(max(counters.stuckWorkers.Load(), 0))
+		result.DeadlinesExceeded += counters.deadlinesExceeded.Load()
+
+		queueWait := counters.queueWait.snapshot()
+		result.QueueWait.add(&queueWait)
+		runTime := counters.runTime.snapshot()
+		result.RunTime.add(&runTime)
+	}
+
+	return result
+}
+
+type shardWorkerState uint8
+
+const (
+	shardWorkerNone shardWorkerState = iota
+	shardWorkerRunning
+	shardWorkerParked
+)
+
+// shardWork is a unit of work queued on a shard
+type shardWork struct {
+	work     func()
+	queuedAt time.Time
+	keyed    bool
+	// the context the work was queued with, if any. Work whose context is done by the time it would
+	// run is skipped
+	ctx     context.Context
+	options *taskOptions
+	// set for work queued as part of an all-or-nothing batch
+	batch *workBatch
+	// the shard the work was queued on, which tracks it as outstanding
+	origin *shard
+}
+
+// A shard is a set of priority queues with at most one worker. The queues, skip counters and worker
+// state are guarded by lock. The atomics mirror parts of that state so other shards and the stats
+// getters can check them without locking
+type shard struct {
+	pool        *shardedPool
+	index       int
+	lock        sync.Mutex
+	queues      [numPriorities]workRing
+	skipped     [numPriorities]uint32
+	state       shardWorkerState
+	wake        chan struct{}
+	isParked    atomic.Bool
+	queued      atomic.Int32
+	outstanding atomic.Int32
+	busy        atomic.Bool
+	worker      atomic.Pointer[workerState]
+	counters    poolCounters
+}
+
+func (self *shard) space(priority Priority) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	queue := &self.queues[priority]
+	return len(queue.items) - queue.size
+}
+
+func (self *shard) push(priority Priority, item shardWork) bool {
+	self.lock.Lock()
+
+	queue := &self.queues[priority]
+	if queue.full() {
+		self.lock.Unlock()
+		return false
+	}
+
+	item.origin = self
+	item.queuedAt = self.pool.clock.Now()
+	self.outstanding.Add(1)
+	queue.pushBack(item)
+	self.counters.updatePeakQueueSize(uint32(self.queued.Add(1)))
+
+	startWorker, busy := self.notifyWorkerLocked()
+	self.lock.Unlock()
+
+	self.notifiedWorker(startWorker, busy && !item.keyed)
+	return true
+}
+
+// pushBatch queues as many of the given items as fit, in order, returning the number queued. The lock is
+// taken, and a worker woken, once for all of them
+func (self *shard) pushBatch(priority Priority, work []func(), batch *workBatch) int {
+	self.lock.Lock()
+
+	queue := &self.queues[priority]
+	count := min(len(work), len(queue.items)-queue.size)
+	if count == 0 {
+		self.lock.Unlock()
+		return 0
+	}
+
+	queuedAt := self.pool.clock.Now()
+	self.outstanding.Add(int32(count))
+	for _, f := range work[:count] {
+		queue.pushBack(shardWork{work: f, queuedAt: queuedAt, batch: batch, origin: self})
+	}
+	self.counters.updatePeakQueueSize(uint32(self.queued.Add(int32(count))))
+
+	startWorker, busy := self.notifyWorkerLocked()
+	self.lock.Unlock()
+
+	self.notifiedWorker(startWorker, busy)
+	return count
+}
+
+// notifyWorkerLocked wakes the shard's worker for newly queued work. It returns true for startWorker if a
+// worker needs to be started, or for busy if the worker is already running
+func (self *shard) notifyWorkerLocked() (startWorker, busy bool) {
+	switch self.state {
+	case shardWorkerNone:
+		if !self.pool.stopped.Load() {
+			self.state = shardWorkerRunning
+			startWorker = true
+		}
+	case shardWorkerParked:
+		self.wakeLocked()
+	case shardWorkerRunning:
+		busy = true
+	}
+	return startWorker, busy
+}
+
+// notifiedWorker finishes notifyWorkerLocked once the lock is released, starting a worker if needed, or
+// waking a thief if the shard's worker is busy and the work can be stolen
+func (self *shard) notifiedWorker(startWorker, stealable bool) {
+	if startWorker {
+		self.pool.startWorker(self)
+	} else if stealable {
+		self.pool.wakeThief(self)
+	}
+}
+
+// pop takes the next work item from the shard's own queues, preferring higher priorities, but giving a
+// lower priority a turn once PriorityBurst items have been taken ahead of it. See pool.pollWork
+func (self *shard) pop() (shardWork, bool) {
+	self.lock.Lock()
+	item, ok := self.popLocked()
+	self.lock.Unlock()
+
+	if ok {
+		self.pool.notifySpace()
+	}
+	return item, ok
+}
+
+func (self *shard) popLocked() (shardWork, bool) {
+	for priority := Priority(numPriorities - 1); priority > PriorityHigh; priority-- {
+		if self.skipped[priority] >= self.pool.priorityBurst {
+			self.skipped[priority] = 0
+			if item, ok := self.queues[priority].popFront(); ok {
+				self.queued.Add(-1)
+				return item, true
+			}
+		}
+	}
+
+	for priority := PriorityHigh; priority < numPriorities; priority++ {
+		if item, ok := self.queues[priority].popFront(); ok {
+			self.queued.Add(-1)
+			for lower := priority + 1; lower < numPriorities; lower++ {
+				if self.queues[lower].size > 0 {
+					self.skipped[lower]++
+				}
+			}
+			return item, true
+		}
+	}
+
+	return shardWork{}, false
+}
+
+// stealFrom takes unkeyed work for another shard's worker, highest priority first. Keyed work must stay
+// on its shard to keep its order, so only the oldest or newest item of a queue is considered, whichever
+// is unkeyed.
+func (self *shard) stealFrom() (shardWork, bool) {
+	self.lock.Lock()
+	item, ok := self.stealLocked()
+	self.lock.Unlock()
+
+	if ok {
+		self.pool.notifySpace()
+	}
+	return item, ok
+}
+
+func (self *shard) stealLocked() (shardWork, bool) {
+	for priority := PriorityHigh; priority < numPriorities; priority++ {
+		queue := &self.queues[priority]
+		if queue.size == 0 {
+			continue
+		}
+
+		var item shardWork
+		if !queue.front().keyed {
+			item, _ = queue.popFront()
+		} else if !queue.back().keyed {
+			item, _ = queue.popBack()
+		} else {
+			continue
+		}
+
+		self.queued.Add(-1)
+		return item, true
+	}
+
+	return shardWork{}, false
+}
+
+// ensureWorker starts a worker for the shard if it doesn't have one
+func (self *shard) ensureWorker() {
+	self.lock.Lock()
+	startWorker := self.state == shardWorkerNone && !self.pool.stopped.Load()
+	if startWorker {
+		self.state = shardWorkerRunning
+	}
+	self.lock.Unlock()
+
+	if startWorker {
+		self.pool.startWorker(self)
+	}
+}
+
+// park marks the worker as waiting for work, returning false if work arrived since it last looked
+func (self *shard) park() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.queued.Load() > 0 {
+		return false
+	}
+
+	self.state = shardWorkerParked
+	self.isParked.Store(true)
+	self.pool.parked.Add(1)
+	return true
+}
+
+// unpark marks a parked worker as running again, clearing any wake up it didn't consume
+func (self *shard) unpark() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.state == shardWorkerParked {
+		self.setRunningLocked()
+	}
+
+	select {
+	case <-self.wake:
+	default:
+	}
+}
+
+func (self *shard) wakeIfParked() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.state != shardWorkerParked {
+		return false
+	}
+	self.wakeLocked()
+	return true
+}
+
+// nudge wakes a parked worker without giving it work, so it re-reads settings such as the idle time
+func (self *shard) nudge() {
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (self *shard) wakeLocked() {
+	self.setRunningLocked()
+	self.nudge()
+}
+
+func (self *shard) setRunningLocked() {
+	self.state = shardWorkerRunning
+	self.isParked.Store(false)
+	self.pool.parked.Add(-1)
+}
+
+// retireIfIdle releases the shard if its worker may exit, returning true if the worker should exit.
+// Workers for shards below min workers stay, as do workers which have been given work while parked.
+func (self *shard) retireIfIdle() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.state != shardWorkerParked || self.queued.Load() > 0 || int32(self.index) < self.pool.minWorkers.Load() {
+		return false
+	}
+
+	self.setRunningLocked()
+	self.state = shardWorkerNone
+	return true
+}
+
+// releaseAfterExit releases the shard after its worker exits because of a panic or shutdown, starting a
+// replacement if the pool is still running and the shard has work or is below min workers
+func (self *shard) releaseAfterExit() {
+	self.lock.Lock()
+	if self.state == shardWorkerParked {
+		self.setRunningLocked()
+	}
+
+	restart := !self.pool.stopped.Load() &&
+		(self.queued.Load() > 0 || int32(self.index) < self.pool.minWorkers.Load())
+
+	if restart {
+		self.state = shardWorkerRunning
+	} else {
+		self.state = shardWorkerNone
+	}
+	self.lock.Unlock()
+
+	if restart {
+		self.pool.startWorker(self)
+	}
+}
+
+// removeQueued empties the shard's queues, appending the removed work to the given slice. Items from
+// all-or-nothing batches which weren't accepted are discarded rather than returned
+func (self *shard) removeQueued(result []func()) []func() {
+	var removed []shardWork
+
+	self.lock.Lock()
+	for priority := range self.queues {
+		for {
+			item, ok := self.queues[priority].popFront()
+			if !ok {
+				break
+			}
+			self.queued.Add(-1)
+			removed = append(removed, item)
+		}
+	}
+	self.lock.Unlock()
+
+	// a batch may still be being submitted, so its decision is waited on without holding the lock,
+	// which the submitter may need to queue the rest of the batch
+	for _, item := range removed {
+		self.pool.complete(item)
+		if item.batch.shouldRun() {
+			result = append(result, item.work)
+		}
+	}
+	return result
+}
+
+// workRing is a fixed capacity double-ended queue
+type workRing struct {
+	items []shardWork
+	head  int
+	size  int
+}
+
+func (self *workRing) full() bool {
+	return self.size == len(self.items)
+}
+
+func (self *workRing) pushBack(item shardWork) {
+	self.items[(self.head+self.size)%len(self.items)] = item
+	self.size++
+}
+
+func (self *workRing) front() *shardWork {
+	return &self.items[self.head]
+}
+
+func (self *workRing) back() *shardWork {
+	return &self.items[(self.head+self.size-1)%len(self.items)]
+}
+
+func (self *workRing) popFront() (shardWork, bool) {
+	if self.size == 0 {
+		return shardWork{}, false
+	}
+	item := self.items[self.head]
+	// clear the slot so the work's closure can be collected
+	self.items[self.head] = shardWork{}
+	self.head = (self.head + 1) % len(self.items)
+	self.size--
+	return item, true
+}
+
+func (self *workRing) popBack() (shardWork, bool) {
+	if self.size == 0 {
+		return shardWork{}, false
+	}
+	idx := (self.head + self.size - 1) % len(self.items)
+	item := self.items[idx]
+	self.items[idx] = shardWork{}
+	self.size--
+	return item, true
+}
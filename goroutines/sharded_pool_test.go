@@ -0,0 +1,298 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestShardedPool(t *testing.T, config PoolConfig) ShardedPool {
+	p, err := NewShardedPool(config)
+	require.NoError(t, err)
+	t.Cleanup(p.Shutdown)
+	return p
+}
+
+// blockKey queues keyed work which blocks its shard's worker until release is closed, returning once
+// the work is running
+func blockKey(t *testing.T, p ShardedPool, key string, release <-chan struct{}) {
+	started := make(chan struct{})
+	require.NoError(t, p.QueueKeyed(key, func() {
+		close(started)
+		<-release
+	}))
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		require.FailNow(t, "timed out waiting for blocking work to start")
+	}
+}
+
+func TestShardedPool(t *testing.T) {
+	t.Run("runs all work", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 16, MinWorkers: 0, MaxWorkers: 4, IdleTime: time.Second})
+
+		var ran atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 500; j++ {
+					req.NoError(p.Queue(func() { ran.Add(1) }))
+				}
+			}()
+		}
+		wg.Wait()
+
+		req.NoError(p.AwaitIdle(5 * time.Second))
+		req.Equal(int32(4000), ran.Load())
+		req.Equal(uint64(4000), p.Stats().Completed)
+		req.LessOrEqual(p.GetWorkerCount(), uint32(4))
+	})
+
+	t.Run("runs keyed work in order", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 8, MinWorkers: 0, MaxWorkers: 4, IdleTime: time.Second})
+
+		const keys = 10
+		const perKey = 200
+		var lock sync.Mutex
+		results := map[string][]int{}
+
+		for i := 0; i < perKey; i++ {
+			for k := 0; k < keys; k++ {
+				key := fmt.Sprintf("key-%d", k)
+				val := i
+				req.NoError(p.QueueKeyed(key, func() {
+					lock.Lock()
+					results[key] = append(results[key], val)
+					lock.Unlock()
+				}))
+			}
+		}
+
+		req.NoError(p.AwaitIdle(5 * time.Second))
+		req.Len(results, keys)
+		for key, vals := range results {
+			req.Len(vals, perKey, key)
+			for i, val := range vals {
+				req.Equal(i, val, "work for %v ran out of order", key)
+			}
+		}
+	})
+
+	t.Run("steals unkeyed work from busy shards", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 32, MinWorkers: 2, MaxWorkers: 2, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		defer close(release)
+		blockKey(t, p, "blocked", release)
+
+		// about half of this lands on the blocked shard, and has to be stolen to complete
+		var ran atomic.Int32
+		for i := 0; i < 40; i++ {
+			req.NoError(p.Queue(func() { ran.Add(1) }))
+		}
+
+		require.Eventually(t, func() bool {
+			return ran.Load() == 40
+		}, time.Second, time.Millisecond)
+		req.Equal(uint32(1), p.GetOutstanding())
+	})
+
+	t.Run("does not steal keyed work", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 4, MinWorkers: 2, MaxWorkers: 2, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		blockKey(t, p, "blocked", release)
+
+		var ran atomic.Int32
+		req.NoError(p.QueueKeyed("blocked", func() { ran.Add(1) }))
+
+		// once the idle worker has run later unkeyed work, it has passed over the keyed work
+		done := make(chan struct{})
+		req.NoError(p.Queue(func() { close(done) }))
+		requireClosed(t, done, "the idle worker should run unkeyed work")
+		req.Equal(int32(0), ran.Load(), "keyed work must wait for earlier work with its key")
+		req.Equal(uint32(2), p.GetOutstanding())
+
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal(int32(1), ran.Load())
+	})
+
+	t.Run("skips queued work whose context is done", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 4, MinWorkers: 1, MaxWorkers: 1, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		blockKey(t, p, "blocked", release)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var ran atomic.Bool
+		req.NoError(p.QueueKeyedCtx(ctx, "blocked", func(context.Context) { ran.Store(true) }))
+		cancel()
+
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+		req.False(ran.Load())
+
+		stats := p.Stats()
+		req.Equal(uint64(1), stats.Cancelled)
+		req.Equal(uint64(1), stats.Completed, "only the blocking work should be counted as completed")
+	})
+
+	t.Run("rejects or waits when a shard is full", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 1, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		blockKey(t, p, "blocked", release)
+
+		req.NoError(p.QueueKeyedOrError("blocked", func() {}))
+		req.ErrorIs(p.QueueKeyedOrError("blocked", func() {}), QueueFullError)
+		req.NoError(p.QueueWithTimeout(func() {}, time.Millisecond), "unkeyed work can use the other shard")
+
+		queued := make(chan error, 1)
+		go func() {
+			queued <- p.QueueKeyed("blocked", func() {})
+		}()
+
+		select {
+		case err := <-queued:
+			req.FailNow("QueueKeyed should wait for space", "returned %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		select {
+		case err := <-queued:
+			req.NoError(err)
+		case <-time.After(time.Second):
+			req.FailNow("QueueKeyed did not return once space was available")
+		}
+
+		req.NoError(p.AwaitIdle(time.Second))
+		stats := p.Stats()
+		req.Equal(uint64(1), stats.RejectedQueueFull)
+		req.Equal(uint64(4), stats.Completed)
+	})
+
+	t.Run("runs higher priority work first within a shard", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 1, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		blockKey(t, p, "blocked", release)
+
+		var lock sync.Mutex
+		var order []Priority
+		for _, priority := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+			req.NoError(p.QueuePriority(priority, func() {
+				lock.Lock()
+				order = append(order, priority)
+				lock.Unlock()
+			}))
+		}
+		req.Equal(uint32(1), p.GetPriorityQueueSize(PriorityHigh))
+
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal([]Priority{PriorityHigh, PriorityNormal, PriorityLow}, order)
+	})
+
+	t.Run("replaces workers after panics", func(t *testing.T) {
+		req := require.New(t)
+		var panics atomic.Int32
+		p := newTestShardedPool(t, PoolConfig{
+			QueueSize:    4,
+			MinWorkers:   1,
+			MaxWorkers:   1,
+			IdleTime:     time.Second,
+			PanicHandler: func(interface{}) { panics.Add(1) },
+		})
+
+		var ran atomic.Int32
+		req.NoError(p.Queue(func() { panic("boom") }))
+		req.NoError(p.Queue(func() { ran.Add(1) }))
+		req.NoError(p.AwaitIdle(time.Second))
+
+		req.Equal(int32(1), panics.Load())
+		req.Equal(int32(1), ran.Load())
+		require.Eventually(t, func() bool {
+			return p.GetWorkerCount() == 1
+		}, time.Second, time.Millisecond)
+		req.Equal(uint64(1), p.Stats().Panics)
+	})
+
+	t.Run("idle workers above min exit", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 4, MinWorkers: 1, MaxWorkers: 4, IdleTime: 20 * time.Millisecond})
+		req.Equal(uint32(1), p.GetWorkerCount())
+
+		for i := 0; i < 4; i++ {
+			req.NoError(p.QueueKeyed(fmt.Sprintf("key-%d", i), func() {}))
+		}
+		req.NoError(p.AwaitIdle(time.Second))
+
+		require.Eventually(t, func() bool {
+			return p.GetWorkerCount() == 1
+		}, time.Second, time.Millisecond)
+
+		req.NoError(p.SetMinWorkers(3))
+		req.Equal(uint32(3), p.GetWorkerCount())
+		req.Error(p.SetMinWorkers(5))
+		req.NoError(p.SetMaxWorkers(4))
+		req.Error(p.SetMaxWorkers(8))
+	})
+
+	t.Run("drains and shuts down", func(t *testing.T) {
+		req := require.New(t)
+		p := newTestShardedPool(t, PoolConfig{QueueSize: 4, MinWorkers: 0, MaxWorkers: 2, IdleTime: time.Second})
+
+		release := make(chan struct{})
+		blockKey(t, p, "blocked", release)
+		req.NoError(p.QueueKeyed("blocked", func() {}))
+
+		abandoned, err := p.Drain(20 * time.Millisecond)
+		req.ErrorIs(err, TimeoutError)
+		req.Len(abandoned, 1)
+		req.ErrorIs(p.Queue(func() {}), PoolStoppedError)
+
+		close(release)
+		req.NoError(p.ShutdownAndWait(time.Second))
+		req.Equal(uint32(0), p.GetWorkerCount())
+		req.Equal(uint32(0), p.GetOutstanding())
+	})
+
+	t.Run("validates config", func(t *testing.T) {
+		_, err := NewShardedPool(PoolConfig{QueueSize: 0, MaxWorkers: 2})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,244 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// PoolStats is a point-in-time snapshot of a pool's state and counters. Counters are cumulative from
+// pool creation.
+type PoolStats struct {
+	// The current number of workers
+	Workers uint32
+	// The current number of workers running work
+	BusyWorkers uint32
+	// The current number of work items queued, across all priorities
+	QueueSize uint32
+	// The highest number of work items which have been queued at once
+	PeakQueueSize uint32
+	// The current number of work items queued or running
+	Outstanding uint32
+	// The current number of workers running work which has exceeded its deadline
+	StuckWorkers uint32
+
+	// The number of work items which have finished running, including those which panicked
+	Completed uint64
+	// The number of submissions rejected with QueueFullError
+	RejectedQueueFull uint64
+	// The number of submissions rejected with TimeoutError
+	RejectedTimeout uint64
+	// The number of context aware submissions which were not run because their context was done
+	Cancelled uint64
+	// The number of work items which panicked in a worker
+	Panics uint64
+	// The number of workers which have been started
+	WorkersSpawned uint64
+	// The number of workers which have exited, whether because they were idle, because the max
+	// workers was lowered, because their work panicked or because the pool shut down
+	WorkersRetired uint64
+	// The number of work items which have run past their deadline
+	DeadlinesExceeded uint64
+
+	// How long work items waited in the queue before a worker started them
+	QueueWait LatencySnapshot
+	// How long work items took to run
+	RunTime LatencySnapshot
+}
+
+// MetricsSink receives metrics values. It can be implemented as an adapter to whichever metrics library
+// a process uses, so that every pool in the process is reported the same way.
+type MetricsSink interface {
+	// Gauge reports a value which can go up and down
+	Gauge(name string, value int64)
+	// Counter reports the current total of a value which only increases
+	Counter(name string, value uint64)
+	// Latency reports a distribution of durations
+	Latency(name string, snapshot *LatencySnapshot)
+}
+
+// Report sends the stats to the given sink, with each metric name prefixed by the given prefix and a dot
+func (self *PoolStats) Report(prefix string, sink MetricsSink) {
+	sink.Gauge(prefix+".workers", int64(self.Workers))
+	sink.Gauge(prefix+".busy_workers", int64(self.BusyWorkers))
+	sink.Gauge(prefix+".queue_size", int64(self.QueueSize))
+	sink.Gauge(prefix+".peak_queue_size", int64(self.PeakQueueSize))
+	sink.Gauge(prefix+".outstanding", int64(self.Outstanding))
+	sink.Gauge(prefix+".stuck_workers", int64(self.StuckWorkers))
+
+	sink.Counter(prefix+".completed", self.Completed)
+	sink.Counter(prefix+".rejected.queue_full", self.RejectedQueueFull)
+	sink.Counter(prefix+".rejected.timeout", self.RejectedTimeout)
+	sink.Counter(prefix+".cancelled", self.Cancelled)
+	sink.Counter(prefix+".panics", self.Panics)
+	sink.Counter(prefix+".workers.spawned", self.WorkersSpawned)
+	sink.Counter(prefix+".workers.retired", self.WorkersRetired)
+	sink.Counter(prefix+".deadlines_exceeded", self.DeadlinesExceeded)
+
+	sink.Latency(prefix+".queue_wait", &self.QueueWait)
+	sink.Latency(prefix+".run_time", &self.RunTime)
+}
+
+// LatencyBucket holds the number of recorded durations which were less than UpperBound and at least
+// the UpperBound of the previous bucket
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// LatencySnapshot is a histogram of recorded durations. Bucket upper bounds double from one microsecond,
+// with a final bucket, with an UpperBound of math.MaxInt64, holding anything longer.
+type LatencySnapshot struct {
+	Count   uint64
+	Sum     time.Duration
+	Max     time.Duration
+	Buckets []LatencyBucket
+}
+
+// Mean returns the average recorded duration, or zero if nothing has been recorded
+func (self *LatencySnapshot) Mean() time.Duration {
+	if self.Count == 0 {
+		return 0
+	}
+	return self.Sum / time.Duration(self.Count)
+}
+
+// Quantile returns an estimate of the given quantile, between 0 and 1, of the recorded durations. The
+// estimate is the upper bound of the bucket holding the quantile, capped at Max, so it is accurate to
+// within a factor of two.
+func (self *LatencySnapshot) Quantile(q float64) time.Duration {
+	if self.Count == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(self.Count)))
+	if target < 1 {
+		target = 1
+	}
+
+	var seen uint64
+	for _, bucket := range self.Buckets {
+		seen += bucket.Count
+		if seen >= target {
+			return min(bucket.UpperBound, self.Max)
+		}
+	}
+	return self.Max
+}
+
+// add combines the durations recorded in another snapshot into this one. Both snapshots must use
+// the same buckets, as all snapshots taken from pools do
+func (self *LatencySnapshot) add(other *LatencySnapshot) {
+	if self.Buckets == nil {
+		self.Buckets = make([]LatencyBucket, len(other.Buckets))
+		copy(self.Buckets, other.Buckets)
+	} else {
+		for i := range other.Buckets {
+			self.Buckets[i].Count += other.Buckets[i].Count
+		}
+	}
+	self.Count += other.Count
+	self.Sum += other.Sum
+	self.Max = max(self.Max, other.Max)
+}
+
+const (
+	latencyBucketUnit = time.Microsecond
+	// 28 doubling buckets covers up to 2^27 microseconds, a little over two minutes
+	numLatencyBuckets = 28
+)
+
+// latencyHistogram records durations into buckets without locking, so it can be updated by every
+// worker. Bucket n holds durations under 2^n microseconds, with the last bucket holding everything else.
+type latencyHistogram struct {
+	buckets [numLatencyBuckets + 1]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64
+	max     atomic.Int64
+}
+
+func (self *latencyHistogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	idx := bits.Len64(uint64(d / latencyBucketUnit))
+	if idx > numLatencyBuckets {
+		idx = numLatencyBuckets
+	}
+
+	self.buckets[idx].Add(1)
+	self.count.Add(1)
+	self.sum.Add(int64(d))
+
+	for {
+		current := self.max.Load()
+		if int64(d) <= current || self.max.CompareAndSwap(current, int64(d)) {
+			return
+		}
+	}
+}
+
+// snapshot copies the histogram. Fields are read individually, so a snapshot taken while durations are
+// being recorded may be slightly inconsistent, for example with Count not quite matching the buckets.
+func (self *latencyHistogram) snapshot() LatencySnapshot {
+	result := LatencySnapshot{
+		Count:   self.count.Load(),
+		Sum:     time.Duration(self.sum.Load()),
+		Max:     time.Duration(self.max.Load()),
+		Buckets: make([]LatencyBucket, len(self.buckets)),
+	}
+
+	for i := range self.buckets {
+		upperBound := time.Duration(math.MaxInt64)
+		if i < numLatencyBuckets {
+			upperBound = latencyBucketUnit << i
+		}
+		result.Buckets[i] = LatencyBucket{
+			UpperBound: upperBound,
+			Count:      self.buckets[i].Load(),
+		}
+	}
+
+	return result
+}
+
+// poolCounters holds the cumulative counters reported in PoolStats
+type poolCounters struct {
+	peakQueueSize     atomic.Uint32
+	rejectedQueueFull atomic.Uint64
+	rejectedTimeout   atomic.Uint64
+	panics            atomic.Uint64
+	workersSpawned    atomic.Uint64
+	workersRetired    atomic.Uint64
+	deadlinesExceeded atomic.Uint64
+	stuckWorkers      atomic.Int32
+	queueWait         latencyHistogram
+	runTime           latencyHistogram
+}
+
+func (self *poolCounters) updatePeakQueueSize(queueSize uint32) {
+	for {
+		current := self.peakQueueSize.Load()
+		if queueSize <= current || self.peakQueueSize.CompareAndSwap(current, queueSize) {
+			return
+		}
+	}
+}
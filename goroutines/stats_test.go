@@ -0,0 +1,151 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	req := require.New(t)
+
+	h := &latencyHistogram{}
+	empty := h.snapshot()
+	req.Equal(time.Duration(0), empty.Mean())
+	req.Equal(time.Duration(0), empty.Quantile(0.5))
+
+	for i := 0; i < 90; i++ {
+		h.record(500 * time.Nanosecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.record(3 * time.Millisecond)
+	}
+	h.record(time.Hour)
+
+	s := h.snapshot()
+	req.Equal(uint64(100), s.Count)
+	req.Equal(time.Hour, s.Max)
+	req.Equal(numLatencyBuckets+1, len(s.Buckets))
+
+	req.Equal(uint64(90), s.Buckets[0].Count)
+	req.Equal(time.Microsecond, s.Buckets[0].UpperBound)
+	// 3ms is 3000us, which falls under 2^12us
+	req.Equal(uint64(9), s.Buckets[12].Count)
+	req.Equal(uint64(1), s.Buckets[numLatencyBuckets].Count)
+	req.Equal(time.Duration(math.MaxInt64), s.Buckets[numLatencyBuckets].UpperBound)
+
+	req.Equal(time.Microsecond, s.Quantile(0.5))
+	req.Equal(4096*time.Microsecond, s.Quantile(0.99))
+	req.Equal(time.Hour, s.Quantile(1))
+	req.Equal((90*500*time.Nanosecond+27*time.Millisecond+time.Hour)/100, s.Mean())
+}
+
+type recordingSink struct {
+	gauges    map[string]int64
+	counters  map[string]uint64
+	latencies map[string]*LatencySnapshot
+}
+
+func (self *recordingSink) Gauge(name string, value int64) {
+	self.gauges[name] = value
+}
+
+func (self *recordingSink) Counter(name string, value uint64) {
+	self.counters[name] = value
+}
+
+func (self *recordingSink) Latency(name string, snapshot *LatencySnapshot) {
+	self.latencies[name] = snapshot
+}
+
+func TestPoolStats(t *testing.T) {
+	req := require.New(t)
+
+	p, clock := newFakeClockPool(t, PoolConfig{
+		QueueSize:    2,
+		MinWorkers:   0,
+		MaxWorkers:   1,
+		IdleTime:     time.Second,
+		PanicHandler: func(interface{}) {},
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	req.NoError(p.Queue(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+
+	req.NoError(p.Queue(func() {}))
+	req.NoError(p.Queue(func() { panic("boom") }))
+	req.ErrorIs(p.QueueOrError(func() {}), QueueFullError)
+
+	timers := clock.TimerCount()
+	timedOut := make(chan error, 1)
+	go func() { timedOut <- p.QueueWithTimeout(func() {}, time.Millisecond) }()
+	req.NoError(clock.AwaitTimers(timers+1, time.Second))
+	clock.Advance(time.Millisecond)
+	req.ErrorIs(<-timedOut, TimeoutError)
+
+	stats := p.Stats()
+	req.Equal(uint32(1), stats.Workers)
+	req.Equal(uint32(1), stats.BusyWorkers)
+	req.Equal(uint32(2), stats.QueueSize)
+	req.Equal(uint32(2), stats.PeakQueueSize)
+	req.Equal(uint32(3), stats.Outstanding)
+	req.Equal(uint64(1), stats.RejectedQueueFull)
+	req.Equal(uint64(1), stats.RejectedTimeout)
+
+	clock.Advance(10 * time.Millisecond)
+	close(release)
+	req.NoError(p.AwaitIdle(time.Second))
+
+	// the worker exits after the panic, and the handler starts a replacement
+	require.Eventually(t, func() bool {
+		return p.Stats().WorkersSpawned == 2
+	}, time.Second, time.Millisecond)
+
+	stats = p.Stats()
+	req.Equal(uint32(0), stats.QueueSize)
+	req.Equal(uint32(2), stats.PeakQueueSize)
+	req.Equal(uint64(3), stats.Completed)
+	req.Equal(uint64(1), stats.Panics)
+	req.Equal(uint64(1), stats.WorkersRetired)
+	req.Equal(uint64(3), stats.QueueWait.Count)
+	req.Equal(uint64(3), stats.RunTime.Count)
+	req.GreaterOrEqual(stats.QueueWait.Max, 10*time.Millisecond)
+	req.GreaterOrEqual(stats.RunTime.Max, 10*time.Millisecond)
+
+	sink := &recordingSink{
+		gauges:    map[string]int64{},
+		counters:  map[string]uint64{},
+		latencies: map[string]*LatencySnapshot{},
+	}
+	stats.Report("pool.test", sink)
+	req.Equal(int64(2), sink.gauges["pool.test.peak_queue_size"])
+	req.Equal(uint64(1), sink.counters["pool.test.rejected.queue_full"])
+	req.Equal(uint64(1), sink.counters["pool.test.panics"])
+	req.Equal(uint64(3), sink.latencies["pool.test.run_time"].Count)
+	req.Len(sink.gauges, 6)
+	req.Len(sink.counters, 8)
+	req.Len(sink.latencies, 2)
+}
@@ -0,0 +1,156 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/openziti/foundation/v2/debugz"
+	"github.com/openziti/foundation/v2/logging"
+)
+
+// StuckTaskReport describes work which has run for longer than its deadline. The work isn't interrupted,
+// and its worker stays busy until it completes
+type StuckTaskReport struct {
+	// The name of the pool, which may be empty
+	PoolName string
+	// The number of the worker running the work
+	WorkerNumber uint32
+	// The label the work was submitted with, if any. See WithTaskLabel
+	Label string
+	// The metadata the work was submitted with, if any. See WithTaskMetadata
+	Metadata TaskMetadata
+	// The deadline the work exceeded
+	Deadline time.Duration
+	// When the work started running
+	Started time.Time
+	// The stack of the worker goroutine, captured once the deadline passed. Reports made close together
+	// share one goroutine dump
+	Stack string
+}
+
+func (self *StuckTaskReport) log() {
+	attrs := []any{
+		slog.String("pool", self.PoolName),
+		slog.Uint64("worker", uint64(self.WorkerNumber)),
+		slog.String("label", self.Label),
+		slog.Duration("deadline", self.Deadline),
+		slog.Time("started", self.Started),
+	}
+
+	if len(self.Metadata) > 0 {
+		attrs = append(attrs, self.Metadata.logAttr())
+	}
+
+	attrs = append(attrs, slog.String("stack", self.Stack))
+	logging.For(logChannel).Warn("pool work exceeded its deadline", attrs...)
+}
+
+// reportStuckTask builds a report for work which has exceeded its deadline and passes it to the handler,
+// or logs it if there is no handler
+func reportStuckTask(poolName string, stacks *stuckStacks, state *workerState, options *taskOptions, deadline time.Duration, started time.Time, handler func(*StuckTaskReport)) {
+	report := &StuckTaskReport{
+		PoolName:     poolName,
+		WorkerNumber: state.number,
+		Label:        options.getLabel(),
+		Metadata:     options.getMetadata(),
+		Deadline:     deadline,
+		Started:      started,
+		Stack:        stacks.get(state.goroutineId, started),
+	}
+
+	if handler != nil {
+		handler(report)
+	} else {
+		report.log()
+	}
+}
+
+// stuckStackReuse is how long a goroutine dump may be shared between stuck task reports
+const stuckStackReuse = time.Second
+
+// stuckStacks shares goroutine dumps between a pool's stuck task reports. Taking a dump stops the world,
+// so when a burst of work goes past its deadline, the reports share one dump rather than taking one each
+type stuckStacks struct {
+	clock   clockz.Clock
+	lock    sync.Mutex
+	takenAt time.Time
+	stacks  map[uint64]string
+}
+
+func newStuckStacks(clock clockz.Clock) *stuckStacks {
+	return &stuckStacks{clock: clock}
+}
+
+// get returns the stack of the goroutine running work which started at the given time. The last dump is
+// reused if it's recent, includes the goroutine, and was taken after the work started, so the stack
+// shows the stuck work rather than something the worker ran before it
+func (self *stuckStacks) get(goroutineId uint64, started time.Time) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := self.clock.Now()
+	if stack, found := self.stacks[goroutineId]; found && !self.takenAt.Before(started) && now.Sub(self.takenAt) < stuckStackReuse {
+		return stack
+	}
+
+	self.stacks = parseGoroutineStacks(debugz.GenerateStack())
+	self.takenAt = now
+	return self.stacks[goroutineId]
+}
+
+const (
+	taskRunning int32 = iota
+	taskFinished
+	taskOverdue
+)
+
+// taskWatch notices when work runs past its deadline. Each watched work item gets its own timer, so work
+// without a deadline costs nothing
+type taskWatch struct {
+	state atomic.Int32
+	timer clockz.Timer
+}
+
+// watchTask calls onOverdue if the work hasn't finished once the deadline has passed. Returns nil if the
+// deadline isn't positive
+func watchTask(clock clockz.Clock, deadline time.Duration, onOverdue func()) *taskWatch {
+	if deadline <= 0 {
+		return nil
+	}
+
+	result := &taskWatch{}
+	result.timer = clock.AfterFunc(deadline, func() {
+		if result.state.CompareAndSwap(taskRunning, taskOverdue) {
+			onOverdue()
+		}
+	})
+	return result
+}
+
+// finish stops watching the work, returning true if it was found to be overdue
+func (self *taskWatch) finish() bool {
+	if self == nil {
+		return false
+	}
+	self.timer.Stop()
+	return !self.state.CompareAndSwap(taskRunning, taskFinished)
+}
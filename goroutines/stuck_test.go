@@ -0,0 +1,183 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/stretchr/testify/require"
+)
+
+func blockInStuckTest(release <-chan struct{}) {
+	<-release
+}
+
+func TestStuckTasks(t *testing.T) {
+	newPools := map[string]func(config PoolConfig) (fullPool, error){
+		"pool": newFullPool,
+		"sharded": func(config PoolConfig) (fullPool, error) {
+			return NewShardedPool(config)
+		},
+	}
+
+	for name, newPool := range newPools {
+		t.Run(name, func(t *testing.T) {
+			newTestPool := func(t *testing.T, deadline time.Duration, reports chan *StuckTaskReport) (fullPool, *clockz.FakeClock) {
+				clock := clockz.NewFakeClock(time.Now())
+				p, err := newPool(PoolConfig{
+					Name:             "stuck-test",
+					QueueSize:        4,
+					MinWorkers:       0,
+					MaxWorkers:       2,
+					IdleTime:         time.Second,
+					TaskDeadline:     deadline,
+					StuckTaskHandler: func(report *StuckTaskReport) { reports <- report },
+					Clock:            clock,
+				})
+				require.NoError(t, err)
+				t.Cleanup(p.Shutdown)
+				return p, clock
+			}
+
+			t.Run("reports work past the pool deadline", func(t *testing.T) {
+				req := require.New(t)
+				reports := make(chan *StuckTaskReport, 4)
+				p, clock := newTestPool(t, 20*time.Millisecond, reports)
+
+				release := make(chan struct{})
+				ctx := WithTaskLabel(context.Background(), "slow-task")
+				ctx = WithTaskMetadata(ctx, TaskMetadata{"circuitId": "abc"})
+				req.NoError(p.QueueCtx(ctx, func(context.Context) { blockInStuckTest(release) }))
+
+				report := advanceUntilReceived(t, clock, 20*time.Millisecond, reports)
+				req.Equal("stuck-test", report.PoolName)
+				req.Equal("slow-task", report.Label)
+				req.Equal(TaskMetadata{"circuitId": "abc"}, report.Metadata)
+				req.Equal(20*time.Millisecond, report.Deadline)
+				req.NotZero(report.WorkerNumber)
+				req.GreaterOrEqual(clock.Since(report.Started), 20*time.Millisecond)
+				req.Contains(report.Stack, "blockInStuckTest")
+
+				stats := p.Stats()
+				req.Equal(uint32(1), stats.StuckWorkers)
+				req.Equal(uint64(1), stats.DeadlinesExceeded)
+
+				close(release)
+				req.NoError(p.AwaitIdle(time.Second))
+				stats = p.Stats()
+				req.Equal(uint32(0), stats.StuckWorkers)
+				req.Equal(uint64(1), stats.DeadlinesExceeded)
+			})
+
+			t.Run("doesn't report work which finishes in time", func(t *testing.T) {
+				req := require.New(t)
+				reports := make(chan *StuckTaskReport, 4)
+				p, clock := newTestPool(t, 50*time.Millisecond, reports)
+
+				for i := 0; i < 10; i++ {
+					req.NoError(p.Queue(func() {}))
+				}
+				req.NoError(p.AwaitIdle(time.Second))
+
+				// the watches are stopped as the work completes, so moving past the deadline reports nothing
+				clock.Advance(70 * time.Millisecond)
+				req.Empty(reports)
+				req.Equal(uint64(0), p.Stats().DeadlinesExceeded)
+			})
+
+			t.Run("uses the task deadline over the pool deadline", func(t *testing.T) {
+				req := require.New(t)
+				reports := make(chan *StuckTaskReport, 4)
+				p, clock := newTestPool(t, 0, reports)
+
+				release := make(chan struct{})
+				defer close(release)
+
+				ctx := WithTaskDeadline(context.Background(), 10*time.Millisecond)
+				req.NoError(p.QueueCtx(ctx, func(context.Context) { blockInStuckTest(release) }))
+				req.NoError(p.Queue(func() { blockInStuckTest(release) }))
+
+				report := advanceUntilReceived(t, clock, 10*time.Millisecond, reports)
+				req.Equal(10*time.Millisecond, report.Deadline)
+
+				clock.Advance(20 * time.Millisecond)
+				req.Empty(reports, "work without a deadline shouldn't be reported")
+			})
+		})
+	}
+
+	t.Run("replaces stuck workers", func(t *testing.T) {
+		req := require.New(t)
+		p, clock := newFakeClockPool(t, PoolConfig{
+			QueueSize:           4,
+			MinWorkers:          0,
+			MaxWorkers:          1,
+			IdleTime:            time.Second,
+			TaskDeadline:        20 * time.Millisecond,
+			StuckTaskHandler:    func(*StuckTaskReport) {},
+			ReplaceStuckWorkers: true,
+		})
+
+		release := make(chan struct{})
+		req.NoError(p.Queue(func() { blockInStuckTest(release) }))
+
+		done := make(chan struct{})
+		req.NoError(p.Queue(func() { close(done) }))
+		advanceUntilReceived(t, clock, 20*time.Millisecond, done)
+		req.Equal(uint32(2), p.GetWorkerCount())
+
+		close(release)
+		req.NoError(p.AwaitIdle(time.Second))
+		req.Equal(uint32(0), p.Stats().StuckWorkers)
+
+		// once the stuck work completes, the pool is back over its max and a worker retires
+		require.Eventually(t, func() bool {
+			return p.GetWorkerCount() == 1
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("sharded pools don't replace stuck workers", func(t *testing.T) {
+		_, err := NewShardedPool(PoolConfig{QueueSize: 4, MaxWorkers: 2, ReplaceStuckWorkers: true})
+		require.Error(t, err)
+	})
+}
+
+func TestStuckStacksShareDumps(t *testing.T) {
+	req := require.New(t)
+	start := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	clock := clockz.NewFakeClock(start)
+	stacks := newStuckStacks(clock)
+	id := currentGoroutineId()
+
+	req.Contains(stacks.get(id, start), "TestStuckStacksShareDumps")
+	taken := stacks.stacks
+
+	clock.Advance(stuckStackReuse / 2)
+	req.Contains(stacks.get(id, start), "TestStuckStacksShareDumps")
+	req.Equal(start, stacks.takenAt, "a recent dump should be reused")
+	req.Equal(taken, stacks.stacks)
+
+	stacks.get(id, clock.Now())
+	req.Equal(clock.Now(), stacks.takenAt, "work started after the dump needs a new one")
+
+	clock.Advance(stuckStackReuse)
+	stacks.get(id, start)
+	req.Equal(clock.Now(), stacks.takenAt, "an old dump should be replaced")
+}
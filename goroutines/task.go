@@ -0,0 +1,120 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// TaskMetadata describes a unit of work, such as the circuit or request it belongs to. It is included
+// in panic and stuck task reports for the work. See WithTaskMetadata
+type TaskMetadata map[string]string
+
+// logAttr returns the metadata as a log group, with the keys in sorted order
+func (self TaskMetadata) logAttr() slog.Attr {
+	keys := make([]string, 0, len(self))
+	for key := range self {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]any, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, slog.String(key, self[key]))
+	}
+	return slog.Group("metadata", attrs...)
+}
+
+// taskOptions holds the per-task settings carried by a context. Work submitted to a pool with one of the
+// context aware queue methods carries the options of its context
+type taskOptions struct {
+	label    string
+	metadata TaskMetadata
+	deadline time.Duration
+}
+
+type taskOptionsKey struct{}
+
+// withTaskOptions returns a context carrying a copy of the context's existing task options, updated by
+// the given function, so that options set by earlier calls are kept
+func withTaskOptions(ctx context.Context, update func(options *taskOptions)) context.Context {
+	options := &taskOptions{}
+	if current := taskOptionsFrom(ctx); current != nil {
+		*options = *current
+	}
+	update(options)
+	return context.WithValue(ctx, taskOptionsKey{}, options)
+}
+
+func taskOptionsFrom(ctx context.Context) *taskOptions {
+	options, _ := ctx.Value(taskOptionsKey{}).(*taskOptions)
+	return options
+}
+
+// WithTaskMetadata returns a context carrying the given metadata. Work submitted to a pool with the
+// context, using one of the context aware queue methods, carries the metadata
+func WithTaskMetadata(ctx context.Context, metadata TaskMetadata) context.Context {
+	return withTaskOptions(ctx, func(options *taskOptions) {
+		options.metadata = metadata
+	})
+}
+
+// TaskMetadataFrom returns the metadata set on the context with WithTaskMetadata, or nil if there is none
+func TaskMetadataFrom(ctx context.Context) TaskMetadata {
+	return taskOptionsFrom(ctx).getMetadata()
+}
+
+// WithTaskLabel returns a context carrying the given label, which identifies work submitted with the
+// context in stuck task reports
+func WithTaskLabel(ctx context.Context, label string) context.Context {
+	return withTaskOptions(ctx, func(options *taskOptions) {
+		options.label = label
+	})
+}
+
+// WithTaskDeadline returns a context carrying a soft deadline for work submitted with the context,
+// which overrides the pool's TaskDeadline. See PoolConfig.TaskDeadline
+func WithTaskDeadline(ctx context.Context, deadline time.Duration) context.Context {
+	return withTaskOptions(ctx, func(options *taskOptions) {
+		options.deadline = deadline
+	})
+}
+
+func (self *taskOptions) getMetadata() TaskMetadata {
+	if self == nil {
+		return nil
+	}
+	return self.metadata
+}
+
+func (self *taskOptions) getLabel() string {
+	if self == nil {
+		return ""
+	}
+	return self.label
+}
+
+// getDeadline returns the task's own deadline if it has one, otherwise the given pool deadline
+func (self *taskOptions) getDeadline(poolDeadline time.Duration) time.Duration {
+	if self == nil || self.deadline <= 0 {
+		return poolDeadline
+	}
+	return self.deadline
+}
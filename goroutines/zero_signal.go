@@ -0,0 +1,69 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package goroutines
+
+import (
+	"context"
+	"sync"
+)
+
+// zeroSignal lets goroutines wait for a counter to reach zero without polling. A waiter takes the
+// current notification channel and only then checks the counter. The goroutine which brings the
+// counter to zero calls signal afterwards, which closes the channel, waking every waiter to check
+// again. Because the channel is taken before the check, a transition to zero can't be missed: either
+// the waiter sees the zero, or it holds the channel that the transition closes.
+//
+// Only transitions to zero take the lock, so counters which are rarely zero pay nothing extra.
+type zeroSignal struct {
+	lock sync.Mutex
+	c    chan struct{}
+}
+
+func (self *zeroSignal) notifyC() <-chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.c == nil {
+		self.c = make(chan struct{})
+	}
+	return self.c
+}
+
+func (self *zeroSignal) signal() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.c != nil {
+		close(self.c)
+		self.c = nil
+	}
+}
+
+// await blocks until isZero returns true, or until the context is done, in which case the
+// context's error is returned
+func (self *zeroSignal) await(ctx context.Context, isZero func() bool) error {
+	for {
+		notifyC := self.notifyC()
+		if isZero() {
+			return nil
+		}
+
+		select {
+		case <-notifyC:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
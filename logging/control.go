@@ -0,0 +1,348 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/pkg/errors"
+)
+
+// maxLevelRequestSize bounds the body of a level change request.
+const maxLevelRequestSize = 4096
+
+// LevelHandlerOptions configures a LevelHandler. The zero value controls
+// the default Registry.
+type LevelHandlerOptions struct {
+	// Registry is the registry whose levels are controlled. It defaults to
+	// DefaultRegistry.
+	Registry *Registry
+
+	// SetGlobalLevel is called to change the global level, defaulting to
+	// the Registry's SetGlobalLevel. Callers which drive logrus in lockstep
+	// with the Registry pass their wrapper here.
+	SetGlobalLevel func(level slog.Level)
+
+	// Clock times temporary overrides. It defaults to the real clock.
+	Clock clockz.Clock
+}
+
+// LevelHandler is an http.Handler for changing log levels on a running
+// process. It is meant to be served on a local listener, such as a unix
+// socket, since it has no authentication of its own:
+//
+//	listener, err := net.Listen("unix", "/var/run/ziti/log.sock")
+//	...
+//	go http.Serve(listener, logging.NewLevelHandler(logging.LevelHandlerOptions{}))
+//
+// Levels are given and reported by their ParseLevel/LevelName names. The
+// routes are:
+//
+//	GET    /levels               the global level and every override
+//	GET    /levels/global        the global level
+//	PUT    /levels/global        set the global level
+//	GET    /levels/named/{name}  the effective level for name, and its override if any
+//	PUT    /levels/named/{name}  set an override for name, which may be a pattern
+//	DELETE /levels/named/{name}  remove the override for name
+//
+// PUT takes a body of {"level": "debug"}, optionally with a "ttl" such as
+// "15m". A level set with a TTL is temporary: when the TTL passes, the
+// level reverts to what it was before, which for a name without an earlier
+// override means the override is removed. Setting a level again, with or
+// without a TTL, replaces the pending revert; a temporary level set over
+// another temporary one still reverts to the level from before either.
+type LevelHandler struct {
+	registry       *Registry
+	setGlobalLevel func(level slog.Level)
+	clock          clockz.Clock
+	mux            *http.ServeMux
+	mu             sync.Mutex
+	// reverts holds the pending revert for each temporary level, keyed by
+	// override name, with globalRevertKey for the global level.
+	reverts map[string]*levelRevert
+}
+
+var _ http.Handler = (*LevelHandler)(nil)
+
+// globalRevertKey keys the global level's revert. Override names can't be
+// empty, so it can't collide with one.
+const globalRevertKey = ""
+
+// levelRevert restores a level when its temporary replacement expires.
+type levelRevert struct {
+	timer   clockz.Timer
+	expires time.Time
+	restore func()
+}
+
+// levelRequest is the body of a PUT.
+type levelRequest struct {
+	Level string `json:"level"`
+	TTL   string `json:"ttl,omitempty"`
+}
+
+// levelState reports a level, and when it reverts if it's temporary.
+type levelState struct {
+	Name    string     `json:"name,omitempty"`
+	Level   string     `json:"level"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// namedLevelState reports the level applied to a name.
+type namedLevelState struct {
+	Name     string      `json:"name"`
+	Level    string      `json:"level"`
+	Override *levelState `json:"override,omitempty"`
+}
+
+// levelsState reports the global level and every override.
+type levelsState struct {
+	Global    levelState   `json:"global"`
+	Overrides []levelState `json:"overrides"`
+}
+
+type levelError struct {
+	Error string `json:"error"`
+}
+
+// NewLevelHandler returns a LevelHandler for the registry in opts.
+func NewLevelHandler(opts LevelHandlerOptions) *LevelHandler {
+	registry := opts.Registry
+	if registry == nil {
+		registry = DefaultRegistry()
+	}
+	setGlobalLevel := opts.SetGlobalLevel
+	if setGlobalLevel == nil {
+		setGlobalLevel = registry.SetGlobalLevel
+	}
+	h := &LevelHandler{
+		registry:       registry,
+		setGlobalLevel: setGlobalLevel,
+		clock:          clockz.OrReal(opts.Clock),
+		mux:            http.NewServeMux(),
+		reverts:        map[string]*levelRevert{},
+	}
+	h.mux.HandleFunc("GET /levels", h.getLevels)
+	h.mux.HandleFunc("GET /levels/global", h.getGlobal)
+	h.mux.HandleFunc("PUT /levels/global", h.putGlobal)
+	h.mux.HandleFunc("GET /levels/named/{name...}", h.getNamed)
+	h.mux.HandleFunc("PUT /levels/named/{name...}", h.putNamed)
+	h.mux.HandleFunc("DELETE /levels/named/{name...}", h.deleteNamed)
+	return h
+}
+
+func (h *LevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Close cancels pending reverts, leaving temporary levels in place.
+func (h *LevelHandler) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, revert := range h.reverts {
+		revert.timer.Stop()
+		delete(h.reverts, key)
+	}
+}
+
+func (h *LevelHandler) getLevels(w http.ResponseWriter, _ *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := levelsState{
+		Global:    h.stateLocked(globalRevertKey, h.registry.GlobalLevel()),
+		Overrides: []levelState{},
+	}
+	for name, level := range h.registry.NamedLevels() {
+		result.Overrides = append(result.Overrides, h.stateLocked(name, level))
+	}
+	sort.Slice(result.Overrides, func(i, j int) bool {
+		return result.Overrides[i].Name < result.Overrides[j].Name
+	})
+	writeLevelJSON(w, http.StatusOK, result)
+}
+
+func (h *LevelHandler) getGlobal(w http.ResponseWriter, _ *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeLevelJSON(w, http.StatusOK, h.stateLocked(globalRevertKey, h.registry.GlobalLevel()))
+}
+
+func (h *LevelHandler) putGlobal(w http.ResponseWriter, r *http.Request) {
+	level, ttl, err := readLevelRequest(w, r)
+	if err != nil {
+		writeLevelError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := h.registry.GlobalLevel()
+	h.setLocked(globalRevertKey, ttl, func() { h.setGlobalLevel(level) }, func() { h.setGlobalLevel(previous) })
+	writeLevelJSON(w, http.StatusOK, h.stateLocked(globalRevertKey, h.registry.GlobalLevel()))
+}
+
+func (h *LevelHandler) getNamed(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == "" {
+		writeLevelError(w, http.StatusBadRequest, errors.New("name must not be empty"))
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeLevelJSON(w, http.StatusOK, h.namedStateLocked(name))
+}
+
+func (h *LevelHandler) putNamed(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == "" {
+		writeLevelError(w, http.StatusBadRequest, errors.New("name must not be empty"))
+		return
+	}
+	level, ttl, err := readLevelRequest(w, r)
+	if err != nil {
+		writeLevelError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	restore := func() { h.registry.ClearNamedLevel(name) }
+	if previous, ok := h.registry.NamedLevel(name); ok {
+		restore = func() { h.registry.SetNamedLevel(name, previous) }
+	}
+	h.setLocked(name, ttl, func() { h.registry.SetNamedLevel(name, level) }, restore)
+	writeLevelJSON(w, http.StatusOK, h.namedStateLocked(name))
+}
+
+func (h *LevelHandler) deleteNamed(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.registry.NamedLevel(name); !ok {
+		writeLevelError(w, http.StatusNotFound, errors.Errorf("no override set for %q", name))
+		return
+	}
+	h.cancelRevertLocked(name)
+	h.registry.ClearNamedLevel(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setLocked applies a level change. With a ttl, restore is scheduled to run
+// once it passes, unless a temporary level is already pending, whose
+// restore is kept instead. The caller must hold mu.
+func (h *LevelHandler) setLocked(key string, ttl time.Duration, apply func(), restore func()) {
+	if pending, ok := h.reverts[key]; ok {
+		restore = pending.restore
+		h.cancelRevertLocked(key)
+	}
+	apply()
+	if ttl <= 0 {
+		return
+	}
+
+	revert := &levelRevert{expires: h.clock.Now().Add(ttl), restore: restore}
+	revert.timer = h.clock.AfterFunc(ttl, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		// a later change may have replaced this revert after the timer fired
+		if h.reverts[key] == revert {
+			delete(h.reverts, key)
+			revert.restore()
+		}
+	})
+	h.reverts[key] = revert
+}
+
+// cancelRevertLocked drops any pending revert for key. The caller must hold
+// mu.
+func (h *LevelHandler) cancelRevertLocked(key string) {
+	if revert, ok := h.reverts[key]; ok {
+		revert.timer.Stop()
+		delete(h.reverts, key)
+	}
+}
+
+// stateLocked reports level for key, with its expiry if it's temporary. The
+// caller must hold mu.
+func (h *LevelHandler) stateLocked(key string, level slog.Level) levelState {
+	result := levelState{Name: key, Level: LevelName(level)}
+	if revert, ok := h.reverts[key]; ok {
+		expires := revert.expires
+		result.Expires = &expires
+	}
+	return result
+}
+
+// namedStateLocked reports the effective level for name and its override.
+// The caller must hold mu.
+func (h *LevelHandler) namedStateLocked(name string) namedLevelState {
+	result := namedLevelState{Name: name, Level: LevelName(h.registry.EffectiveLevel(name))}
+	if level, ok := h.registry.NamedLevel(name); ok {
+		override := h.stateLocked(name, level)
+		result.Override = &override
+	}
+	return result
+}
+
+// readLevelRequest decodes and validates the body of a PUT.
+func readLevelRequest(w http.ResponseWriter, r *http.Request) (slog.Level, time.Duration, error) {
+	var req levelRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLevelRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, 0, errors.New("request body must not be empty")
+		}
+		return 0, 0, errors.Wrap(err, "invalid request body")
+	}
+
+	level, err := ParseLevel(req.Level)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid ttl %q", req.TTL)
+		}
+		if ttl <= 0 {
+			return 0, 0, errors.Errorf("ttl must be > 0, got %v", ttl)
+		}
+	}
+	return level, ttl, nil
+}
+
+func writeLevelJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeLevelError(w http.ResponseWriter, status int, err error) {
+	writeLevelJSON(w, status, levelError{Error: err.Error()})
+}
@@ -0,0 +1,226 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/stretchr/testify/require"
+)
+
+var controlTestStart = time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func newTestLevelHandler(t *testing.T) (*LevelHandler, *Registry, *clockz.FakeClock) {
+	t.Helper()
+	registry := NewRegistry(discardHandler{})
+	clock := clockz.NewFakeClock(controlTestStart)
+	h := NewLevelHandler(LevelHandlerOptions{Registry: registry, Clock: clock})
+	t.Cleanup(h.Close)
+	return h, registry, clock
+}
+
+// serveLevel sends a request to h, returning the status and decoding the
+// response body into result if given.
+func serveLevel(t *testing.T, h http.Handler, method, path, body string, result any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if result != nil {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), result), "body: %s", w.Body.String())
+	}
+	return w.Code
+}
+
+func TestLevelHandlerGlobal(t *testing.T) {
+	h, registry, _ := newTestLevelHandler(t)
+
+	var state levelState
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "GET", "/levels/global", "", &state))
+	require.Equal(t, levelState{Level: "info"}, state)
+
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/global", `{"level":"TRACE"}`, &state))
+	require.Equal(t, levelState{Level: "trace"}, state)
+	require.Equal(t, LevelTrace, registry.GlobalLevel())
+}
+
+func TestLevelHandlerUsesGlobalLevelSetter(t *testing.T) {
+	registry := NewRegistry(discardHandler{})
+	var set []slog.Level
+	h := NewLevelHandler(LevelHandlerOptions{
+		Registry: registry,
+		SetGlobalLevel: func(level slog.Level) {
+			set = append(set, level)
+			registry.SetGlobalLevel(level)
+		},
+	})
+
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/global", `{"level":"warn"}`, nil))
+	require.Equal(t, []slog.Level{slog.LevelWarn}, set)
+}
+
+func TestLevelHandlerNamed(t *testing.T) {
+	h, registry, _ := newTestLevelHandler(t)
+
+	var named namedLevelState
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/named/ziti.router", `{"level":"debug"}`, &named))
+	require.Equal(t, namedLevelState{
+		Name:     "ziti.router",
+		Level:    "debug",
+		Override: &levelState{Name: "ziti.router", Level: "debug"},
+	}, named)
+	require.Equal(t, slog.LevelDebug, registry.EffectiveLevel("ziti.router.xgress"))
+
+	// names may contain slashes, and patterns need their wildcards escaped
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/named/ziti.router/link", `{"level":"error"}`, nil))
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/named/edge.%2A", `{"level":"warn"}`, nil))
+
+	var inherited namedLevelState
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "GET", "/levels/named/ziti.router.xgress", "", &inherited))
+	require.Equal(t, namedLevelState{Name: "ziti.router.xgress", Level: "debug"}, inherited, "the level is inherited, with no override of its own")
+
+	var levels levelsState
+	require.Equal(t, http.StatusOK, serveLevel(t, h, "GET", "/levels", "", &levels))
+	require.Equal(t, levelsState{
+		Global: levelState{Level: "info"},
+		Overrides: []levelState{
+			{Name: "edge.*", Level: "warn"},
+			{Name: "ziti.router", Level: "debug"},
+			{Name: "ziti.router/link", Level: "error"},
+		},
+	}, levels)
+
+	require.Equal(t, http.StatusNoContent, serveLevel(t, h, "DELETE", "/levels/named/ziti.router", "", nil))
+	require.Equal(t, slog.LevelInfo, registry.EffectiveLevel("ziti.router.xgress"))
+
+	var levelErr levelError
+	require.Equal(t, http.StatusNotFound, serveLevel(t, h, "DELETE", "/levels/named/ziti.router", "", &levelErr))
+	require.Contains(t, levelErr.Error, "ziti.router")
+}
+
+func TestLevelHandlerRejectsBadRequests(t *testing.T) {
+	h, _, _ := newTestLevelHandler(t)
+
+	for _, body := range []string{"", "{", `{"level":"loud"}`, `{"level":"info","ttl":"soon"}`, `{"level":"info","ttl":"-1m"}`, `{"level":"info","extra":1}`} {
+		var levelErr levelError
+		require.Equal(t, http.StatusBadRequest, serveLevel(t, h, "PUT", "/levels/global", body, &levelErr), "body %q", body)
+		require.NotEmpty(t, levelErr.Error)
+	}
+
+	require.Equal(t, http.StatusBadRequest, serveLevel(t, h, "PUT", "/levels/named/", `{"level":"info"}`, nil))
+	require.Equal(t, http.StatusMethodNotAllowed, serveLevel(t, h, "POST", "/levels/global", `{"level":"info"}`, nil))
+	require.Equal(t, http.StatusNotFound, serveLevel(t, h, "GET", "/other", "", nil))
+}
+
+func TestLevelHandlerTemporaryLevels(t *testing.T) {
+	t.Run("a new override is removed", func(t *testing.T) {
+		h, registry, clock := newTestLevelHandler(t)
+
+		var named namedLevelState
+		require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/named/ziti.router", `{"level":"trace","ttl":"10m"}`, &named))
+		expires := controlTestStart.Add(10 * time.Minute)
+		require.Equal(t, &expires, named.Override.Expires)
+
+		clock.Advance(10 * time.Minute)
+		require.Eventually(t, func() bool {
+			_, ok := registry.NamedLevel("ziti.router")
+			return !ok
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("an existing override is restored", func(t *testing.T) {
+		h, registry, clock := newTestLevelHandler(t)
+		registry.SetNamedLevel("ziti.router", slog.LevelWarn)
+
+		require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/named/ziti.router", `{"level":"trace","ttl":"10m"}`, nil))
+		// stacking a second temporary level still reverts to the original
+		require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/named/ziti.router", `{"level":"debug","ttl":"20m"}`, nil))
+		require.Equal(t, 1, clock.TimerCount())
+
+		clock.Advance(10 * time.Minute)
+		level, _ := registry.NamedLevel("ziti.router")
+		require.Equal(t, slog.LevelDebug, level, "the first TTL was replaced")
+
+		clock.Advance(10 * time.Minute)
+		require.Eventually(t, func() bool {
+			level, ok := registry.NamedLevel("ziti.router")
+			return ok && level == slog.LevelWarn
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("a permanent change cancels the revert", func(t *testing.T) {
+		h, registry, clock := newTestLevelHandler(t)
+
+		require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/global", `{"level":"debug","ttl":"1m"}`, nil))
+		var levels levelsState
+		require.Equal(t, http.StatusOK, serveLevel(t, h, "GET", "/levels", "", &levels))
+		require.NotNil(t, levels.Global.Expires)
+
+		require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/global", `{"level":"warn"}`, nil))
+		require.Equal(t, 0, clock.TimerCount())
+		clock.Advance(time.Minute)
+		require.Equal(t, slog.LevelWarn, registry.GlobalLevel())
+	})
+
+	t.Run("the global level reverts", func(t *testing.T) {
+		h, registry, clock := newTestLevelHandler(t)
+
+		require.Equal(t, http.StatusOK, serveLevel(t, h, "PUT", "/levels/global", `{"level":"debug","ttl":"1m"}`, nil))
+		require.Equal(t, slog.LevelDebug, registry.GlobalLevel())
+		clock.Advance(time.Minute)
+		require.Eventually(t, func() bool {
+			return registry.GlobalLevel() == slog.LevelInfo
+		}, time.Second, time.Millisecond)
+	})
+}
+
+// TestLevelHandlerOverUnixSocket serves the handler the way it's meant to
+// be deployed, on a local unix socket.
+func TestLevelHandlerOverUnixSocket(t *testing.T) {
+	h, registry, _ := newTestLevelHandler(t)
+
+	path := filepath.Join(t.TempDir(), "log.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	server := &http.Server{Handler: h}
+	go func() { _ = server.Serve(listener) }()
+	defer func() { _ = server.Close() }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	req, err := http.NewRequest("PUT", "http://local/levels/named/ziti.router", strings.NewReader(`{"level":"debug"}`))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, slog.LevelDebug, registry.EffectiveLevel("ziti.router"))
+}
@@ -0,0 +1,550 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/pkg/errors"
+)
+
+// backupTimeLayout is the timestamp added to rotated file names, in UTC.
+const backupTimeLayout = "20060102T150405.000"
+
+// FileOptions configures a RotatingFile, and the FileHandler writing to one.
+// Only Path is required; the zero value of every other field disables the
+// feature it controls.
+type FileOptions struct {
+	// Path is the file records are written to. Rotated files are kept in
+	// the same directory, named after Path with the rotation time added
+	// before the extension: router.log rotates to
+	// router-20240102T150405.000.log.
+	Path string
+
+	// MaxSize rotates the file before a write would take it past this many
+	// bytes. A single write larger than MaxSize still goes to one file.
+	MaxSize int64
+
+	// RotateEvery rotates the file at each multiple of this interval since
+	// the zero time, so 24h rotates at midnight UTC. The boundary is only
+	// checked when a write happens, so a file which isn't written to keeps
+	// its records until the next write after the boundary.
+	RotateEvery time.Duration
+
+	// MaxBackups is the number of rotated files kept. The oldest files past
+	// this count are removed.
+	MaxBackups int
+
+	// MaxAge removes rotated files once they were rotated this long ago.
+	MaxAge time.Duration
+
+	// Compress gzips rotated files. Compression and removal happen on a
+	// background goroutine, so they never hold up a write.
+	Compress bool
+
+	// ReopenOnSIGHUP reopens Path when the process receives SIGHUP, for
+	// use with an external tool such as logrotate which moves the file
+	// aside and then signals the process.
+	ReopenOnSIGHUP bool
+
+	// NewHandler builds the handler that formats records onto the file. It
+	// defaults to a JSON handler which accepts every level, since gating
+	// happens upstream in the Registry.
+	NewHandler func(w io.Writer) slog.Handler
+
+	// Clock is used for rotation times and file ages. It defaults to the
+	// real clock.
+	Clock clockz.Clock
+}
+
+// Validate returns an error if any field is outside its valid range.
+func (o FileOptions) Validate() error {
+	if o.Path == "" {
+		return errors.New("Path must be set")
+	}
+	if o.MaxSize < 0 {
+		return errors.Errorf("MaxSize must be >= 0, got %d", o.MaxSize)
+	}
+	if o.RotateEvery < 0 {
+		return errors.Errorf("RotateEvery must be >= 0, got %v", o.RotateEvery)
+	}
+	if o.MaxBackups < 0 {
+		return errors.Errorf("MaxBackups must be >= 0, got %d", o.MaxBackups)
+	}
+	if o.MaxAge < 0 {
+		return errors.Errorf("MaxAge must be >= 0, got %v", o.MaxAge)
+	}
+	return nil
+}
+
+// RotatingFile is an io.WriteCloser over a file which it rotates by size and
+// time, pruning and optionally compressing the rotated files. Writes,
+// rotation and Reopen are serialized by an internal mutex, so it is safe to
+// use from several goroutines, and a SIGHUP reopen can't interleave with a
+// write in progress. Each Write goes straight to the file, so a record
+// written behind AsyncHandler's downstreamMu is on disk when Handle
+// returns.
+//
+// A rotation which fails during a Write doesn't lose the record: it is
+// written to whichever file is open afterwards, and the rotation error is
+// reported on os.Stderr.
+type RotatingFile struct {
+	opts         FileOptions
+	clock        clockz.Clock
+	rename       func(oldPath, newPath string) error
+	reportError  func(err error)
+	mu           sync.Mutex
+	file         *os.File
+	size         int64
+	nextRotation time.Time
+	closed       bool
+	millC        chan struct{}
+	signalC      chan os.Signal
+	closeNotify  chan struct{}
+	done         sync.WaitGroup
+}
+
+var _ io.WriteCloser = (*RotatingFile)(nil)
+
+// NewRotatingFile opens opts.Path for appending, creating it and its
+// directory if needed, and starts the goroutines which prune rotated files
+// and, if enabled, listen for SIGHUP.
+func NewRotatingFile(opts FileOptions) (*RotatingFile, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	f := &RotatingFile{
+		opts:        opts,
+		clock:       clockz.OrReal(opts.Clock),
+		rename:      os.Rename,
+		reportError: reportRotateError,
+		millC:       make(chan struct{}, 1),
+		closeNotify: make(chan struct{}),
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "unable to create log directory for %s", opts.Path)
+	}
+	if err := f.openLocked(); err != nil {
+		return nil, err
+	}
+	f.nextRotation = f.rotationAfter(f.clock.Now())
+
+	f.done.Add(1)
+	go f.runMill()
+	// prune whatever earlier runs left behind
+	f.requestMill()
+
+	if opts.ReopenOnSIGHUP {
+		f.signalC = make(chan os.Signal, 1)
+		signal.Notify(f.signalC, syscall.SIGHUP)
+		f.done.Add(1)
+		go f.runReopenOnSignal()
+	}
+	return f, nil
+}
+
+// Write writes p to the current file, rotating first if p would take the
+// file past MaxSize or a RotateEvery boundary has passed. Rotation errors
+// are reported rather than returned, since p is still written; Write only
+// fails if no file can be opened at Path, or the write itself fails.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errors.Errorf("log file %s is closed", f.opts.Path)
+	}
+	if err := f.rotateIfDueLocked(int64(len(p))); err != nil {
+		f.reportError(err)
+	}
+	if err := f.ensureOpenLocked(); err != nil {
+		return 0, err
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one, regardless of
+// its size or age. An empty file isn't rotated.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errors.Errorf("log file %s is closed", f.opts.Path)
+	}
+	if err := f.ensureOpenLocked(); err != nil {
+		return err
+	}
+	return f.rotateLocked()
+}
+
+// Reopen closes the current file and opens Path again, without rotating.
+// After an external tool has moved the file aside, this starts a new file
+// at Path. It's what SIGHUP triggers when ReopenOnSIGHUP is set. If closing
+// the current file fails, Path is still reopened and the close error is
+// returned.
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errors.Errorf("log file %s is closed", f.opts.Path)
+	}
+	closeErr := f.closeLocked()
+	if err := f.openLocked(); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Close stops the background goroutines and closes the file. Rotated files
+// still waiting to be compressed are compressed on the next start. Calling
+// Close more than once is a no-op.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	err := f.closeLocked()
+	f.mu.Unlock()
+
+	if f.signalC != nil {
+		signal.Stop(f.signalC)
+	}
+	close(f.closeNotify)
+	f.done.Wait()
+	return err
+}
+
+// openLocked opens Path for appending and picks up its current size. The
+// caller must hold mu, or be the constructor.
+func (f *RotatingFile) openLocked() error {
+	file, err := os.OpenFile(f.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open log file %s", f.opts.Path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "unable to stat log file %s", f.opts.Path)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// closeLocked closes the current file, if one is open. The descriptor can't
+// be trusted once a close has failed, so the file is dropped either way,
+// and the next write opens Path again. The caller must hold mu.
+func (f *RotatingFile) closeLocked() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return errors.Wrapf(err, "unable to close log file %s", f.opts.Path)
+	}
+	return nil
+}
+
+// ensureOpenLocked opens Path if an earlier failed close or open left no
+// file open. The caller must hold mu.
+func (f *RotatingFile) ensureOpenLocked() error {
+	if f.file != nil {
+		return nil
+	}
+	return f.openLocked()
+}
+
+// rotateIfDueLocked rotates if writing pending more bytes would pass
+// MaxSize, or the RotateEvery boundary has passed. The caller must hold mu.
+func (f *RotatingFile) rotateIfDueLocked(pending int64) error {
+	if f.opts.RotateEvery > 0 && !f.clock.Now().Before(f.nextRotation) {
+		return f.rotateLocked()
+	}
+	if f.opts.MaxSize > 0 && f.size+pending > f.opts.MaxSize {
+		return f.rotateLocked()
+	}
+	return nil
+}
+
+// rotateLocked renames the current file to its backup name and opens a new
+// one at Path. If closing the current file fails, the rotation still goes
+// ahead and the close error is returned. The caller must hold mu.
+func (f *RotatingFile) rotateLocked() error {
+	now := f.clock.Now()
+	f.nextRotation = f.rotationAfter(now)
+	if f.size == 0 {
+		return nil
+	}
+
+	closeErr := f.closeLocked()
+	if err := f.rename(f.opts.Path, f.backupPath(now)); err != nil {
+		// keep writing to the existing file rather than losing records
+		if openErr := f.openLocked(); openErr != nil {
+			return openErr
+		}
+		return errors.Wrapf(err, "unable to rotate log file %s", f.opts.Path)
+	}
+	if err := f.openLocked(); err != nil {
+		return err
+	}
+	f.requestMill()
+	return closeErr
+}
+
+// rotationAfter returns the first RotateEvery boundary after t.
+func (f *RotatingFile) rotationAfter(t time.Time) time.Time {
+	if f.opts.RotateEvery <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.opts.RotateEvery).Add(f.opts.RotateEvery)
+}
+
+// backupPath returns an unused name to rotate the current file to. If two
+// rotations land on the same millisecond, the later one is named a
+// millisecond on.
+func (f *RotatingFile) backupPath(t time.Time) string {
+	prefix, ext := f.backupNameParts()
+	for {
+		path := filepath.Join(filepath.Dir(f.opts.Path), prefix+t.UTC().Format(backupTimeLayout)+ext)
+		if !fileExists(path) && !fileExists(path+".gz") {
+			return path
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// backupNameParts returns what rotated file names start and end with.
+func (f *RotatingFile) backupNameParts() (prefix, ext string) {
+	base := filepath.Base(f.opts.Path)
+	ext = filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-", ext
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// requestMill asks the mill goroutine to prune and compress rotated files.
+// Requests made while one is pending are merged.
+func (f *RotatingFile) requestMill() {
+	select {
+	case f.millC <- struct{}{}:
+	default:
+	}
+}
+
+func (f *RotatingFile) runMill() {
+	defer f.done.Done()
+	for {
+		select {
+		case <-f.millC:
+			f.mill()
+		case <-f.closeNotify:
+			return
+		}
+	}
+}
+
+func (f *RotatingFile) runReopenOnSignal() {
+	defer f.done.Done()
+	for {
+		select {
+		case <-f.signalC:
+			if err := f.Reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "logging: unable to reopen log file on SIGHUP: %v\n", err)
+			}
+		case <-f.closeNotify:
+			return
+		}
+	}
+}
+
+// backupFile is a rotated file found by mill.
+type backupFile struct {
+	path       string
+	rotated    time.Time
+	compressed bool
+}
+
+// mill removes rotated files past MaxBackups or MaxAge and compresses the
+// rest, if Compress is set. It runs only on the mill goroutine. Failures
+// are reported on os.Stderr, bypassing slog since this file may be where
+// slog writes, and don't stop the other files being handled.
+func (f *RotatingFile) mill() {
+	backups, err := f.listBackups()
+	if err != nil {
+		reportMillError(err)
+		return
+	}
+	// newest first, so the ones past MaxBackups are at the end
+	slices.SortFunc(backups, func(a, b backupFile) int {
+		return b.rotated.Compare(a.rotated)
+	})
+
+	now := f.clock.Now()
+	for i, backup := range backups {
+		expired := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		expired = expired || (f.opts.MaxAge > 0 && now.Sub(backup.rotated) > f.opts.MaxAge)
+		if expired {
+			if err := os.Remove(backup.path); err != nil && !os.IsNotExist(err) {
+				reportMillError(err)
+			}
+		} else if f.opts.Compress && !backup.compressed {
+			if err := compressFile(backup.path); err != nil {
+				reportMillError(err)
+			}
+		}
+	}
+}
+
+func reportRotateError(err error) {
+	fmt.Fprintf(os.Stderr, "logging: unable to rotate log file: %v\n", err)
+}
+
+func reportMillError(err error) {
+	fmt.Fprintf(os.Stderr, "logging: unable to clean up rotated log files: %v\n", err)
+}
+
+// listBackups returns the rotated files next to Path, recognized by name.
+func (f *RotatingFile) listBackups() ([]backupFile, error) {
+	dir := filepath.Dir(f.opts.Path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list log directory %s", dir)
+	}
+
+	prefix, ext := f.backupNameParts()
+	var result []backupFile
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp, compressed := strings.CutSuffix(strings.TrimPrefix(name, prefix), ".gz")
+		stamp, ok := strings.CutSuffix(stamp, ext)
+		if !ok {
+			continue
+		}
+		rotated, err := time.Parse(backupTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		result = append(result, backupFile{
+			path:       filepath.Join(dir, name),
+			rotated:    rotated,
+			compressed: compressed,
+		})
+	}
+	return result, nil
+}
+
+// compressFile gzips path to path.gz and removes path. The gzip is written
+// under a temporary name first, so a partial one is never mistaken for a
+// rotated file.
+func compressFile(path string) (err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %s for compression", path)
+	}
+	defer func() { _ = in.Close() }()
+
+	tmpPath := path + ".gz.tmp"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create %s", tmpPath)
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err != nil {
+		return errors.Wrapf(err, "unable to compress %s", path)
+	}
+	if err = gz.Close(); err != nil {
+		return errors.Wrapf(err, "unable to compress %s", path)
+	}
+	if err = out.Close(); err != nil {
+		return errors.Wrapf(err, "unable to write %s", tmpPath)
+	}
+	if err = os.Rename(tmpPath, path+".gz"); err != nil {
+		return errors.Wrapf(err, "unable to rename %s", tmpPath)
+	}
+	_ = in.Close()
+	return os.Remove(path)
+}
+
+// FileHandler is a slog.Handler which writes records to a RotatingFile. It
+// is meant as the downstream of an AsyncHandler, whose drain goroutine
+// serializes calls to it; the file's own locking makes it safe without
+// that too. Close it after the AsyncHandler has drained.
+type FileHandler struct {
+	slog.Handler
+	file *RotatingFile
+}
+
+var _ slog.Handler = (*FileHandler)(nil)
+
+// NewFileHandler opens a RotatingFile with opts and returns a handler
+// formatting records onto it with opts.NewHandler.
+func NewFileHandler(opts FileOptions) (*FileHandler, error) {
+	file, err := NewRotatingFile(opts)
+	if err != nil {
+		return nil, err
+	}
+	newHandler := opts.NewHandler
+	if newHandler == nil {
+		newHandler = func(w io.Writer) slog.Handler {
+			return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: LevelTrace})
+		}
+	}
+	return &FileHandler{Handler: newHandler(file), file: file}, nil
+}
+
+// File returns the underlying RotatingFile, for rotating or reopening it
+// directly.
+func (h *FileHandler) File() *RotatingFile {
+	return h.file
+}
+
+// Close closes the underlying file.
+func (h *FileHandler) Close() error {
+	return h.file.Close()
+}
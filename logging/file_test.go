@@ -0,0 +1,318 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/stretchr/testify/require"
+)
+
+var fileTestStart = time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+// newTestRotatingFile opens a RotatingFile at router.log in a temp dir,
+// with a fake clock, closing it when the test ends.
+func newTestRotatingFile(t *testing.T, opts FileOptions) (*RotatingFile, *clockz.FakeClock) {
+	t.Helper()
+	clock := clockz.NewFakeClock(fileTestStart)
+	if opts.Path == "" {
+		opts.Path = filepath.Join(t.TempDir(), "router.log")
+	}
+	opts.Clock = clock
+	f, err := NewRotatingFile(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+	return f, clock
+}
+
+// backupNames returns the sorted names of the rotated files next to f.
+func backupNames(t *testing.T, f *RotatingFile) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(f.opts.Path))
+	require.NoError(t, err)
+	var result []string
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(f.opts.Path) {
+			result = append(result, entry.Name())
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func writeString(t *testing.T, f *RotatingFile, s string) {
+	t.Helper()
+	_, err := f.Write([]byte(s))
+	require.NoError(t, err)
+}
+
+func TestFileOptionsValidate(t *testing.T) {
+	require.NoError(t, FileOptions{Path: "x.log"}.Validate())
+	require.Error(t, FileOptions{}.Validate())
+	require.Error(t, FileOptions{Path: "x.log", MaxSize: -1}.Validate())
+	require.Error(t, FileOptions{Path: "x.log", RotateEvery: -1}.Validate())
+	require.Error(t, FileOptions{Path: "x.log", MaxBackups: -1}.Validate())
+	require.Error(t, FileOptions{Path: "x.log", MaxAge: -1}.Validate())
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	f, clock := newTestRotatingFile(t, FileOptions{MaxSize: 10})
+
+	writeString(t, f, "12345\n")
+	writeString(t, f, "123\n")
+	require.Empty(t, backupNames(t, f), "a write which fits exactly shouldn't rotate")
+
+	clock.Advance(time.Millisecond)
+	writeString(t, f, "abc\n")
+	require.Equal(t, []string{"router-20240102T150405.001.log"}, backupNames(t, f))
+	require.Equal(t, "12345\n123\n", readFile(t, filepath.Join(filepath.Dir(f.opts.Path), "router-20240102T150405.001.log")))
+	require.Equal(t, "abc\n", readFile(t, f.opts.Path))
+
+	// an oversized write still lands, in a file of its own
+	writeString(t, f, "0123456789abcdef\n")
+	require.Len(t, backupNames(t, f), 2, "a same-millisecond rotation should get a distinct name")
+	require.Equal(t, "0123456789abcdef\n", readFile(t, f.opts.Path))
+}
+
+func TestRotatingFileRotatesByTime(t *testing.T) {
+	f, clock := newTestRotatingFile(t, FileOptions{RotateEvery: time.Hour})
+
+	writeString(t, f, "first\n")
+	clock.Advance(54 * time.Minute)
+	writeString(t, f, "second\n")
+	require.Empty(t, backupNames(t, f))
+
+	// 16:00 is the first hour boundary after the 15:04 start
+	clock.Advance(2 * time.Minute)
+	writeString(t, f, "third\n")
+	require.Equal(t, []string{"router-20240102T160005.000.log"}, backupNames(t, f))
+	require.Equal(t, "third\n", readFile(t, f.opts.Path))
+
+	clock.Advance(time.Minute)
+	require.NoError(t, f.Rotate())
+	require.NoError(t, f.Rotate())
+	require.Len(t, backupNames(t, f), 2, "rotating an empty file should do nothing")
+}
+
+func TestRotatingFileRetention(t *testing.T) {
+	t.Run("keeps MaxBackups files", func(t *testing.T) {
+		f, clock := newTestRotatingFile(t, FileOptions{MaxBackups: 2})
+		for i := 0; i < 5; i++ {
+			writeString(t, f, "record\n")
+			clock.Advance(time.Second)
+			require.NoError(t, f.Rotate())
+		}
+		require.Eventually(t, func() bool {
+			return len(backupNames(t, f)) == 2
+		}, time.Second, time.Millisecond)
+		require.Equal(t, []string{"router-20240102T150409.000.log", "router-20240102T150410.000.log"}, backupNames(t, f))
+	})
+
+	t.Run("removes files past MaxAge", func(t *testing.T) {
+		f, clock := newTestRotatingFile(t, FileOptions{MaxAge: time.Hour})
+		writeString(t, f, "old\n")
+		require.NoError(t, f.Rotate())
+		clock.Advance(30 * time.Minute)
+		writeString(t, f, "newer\n")
+		require.NoError(t, f.Rotate())
+
+		clock.Advance(45 * time.Minute)
+		writeString(t, f, "newest\n")
+		require.NoError(t, f.Rotate())
+		require.Eventually(t, func() bool {
+			names := backupNames(t, f)
+			return len(names) == 2 && names[0] == "router-20240102T153405.000.log"
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("prunes files left by an earlier run", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, name := range []string{"router-20240101T000000.000.log", "router-20240101T010000.000.log.gz", "router-junk.log", "other.log"} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644))
+		}
+		f, _ := newTestRotatingFile(t, FileOptions{Path: filepath.Join(dir, "router.log"), MaxBackups: 1})
+		require.Eventually(t, func() bool {
+			return len(backupNames(t, f)) == 3
+		}, time.Second, time.Millisecond)
+		require.Equal(t, []string{"other.log", "router-20240101T010000.000.log.gz", "router-junk.log"}, backupNames(t, f))
+	})
+}
+
+func TestRotatingFileCompresses(t *testing.T) {
+	f, _ := newTestRotatingFile(t, FileOptions{Compress: true})
+	writeString(t, f, "compress me\n")
+	require.NoError(t, f.Rotate())
+
+	name := "router-20240102T150405.000.log.gz"
+	require.Eventually(t, func() bool {
+		names := backupNames(t, f)
+		return len(names) == 1 && names[0] == name
+	}, time.Second, time.Millisecond)
+
+	in, err := os.Open(filepath.Join(filepath.Dir(f.opts.Path), name))
+	require.NoError(t, err)
+	defer func() { _ = in.Close() }()
+	gz, err := gzip.NewReader(in)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, "compress me\n", string(data))
+}
+
+// TestRotatingFileReopen simulates an external logrotate: the file is moved
+// aside, and writes only move to a new file at the path after Reopen.
+func TestRotatingFileReopen(t *testing.T) {
+	f, _ := newTestRotatingFile(t, FileOptions{})
+	writeString(t, f, "before\n")
+
+	moved := f.opts.Path + ".1"
+	require.NoError(t, os.Rename(f.opts.Path, moved))
+	writeString(t, f, "still old\n")
+
+	require.NoError(t, f.Reopen())
+	writeString(t, f, "after\n")
+	require.Equal(t, "before\nstill old\n", readFile(t, moved))
+	require.Equal(t, "after\n", readFile(t, f.opts.Path))
+
+	require.NoError(t, f.Close())
+	require.NoError(t, f.Close())
+	_, err := f.Write([]byte("closed\n"))
+	require.Error(t, err)
+	require.Error(t, f.Reopen())
+}
+
+// TestRotatingFileRecoversFromFailedClose closes the file out from under the
+// RotatingFile, so its own close fails, and checks that writes carry on to a
+// freshly opened file rather than the dead descriptor.
+func TestRotatingFileRecoversFromFailedClose(t *testing.T) {
+	t.Run("reopen", func(t *testing.T) {
+		f, _ := newTestRotatingFile(t, FileOptions{})
+		writeString(t, f, "before\n")
+
+		require.NoError(t, f.file.Close())
+		require.ErrorIs(t, f.Reopen(), os.ErrClosed)
+		writeString(t, f, "after\n")
+		require.Equal(t, "before\nafter\n", readFile(t, f.opts.Path))
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		f, _ := newTestRotatingFile(t, FileOptions{})
+		writeString(t, f, "before\n")
+
+		require.NoError(t, f.file.Close())
+		require.ErrorIs(t, f.Rotate(), os.ErrClosed)
+		writeString(t, f, "after\n")
+		require.Equal(t, []string{"router-20240102T150405.000.log"}, backupNames(t, f))
+		require.Equal(t, "after\n", readFile(t, f.opts.Path))
+	})
+}
+
+// TestRotatingFileKeepsRecordsWhenRotationFails checks a record which
+// triggers a failing rotation is still written, with the failure reported
+// rather than returned.
+func TestRotatingFileKeepsRecordsWhenRotationFails(t *testing.T) {
+	newFile := func(t *testing.T) (*RotatingFile, *[]error) {
+		f, _ := newTestRotatingFile(t, FileOptions{MaxSize: 10})
+		var reported []error
+		f.reportError = func(err error) { reported = append(reported, err) }
+		return f, &reported
+	}
+
+	t.Run("rename", func(t *testing.T) {
+		f, reported := newFile(t)
+		f.rename = func(string, string) error { return errors.New("rename failed") }
+
+		writeString(t, f, "12345\n")
+		writeString(t, f, "abcdef\n")
+		writeString(t, f, "ghijkl\n")
+		require.Len(t, *reported, 2, "each write past MaxSize retries the rotation")
+		require.Empty(t, backupNames(t, f))
+		require.Equal(t, "12345\nabcdef\nghijkl\n", readFile(t, f.opts.Path))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		f, reported := newFile(t)
+
+		writeString(t, f, "12345\n")
+		require.NoError(t, f.file.Close())
+		writeString(t, f, "abcdef\n")
+		require.Len(t, *reported, 1)
+		require.ErrorIs(t, (*reported)[0], os.ErrClosed)
+		require.Equal(t, []string{"router-20240102T150405.000.log"}, backupNames(t, f))
+		require.Equal(t, "abcdef\n", readFile(t, f.opts.Path))
+	})
+}
+
+func TestRotatingFileAppendsToExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "router.log")
+	f, _ := newTestRotatingFile(t, FileOptions{Path: path, MaxSize: 10})
+	writeString(t, f, "12345\n")
+	require.NoError(t, f.Close())
+
+	f, _ = newTestRotatingFile(t, FileOptions{Path: path, MaxSize: 10})
+	writeString(t, f, "abcdef\n")
+	require.Equal(t, "abcdef\n", readFile(t, path), "the size of the existing file should count toward MaxSize")
+	require.Len(t, backupNames(t, f), 1)
+}
+
+func TestFileHandlerBehindAsyncHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.log")
+	fh, err := NewFileHandler(FileOptions{Path: path, MaxSize: 1024})
+	require.NoError(t, err)
+
+	r, async := newTestRegistry(t, fh)
+	r.SetGlobalLevel(LevelTrace)
+	for i := 0; i < 50; i++ {
+		r.For("router.link").Log(t.Context(), LevelTrace, "linked", "i", i)
+	}
+	require.NoError(t, async.Close())
+	<-async.drainDone
+	require.NoError(t, fh.Close())
+
+	names := backupNames(t, fh.File())
+	require.NotEmpty(t, names, "50 records should have passed MaxSize")
+
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, strings.Split(strings.TrimSpace(readFile(t, filepath.Join(filepath.Dir(path), name))), "\n")...)
+	}
+	lines = append(lines, strings.Split(strings.TrimSpace(readFile(t, path)), "\n")...)
+	require.Len(t, lines, 50)
+
+	var first map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	require.Equal(t, "linked", first["msg"])
+	require.Equal(t, "router.link", first["channel"])
+	require.Equal(t, "DEBUG-4", first["level"])
+}
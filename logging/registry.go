@@ -37,13 +37,21 @@ import (
 // the bootstrap Registry created at init can be re-rooted by Install later
 // without orphaning any loggers.
 //
-// Reads (Enabled checks, For lookups in the cache) take RLock; mutations
+// Overrides apply hierarchically and may be glob patterns; see resolve.go
+// for the matching rules. Each namedHandler caches the LevelVar its name
+// resolves to, tagged with the registry's override generation, which is
+// bumped whenever an override is added or removed. The Enabled hot path is
+// then two atomic loads and a LevelVar read, and only re-resolves after
+// the set of overrides changes.
+//
+// Reads (For lookups in the cache, level resolution) take RLock; mutations
 // take the write lock. Level changes are operator actions and not a hot
 // path, so the lock cost on Set/Clear is fine.
 type Registry struct {
 	mu          sync.RWMutex
 	global      *slog.LevelVar
 	overrides   map[string]*slog.LevelVar
+	generation  atomic.Uint64
 	loggerCache map[string]*slog.Logger
 	root        atomic.Pointer[slog.Handler]
 }
@@ -76,19 +84,23 @@ func (r *Registry) GlobalLevel() slog.Level {
 	return r.global.Level()
 }
 
-// SetNamedLevel installs or updates a per-name override. The override is
-// held in a *slog.LevelVar created on first use for the name; subsequent
-// SetNamedLevel calls update the same LevelVar, so any Logger view of the
-// name sees the new level live.
+// SetNamedLevel installs or updates a per-name override. The name may be a
+// logger name, which also covers the loggers below it ("ziti.router" covers
+// "ziti.router.xgress"), or a glob pattern such as "ziti.*.xgress". The
+// override is held in a *slog.LevelVar created on first use for the name;
+// subsequent SetNamedLevel calls update the same LevelVar, so any Logger
+// view of the name sees the new level live.
 func (r *Registry) SetNamedLevel(name string, level slog.Level) {
 	r.mu.Lock()
 	lv, ok := r.overrides[name]
 	if !ok {
 		lv = new(slog.LevelVar)
 		r.overrides[name] = lv
+		r.generation.Add(1)
 	}
-	r.mu.Unlock()
+	// set before unlocking, so a new override is never seen at its zero level
 	lv.Set(level)
+	r.mu.Unlock()
 }
 
 // ClearNamedLevel removes the override for name. After clear, the name
@@ -98,7 +110,34 @@ func (r *Registry) SetNamedLevel(name string, level slog.Level) {
 func (r *Registry) ClearNamedLevel(name string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	delete(r.overrides, name)
+	if _, ok := r.overrides[name]; ok {
+		delete(r.overrides, name)
+		r.generation.Add(1)
+	}
+}
+
+// NamedLevel returns the level of the override set for name, which may be
+// a pattern, and whether there is one. Unlike EffectiveLevel, it doesn't
+// consider ancestors or patterns matching name.
+func (r *Registry) NamedLevel(name string) (slog.Level, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if lv, ok := r.overrides[name]; ok {
+		return lv.Level(), true
+	}
+	return 0, false
+}
+
+// NamedLevels returns a snapshot of the overrides, keyed by the name or
+// pattern they were set for.
+func (r *Registry) NamedLevels() map[string]slog.Level {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make(map[string]slog.Level, len(r.overrides))
+	for name, lv := range r.overrides {
+		result[name] = lv.Level()
+	}
+	return result
 }
 
 // For returns the *slog.Logger for a named scope, constructed on first use
@@ -122,7 +161,7 @@ func (r *Registry) For(name string) *slog.Logger {
 		return cached
 	}
 	nh := &namedHandler{registry: r, name: name}
-	h := nh.WithAttrs([]slog.Attr{slog.String("channel", name)})
+	h := nh.WithAttrs([]slog.Attr{slog.String(channelKey, name)})
 	logger := slog.New(h)
 	r.loggerCache[name] = logger
 	return logger
@@ -159,15 +198,38 @@ func (r *Registry) SetRoot(root slog.Handler) {
 	r.root.Store(&root)
 }
 
-// resolveLevel returns the effective level for name: the override's level
-// if one is set, otherwise the live global level.
-func (r *Registry) resolveLevel(name string) slog.Level {
+// EffectiveLevel returns the level currently applied to the logger name,
+// after hierarchical and pattern overrides are taken into account.
+func (r *Registry) EffectiveLevel(name string) slog.Level {
+	return r.resolveLevel(name).level.Level()
+}
+
+// levelResolution is the LevelVar a name resolved to, valid for as long as
+// the registry's override generation matches.
+type levelResolution struct {
+	generation uint64
+	level      *slog.LevelVar
+}
+
+// resolveLevel finds the LevelVar governing name: the most specific
+// matching override if there is one, otherwise the live global level.
+func (r *Registry) resolveLevel(name string) *levelResolution {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	result := &levelResolution{generation: r.generation.Load(), level: r.global}
 	if lv, ok := r.overrides[name]; ok {
-		return lv.Level()
+		result.level = lv
+		return result
 	}
-	return r.global.Level()
+	best, bestSpecificity := "", -1
+	for key, lv := range r.overrides {
+		specificity := overrideSpecificity(key, name)
+		if specificity >= 0 && moreSpecific(key, specificity, best, bestSpecificity) {
+			best, bestSpecificity = key, specificity
+			result.level = lv
+		}
+	}
+	return result
 }
 
 // namedHandler is the chain node that does per-name level gating and
@@ -176,12 +238,24 @@ func (r *Registry) resolveLevel(name string) slog.Level {
 type namedHandler struct {
 	registry *Registry
 	name     string
+	resolved atomic.Pointer[levelResolution]
 }
 
 var _ slog.Handler = (*namedHandler)(nil)
 
 func (h *namedHandler) Enabled(_ context.Context, level slog.Level) bool {
-	return level >= h.registry.resolveLevel(h.name)
+	return level >= h.levelVar().Level()
+}
+
+// levelVar returns the LevelVar for the handler's name, re-resolving only
+// if overrides were added or removed since it was last resolved.
+func (h *namedHandler) levelVar() *slog.LevelVar {
+	resolved := h.resolved.Load()
+	if resolved == nil || resolved.generation != h.registry.generation.Load() {
+		resolved = h.registry.resolveLevel(h.name)
+		h.resolved.Store(resolved)
+	}
+	return resolved.level
 }
 
 func (h *namedHandler) Handle(ctx context.Context, r slog.Record) error {
@@ -270,3 +344,9 @@ func SetNamedLevel(name string, level slog.Level) {
 func ClearNamedLevel(name string) {
 	defaultRegistry.ClearNamedLevel(name)
 }
+
+// EffectiveLevel returns the level applied to the named logger on the
+// default Registry.
+func EffectiveLevel(name string) slog.Level {
+	return defaultRegistry.EffectiveLevel(name)
+}
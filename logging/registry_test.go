@@ -115,6 +115,73 @@ func TestRegistryClearNamedLevelRevertsToGlobal(t *testing.T) {
 	require.True(t, r.For("x").Enabled(context.Background(), slog.LevelDebug), "global change should reach the previously-overridden name")
 }
 
+// TestRegistryHierarchicalLevels confirms an override applies to the
+// loggers below it and that the most specific matching override wins.
+func TestRegistryHierarchicalLevels(t *testing.T) {
+	rec := &recordingHandler{}
+	r, async := newTestRegistry(t, rec)
+	defer func() { _ = async.Close(); <-async.drainDone }()
+
+	r.SetGlobalLevel(slog.LevelInfo)
+	r.SetNamedLevel("ziti.router", slog.LevelDebug)
+	r.SetNamedLevel("ziti.router.xgress", slog.LevelWarn)
+	r.SetNamedLevel("ziti.*.link", LevelTrace)
+	r.SetNamedLevel("ziti.router.link.*", slog.LevelError)
+
+	require.Equal(t, slog.LevelDebug, r.EffectiveLevel("ziti.router"))
+	require.Equal(t, slog.LevelDebug, r.EffectiveLevel("ziti.router/handlers"))
+	require.Equal(t, slog.LevelWarn, r.EffectiveLevel("ziti.router.xgress"))
+	require.Equal(t, slog.LevelWarn, r.EffectiveLevel("ziti.router.xgress/dialer"))
+	require.Equal(t, LevelTrace, r.EffectiveLevel("ziti.controller.link"))
+	require.Equal(t, slog.LevelDebug, r.EffectiveLevel("ziti.router.link"), "the ancestor has more literal characters than the pattern")
+	require.Equal(t, slog.LevelError, r.EffectiveLevel("ziti.router.link.dial"))
+	require.Equal(t, slog.LevelInfo, r.EffectiveLevel("ziti.routerx"), "overrides only cover whole name segments")
+	require.Equal(t, slog.LevelInfo, r.EffectiveLevel("ziti"))
+
+	r.For("ziti.router.forwarder").Debug("forwarder-debug")
+	r.For("ziti.router.xgress.edge").Info("xgress-info-dropped")
+	r.For("ziti.controller").Debug("controller-debug-dropped")
+
+	require.NoError(t, async.Close())
+	<-async.drainDone
+
+	var msgs []string
+	for _, r := range rec.snapshot() {
+		msgs = append(msgs, r.Message)
+	}
+	require.Equal(t, []string{"forwarder-debug"}, msgs)
+}
+
+// TestRegistryResolvedLevelsTrackOverrideChanges proves an existing logger
+// re-resolves when overrides are added or removed, after having cached its
+// resolved level.
+func TestRegistryResolvedLevelsTrackOverrideChanges(t *testing.T) {
+	rec := &recordingHandler{}
+	r, async := newTestRegistry(t, rec)
+	defer func() { _ = async.Close(); <-async.drainDone }()
+
+	r.SetGlobalLevel(slog.LevelInfo)
+	logger := r.For("ziti.router.xgress")
+	require.False(t, logger.Enabled(context.Background(), slog.LevelDebug))
+
+	r.SetNamedLevel("ziti", slog.LevelDebug)
+	require.True(t, logger.Enabled(context.Background(), slog.LevelDebug), "a new ancestor override should apply")
+
+	r.SetNamedLevel("ziti.router", slog.LevelWarn)
+	require.False(t, logger.Enabled(context.Background(), slog.LevelInfo), "a nearer ancestor should take over")
+
+	r.SetNamedLevel("ziti.router", slog.LevelDebug)
+	require.True(t, logger.Enabled(context.Background(), slog.LevelDebug), "updating an override should apply live")
+
+	r.ClearNamedLevel("ziti.router")
+	r.SetNamedLevel("ziti", slog.LevelError)
+	require.False(t, logger.Enabled(context.Background(), slog.LevelWarn), "clearing should fall back to the next ancestor")
+
+	r.ClearNamedLevel("ziti")
+	r.SetGlobalLevel(slog.LevelDebug)
+	require.True(t, logger.Enabled(context.Background(), slog.LevelDebug), "with no overrides left, the global applies")
+}
+
 // TestRegistryLevelChangesAffectExistingLoggers proves a Logger created
 // before a level change reflects the new level on its next Enabled check.
 func TestRegistryLevelChangesAffectExistingLoggers(t *testing.T) {
@@ -279,6 +346,7 @@ func resetDefaultForTest() {
 	defaultRegistry.mu.Lock()
 	defaultRegistry.overrides = map[string]*slog.LevelVar{}
 	defaultRegistry.loggerCache = map[string]*slog.Logger{}
+	defaultRegistry.generation.Add(1)
 	defaultRegistry.mu.Unlock()
 	defaultRegistry.SetRoot(discardHandler{})
 	defaultRegistry.global.Set(slog.LevelInfo)
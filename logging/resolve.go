@@ -0,0 +1,109 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"strings"
+)
+
+// Level override keys are matched against logger names in one of two ways:
+//
+//   - A plain key applies to the logger of the same name and to every
+//     logger below it in the hierarchy, where '.' and '/' both separate
+//     levels. "ziti.router" covers "ziti.router.xgress" and
+//     "ziti.router/link", but not "ziti.routerx".
+//   - A key containing '*' or '?' is a glob pattern. '*' matches any run of
+//     characters, separators included, and '?' matches exactly one. The
+//     pattern must match the whole name: "ziti.*.xgress" covers
+//     "ziti.router.xgress" but not "ziti.router.xgress.dial".
+//
+// When several keys match a name, the most specific wins. Specificity is
+// the number of literal (non-wildcard) characters in the key, so an exact
+// name beats its ancestors, a nearer ancestor beats a farther one, and
+// "ziti.router.*" beats "ziti.*". A plain key beats a pattern of equal
+// specificity.
+
+// isLevelPattern reports whether an override key is a glob pattern rather
+// than a plain name.
+func isLevelPattern(key string) bool {
+	return strings.ContainsAny(key, "*?")
+}
+
+// isNameSeparator reports whether c separates levels of a logger name.
+func isNameSeparator(c byte) bool {
+	return c == '.' || c == '/'
+}
+
+// overrideSpecificity returns how specifically key matches name, or -1 if
+// it doesn't match at all.
+func overrideSpecificity(key, name string) int {
+	if isLevelPattern(key) {
+		if !globMatch(key, name) {
+			return -1
+		}
+		return len(key) - strings.Count(key, "*") - strings.Count(key, "?")
+	}
+	if !strings.HasPrefix(name, key) {
+		return -1
+	}
+	if len(name) > len(key) && !isNameSeparator(name[len(key)]) {
+		return -1
+	}
+	return len(key)
+}
+
+// moreSpecific reports whether override key, matching with the given
+// specificity, should win over the current best match.
+func moreSpecific(key string, specificity int, best string, bestSpecificity int) bool {
+	if specificity != bestSpecificity {
+		return specificity > bestSpecificity
+	}
+	keyIsPattern, bestIsPattern := isLevelPattern(key), isLevelPattern(best)
+	if keyIsPattern != bestIsPattern {
+		return !keyIsPattern
+	}
+	// equally specific patterns are ordered by key so the winner doesn't
+	// depend on map iteration order
+	return key < best
+}
+
+// globMatch reports whether name matches the whole of pattern, where '*'
+// matches any run of characters and '?' matches a single character.
+func globMatch(pattern, name string) bool {
+	p, n := 0, 0
+	starP, starN := -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starN = p, n
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case starP >= 0:
+			// let the last '*' swallow one more character and retry
+			starN++
+			p, n = starP+1, starN
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,60 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "ziti.router", true},
+		{"ziti.*", "ziti.router.xgress", true},
+		{"ziti.*", "ziti", false},
+		{"ziti.*.xgress", "ziti.router.xgress", true},
+		{"ziti.*.xgress", "ziti.router.xgress.dial", false},
+		{"*.xgress*", "ziti.router.xgress_edge", true},
+		{"ziti.rout?r", "ziti.router", true},
+		{"ziti.rout?r", "ziti.routr", false},
+		{"*a*b", "xaxbxab", true},
+		{"*a*b", "xaxbxa", false},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.match, globMatch(c.pattern, c.name), "pattern %q, name %q", c.pattern, c.name)
+	}
+}
+
+func TestOverrideSpecificity(t *testing.T) {
+	require.Equal(t, 11, overrideSpecificity("ziti.router", "ziti.router"))
+	require.Equal(t, 11, overrideSpecificity("ziti.router", "ziti.router.xgress"))
+	require.Equal(t, 11, overrideSpecificity("ziti.router", "ziti.router/xgress"))
+	require.Equal(t, -1, overrideSpecificity("ziti.router", "ziti.routerx"))
+	require.Equal(t, -1, overrideSpecificity("ziti.router", "ziti"))
+	require.Equal(t, 5, overrideSpecificity("ziti.*", "ziti.router"))
+	require.Equal(t, -1, overrideSpecificity("ziti.*", "edge.router"))
+
+	require.True(t, moreSpecific("ziti.router", 11, "ziti.route*", 10))
+	require.True(t, moreSpecific("ziti*.", 5, "ziti.*", 5), "equally specific patterns are ordered by key")
+	require.True(t, moreSpecific("ziti.", 5, "ziti.*", 5), "a plain key beats a pattern of equal specificity")
+}
@@ -0,0 +1,329 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/pkg/errors"
+)
+
+// Default SamplingOptions values.
+const (
+	DefaultSamplingInterval   = time.Second
+	DefaultSamplingFirst      = 100
+	DefaultSamplingThereafter = 100
+	DefaultSamplingExempt     = slog.LevelWarn
+	DefaultSamplingMaxKeys    = 10000
+)
+
+// SamplingOptions configures a SamplingHandler. Zero values are not valid;
+// use DefaultSamplingOptions as a starting point.
+type SamplingOptions struct {
+	// Interval is the window sampling counts are kept over. Each channel and
+	// message pair starts again from zero once its window has passed.
+	Interval time.Duration
+
+	// First is the number of records with the same channel and message
+	// passed on in each interval before sampling starts.
+	First int
+
+	// Thereafter passes on every Thereafter-th record after the first First
+	// in an interval. Zero drops every record past First.
+	Thereafter int
+
+	// ExemptThreshold is the lowest level which bypasses sampling, so
+	// warnings and errors are never thinned out with the defaults.
+	ExemptThreshold slog.Level
+
+	// SummaryInterval is the cadence at which a summary record is emitted
+	// for each channel and message pair that had records suppressed.
+	SummaryInterval time.Duration
+
+	// MaxKeys caps the number of channel and message pairs counted at once,
+	// so messages with unbounded variety can't grow the counts without
+	// limit. Records for new pairs past the cap share a single overflow
+	// count, sampled and summarized like any other pair.
+	MaxKeys int
+
+	// Clock is used for sampling windows and the summary cadence. It
+	// defaults to the real clock.
+	Clock clockz.Clock
+}
+
+// DefaultSamplingOptions returns SamplingOptions passing the first 100
+// records per channel and message each second and 1 in 100 after that,
+// with warnings and above exempt, counting up to 10000 pairs.
+func DefaultSamplingOptions() SamplingOptions {
+	return SamplingOptions{
+		Interval:        DefaultSamplingInterval,
+		First:           DefaultSamplingFirst,
+		Thereafter:      DefaultSamplingThereafter,
+		ExemptThreshold: DefaultSamplingExempt,
+		SummaryInterval: DefaultSummaryInterval,
+		MaxKeys:         DefaultSamplingMaxKeys,
+	}
+}
+
+// Validate returns an error if any field is outside its valid range.
+func (o SamplingOptions) Validate() error {
+	if o.Interval <= 0 {
+		return errors.Errorf("Interval must be > 0, got %v", o.Interval)
+	}
+	if o.First < 0 {
+		return errors.Errorf("First must be >= 0, got %d", o.First)
+	}
+	if o.Thereafter < 0 {
+		return errors.Errorf("Thereafter must be >= 0, got %d", o.Thereafter)
+	}
+	if o.ExemptThreshold < LevelTrace || o.ExemptThreshold > LevelPanic {
+		return errors.Errorf("ExemptThreshold %v is outside the canonical level range (%v..%v)", o.ExemptThreshold, LevelTrace, LevelPanic)
+	}
+	if o.SummaryInterval <= 0 {
+		return errors.Errorf("SummaryInterval must be > 0, got %v", o.SummaryInterval)
+	}
+	if o.MaxKeys <= 0 {
+		return errors.Errorf("MaxKeys must be > 0, got %d", o.MaxKeys)
+	}
+	return nil
+}
+
+// SamplingHandler thins out repetitive records before they reach the next
+// handler. Records are keyed by channel plus message; in each interval the
+// first First records for a key pass, then 1 in Thereafter. Unlike
+// AsyncHandler's queue-full shedding, which drops whatever arrives while
+// the queue is saturated, this keeps a noisy message from crowding out the
+// rest in the first place.
+//
+// It is meant to sit between the Registry and an AsyncHandler, so sampling
+// happens before records are queued:
+//
+//	Registry -> SamplingHandler -> AsyncHandler -> downstream
+//
+// Handle is safe for concurrent use and takes no locks on the hot path.
+// The periodic summary is written to the next handler from the sampler's
+// own goroutine, so the next handler must be safe for concurrent use, as
+// AsyncHandler is.
+type SamplingHandler struct {
+	opts        SamplingOptions
+	next        slog.Handler
+	clock       clockz.Clock
+	counters    sync.Map // samplingKey -> *sampleCounter
+	keys        atomic.Int64
+	overflow    *sampleCounter
+	closeNotify chan struct{}
+	summaryDone chan struct{}
+	closed      atomic.Bool
+	// windowStart is the start of the current summary window. It is only
+	// accessed by the summary goroutine after the handler is constructed.
+	windowStart time.Time
+}
+
+var _ slog.Handler = (*SamplingHandler)(nil)
+
+type samplingKey struct {
+	channel string
+	message string
+}
+
+// sampleCounter tracks one key. The window reset and the count increment
+// aren't atomic together, so a record racing a reset may be counted in
+// either window; sampling is approximate by design.
+type sampleCounter struct {
+	windowStart atomic.Int64
+	count       atomic.Int64
+	suppressed  atomic.Int64
+}
+
+// NewSamplingHandler returns a SamplingHandler forwarding sampled records to
+// next. It validates opts and starts the summary goroutine, which Close
+// stops.
+func NewSamplingHandler(next slog.Handler, opts SamplingOptions) (*SamplingHandler, error) {
+	if next == nil {
+		return nil, errors.New("next handler must not be nil")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	h := &SamplingHandler{
+		opts:        opts,
+		next:        next,
+		clock:       clockz.OrReal(opts.Clock),
+		overflow:    &sampleCounter{},
+		closeNotify: make(chan struct{}),
+		summaryDone: make(chan struct{}),
+	}
+	h.windowStart = h.clock.Now()
+	h.overflow.windowStart.Store(h.windowStart.UnixNano())
+	go h.runSummary()
+	return h, nil
+}
+
+// Enabled defers to the next handler.
+func (h *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle forwards r if it is exempt by level or its key is within its
+// sampling allowance, and otherwise counts it toward the next summary.
+func (h *SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= h.opts.ExemptThreshold || h.sample(r) {
+		return h.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+// sample reports whether r should be passed on.
+func (h *SamplingHandler) sample(r slog.Record) bool {
+	key := samplingKey{channel: recordChannel(r), message: r.Message}
+	now := h.clock.Now().UnixNano()
+
+	var counter *sampleCounter
+	if val, ok := h.counters.Load(key); ok {
+		counter = val.(*sampleCounter)
+	} else {
+		counter = h.track(key, now)
+	}
+
+	start := counter.windowStart.Load()
+	if now-start >= int64(h.opts.Interval) && counter.windowStart.CompareAndSwap(start, now) {
+		counter.count.Store(0)
+	}
+
+	n := counter.count.Add(1) - int64(h.opts.First)
+	if n <= 0 || (h.opts.Thereafter > 0 && n%int64(h.opts.Thereafter) == 0) {
+		return true
+	}
+	counter.suppressed.Add(1)
+	return false
+}
+
+// track returns a new counter for key, or the shared overflow counter if
+// MaxKeys keys are already counted. Near the cap, racing keys may both be
+// sent to the overflow counter.
+func (h *SamplingHandler) track(key samplingKey, now int64) *sampleCounter {
+	if h.keys.Add(1) > int64(h.opts.MaxKeys) {
+		h.keys.Add(-1)
+		return h.overflow
+	}
+	counter := &sampleCounter{}
+	counter.windowStart.Store(now)
+	val, loaded := h.counters.LoadOrStore(key, counter)
+	if loaded {
+		h.keys.Add(-1)
+	}
+	return val.(*sampleCounter)
+}
+
+// WithAttrs returns a child handler that prepends the given attrs to every
+// record it sees before forwarding to the SamplingHandler, so a channel
+// bound with WithAttrs still keys the sampling.
+func (h *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return &boundHandler{parent: h, attrs: slices.Clone(attrs)}
+}
+
+// WithGroup returns a child handler that wraps every record's attrs in
+// slog.Group(name, ...) before forwarding.
+func (h *SamplingHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &groupedHandler{parent: h, name: name}
+}
+
+// Close stops the summary goroutine after it emits a final summary for
+// anything suppressed since the last one. Calling Close more than once is
+// a no-op.
+func (h *SamplingHandler) Close() error {
+	if !h.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	close(h.closeNotify)
+	<-h.summaryDone
+	return nil
+}
+
+func (h *SamplingHandler) runSummary() {
+	defer close(h.summaryDone)
+	timer := h.clock.NewTimer(h.opts.SummaryInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			h.emitSummaryIfAny()
+			timer.Reset(h.opts.SummaryInterval)
+		case <-h.closeNotify:
+			h.emitSummaryIfAny()
+			return
+		}
+	}
+}
+
+// emitSummaryIfAny snapshots and zeroes the suppressed counts, emitting one
+// summary record per key which had records suppressed. The record carries
+// the key's channel, so it is routed like the records it stands in for.
+// Keys idle for two intervals with nothing suppressed are forgotten, so
+// one-off messages don't accumulate. Records suppressed from the overflow
+// count get one summary of their own. Runs only from the summary goroutine.
+func (h *SamplingHandler) emitSummaryIfAny() {
+	now := h.clock.Now()
+	since := h.windowStart
+	h.windowStart = now
+
+	h.counters.Range(func(k, v any) bool {
+		key, counter := k.(samplingKey), v.(*sampleCounter)
+		suppressed := counter.suppressed.Swap(0)
+		if suppressed == 0 {
+			if now.UnixNano()-counter.windowStart.Load() >= 2*int64(h.opts.Interval) && h.counters.CompareAndDelete(k, v) {
+				h.keys.Add(-1)
+			}
+			return true
+		}
+
+		r := slog.NewRecord(now, slog.LevelWarn, "log sampling suppressed messages", 0)
+		if key.channel != "" {
+			r.AddAttrs(slog.String(channelKey, key.channel))
+		}
+		r.AddAttrs(
+			slog.String("message", key.message),
+			slog.Int64("suppressed", suppressed),
+			slog.Time("since", since),
+		)
+		_ = h.next.Handle(context.Background(), r)
+		return true
+	})
+
+	if suppressed := h.overflow.suppressed.Swap(0); suppressed > 0 {
+		r := slog.NewRecord(now, slog.LevelWarn, "log sampling suppressed messages past the key limit", 0)
+		r.AddAttrs(
+			slog.Int("max_keys", h.opts.MaxKeys),
+			slog.Int64("suppressed", suppressed),
+			slog.Time("since", since),
+		)
+		_ = h.next.Handle(context.Background(), r)
+	}
+}
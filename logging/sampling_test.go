@@ -0,0 +1,248 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSamplingHandler returns a SamplingHandler passing the first 2
+// records per key each second and 1 in 3 after that, on a fake clock, with
+// its summary timer already started.
+func newTestSamplingHandler(t *testing.T, next slog.Handler) (*SamplingHandler, *clockz.FakeClock) {
+	t.Helper()
+	clock := clockz.NewFakeClock(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	opts := DefaultSamplingOptions()
+	opts.First = 2
+	opts.Thereafter = 3
+	opts.SummaryInterval = 10 * time.Second
+	opts.Clock = clock
+	h, err := NewSamplingHandler(next, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = h.Close() })
+	require.NoError(t, clock.AwaitTimers(1, time.Second))
+	return h, clock
+}
+
+// attrsOf flattens a record's top-level attrs into a map.
+func attrsOf(r slog.Record) map[string]slog.Value {
+	result := map[string]slog.Value{}
+	r.Attrs(func(a slog.Attr) bool {
+		result[a.Key] = a.Value
+		return true
+	})
+	return result
+}
+
+func TestSamplingOptionsValidate(t *testing.T) {
+	require.NoError(t, DefaultSamplingOptions().Validate())
+
+	for name, mutate := range map[string]func(*SamplingOptions){
+		"interval":         func(o *SamplingOptions) { o.Interval = 0 },
+		"first":            func(o *SamplingOptions) { o.First = -1 },
+		"thereafter":       func(o *SamplingOptions) { o.Thereafter = -1 },
+		"exempt threshold": func(o *SamplingOptions) { o.ExemptThreshold = LevelPanic + 1 },
+		"summary interval": func(o *SamplingOptions) { o.SummaryInterval = 0 },
+		"max keys":         func(o *SamplingOptions) { o.MaxKeys = 0 },
+	} {
+		opts := DefaultSamplingOptions()
+		mutate(&opts)
+		require.Error(t, opts.Validate(), name)
+	}
+
+	_, err := NewSamplingHandler(nil, DefaultSamplingOptions())
+	require.Error(t, err)
+}
+
+func TestSamplingHandlerFirstThenEveryM(t *testing.T) {
+	rec := &recordingHandler{}
+	h, _ := newTestSamplingHandler(t, rec)
+	logger := slog.New(h).With(channelKey, "router")
+
+	for i := 1; i <= 11; i++ {
+		logger.Info("noisy", "i", i)
+	}
+
+	var passed []int64
+	for _, r := range rec.snapshot() {
+		passed = append(passed, attrsOf(r)["i"].Int64())
+	}
+	// the first 2, then every 3rd after them
+	require.Equal(t, []int64{1, 2, 5, 8, 11}, passed)
+}
+
+func TestSamplingHandlerKeysByChannelAndMessage(t *testing.T) {
+	rec := &recordingHandler{}
+	h, _ := newTestSamplingHandler(t, rec)
+	root := slog.New(h)
+
+	for i := 0; i < 3; i++ {
+		root.With(channelKey, "router").Info("a")
+		root.With(channelKey, "router").Info("b")
+		root.With(channelKey, "controller").Info("a")
+		root.Info("a")
+	}
+	require.Equal(t, 8, rec.count(), "each of the 4 keys should pass its first 2")
+}
+
+func TestSamplingHandlerCapsKeys(t *testing.T) {
+	rec := &recordingHandler{}
+	clock := clockz.NewFakeClock(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	opts := DefaultSamplingOptions()
+	opts.First = 2
+	opts.Thereafter = 3
+	opts.SummaryInterval = 10 * time.Second
+	opts.MaxKeys = 2
+	opts.Clock = clock
+	h, err := NewSamplingHandler(rec, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = h.Close() })
+	require.NoError(t, clock.AwaitTimers(1, time.Second))
+	logger := slog.New(h)
+
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 3; i++ {
+			logger.Info(msg)
+		}
+	}
+	require.Equal(t, int64(2), h.keys.Load())
+	require.Equal(t, 7, rec.count(), "a and b should pass their first 2, and c and d share one overflow count")
+
+	clock.Advance(10 * time.Second)
+	require.Eventually(t, func() bool { return rec.count() == 10 }, time.Second, time.Millisecond)
+	overflow := rec.snapshot()[9]
+	require.Equal(t, "log sampling suppressed messages past the key limit", overflow.Message)
+	require.Equal(t, int64(2), attrsOf(overflow)["max_keys"].Int64())
+	require.Equal(t, int64(3), attrsOf(overflow)["suppressed"].Int64())
+
+	// idle keys are forgotten, making room for new ones
+	require.NoError(t, clock.AwaitTimers(1, time.Second))
+	clock.Advance(10 * time.Second)
+	require.Eventually(t, func() bool { return h.keys.Load() == 0 }, time.Second, time.Millisecond)
+	logger.Info("e")
+	require.Equal(t, int64(1), h.keys.Load())
+}
+
+func TestSamplingHandlerWindowResets(t *testing.T) {
+	rec := &recordingHandler{}
+	h, clock := newTestSamplingHandler(t, rec)
+	logger := slog.New(h)
+
+	for i := 0; i < 4; i++ {
+		logger.Info("noisy")
+	}
+	require.Equal(t, 2, rec.count())
+
+	clock.Advance(DefaultSamplingInterval)
+	for i := 0; i < 4; i++ {
+		logger.Info("noisy")
+	}
+	require.Equal(t, 4, rec.count(), "a new interval should pass the first 2 again")
+}
+
+func TestSamplingHandlerExemptsHighLevels(t *testing.T) {
+	rec := &recordingHandler{}
+	h, _ := newTestSamplingHandler(t, rec)
+	logger := slog.New(h)
+
+	for i := 0; i < 10; i++ {
+		logger.Warn("noisy")
+	}
+	require.Equal(t, 10, rec.count())
+}
+
+func TestSamplingHandlerSummarizesSuppressed(t *testing.T) {
+	rec := &recordingHandler{}
+	h, clock := newTestSamplingHandler(t, rec)
+	logger := slog.New(h).With(channelKey, "router.link")
+
+	for i := 0; i < 10; i++ {
+		logger.Info("noisy")
+	}
+	require.Equal(t, 4, rec.count(), "records 1, 2, 5 and 8 should pass")
+
+	clock.Advance(10 * time.Second)
+	require.Eventually(t, func() bool { return rec.count() == 5 }, time.Second, time.Millisecond)
+
+	summary := rec.snapshot()[4]
+	require.Equal(t, slog.LevelWarn, summary.Level)
+	require.Equal(t, "log sampling suppressed messages", summary.Message)
+	attrs := attrsOf(summary)
+	require.Equal(t, "router.link", attrs[channelKey].String())
+	require.Equal(t, "noisy", attrs["message"].String())
+	require.Equal(t, int64(6), attrs["suppressed"].Int64())
+	require.Equal(t, clock.Now().Add(-10*time.Second), attrs["since"].Time())
+
+	// nothing further suppressed, so the next summary is skipped
+	require.NoError(t, clock.AwaitTimers(1, time.Second))
+	clock.Advance(10 * time.Second)
+	require.NoError(t, clock.AwaitTimers(1, time.Second))
+	require.Equal(t, 5, rec.count())
+}
+
+func TestSamplingHandlerCloseEmitsFinalSummary(t *testing.T) {
+	rec := &recordingHandler{}
+	h, _ := newTestSamplingHandler(t, rec)
+	logger := slog.New(h)
+
+	for i := 0; i < 4; i++ {
+		logger.Info("noisy")
+	}
+	require.NoError(t, h.Close())
+	require.NoError(t, h.Close())
+
+	recs := rec.snapshot()
+	require.Len(t, recs, 3)
+	require.Equal(t, int64(2), attrsOf(recs[2])["suppressed"].Int64())
+	_, hasChannel := attrsOf(recs[2])[channelKey]
+	require.False(t, hasChannel, "records without a channel are summarized without one")
+}
+
+// TestSamplingHandlerInRegistryChain places the sampler between a Registry
+// and an AsyncHandler, the intended position, to confirm the channel bound
+// by For keys the sampling.
+func TestSamplingHandlerInRegistryChain(t *testing.T) {
+	rec := &recordingHandler{}
+	async, err := NewAsyncHandler(rec, DefaultOptions())
+	require.NoError(t, err)
+	h, _ := newTestSamplingHandler(t, async)
+	r := NewRegistry(h)
+
+	for i := 0; i < 5; i++ {
+		r.For("router").Info("noisy")
+		r.For("controller").Info("noisy")
+	}
+	require.NoError(t, h.Close())
+	require.NoError(t, async.Close())
+	<-async.drainDone
+
+	counts := map[string]int{}
+	for _, rec := range rec.snapshot() {
+		counts[attrsOf(rec)[channelKey].String()+"/"+rec.Message]++
+	}
+	require.Equal(t, map[string]int{
+		"router/noisy":     3,
+		"controller/noisy": 3,
+		"router/log sampling suppressed messages":     1,
+		"controller/log sampling suppressed messages": 1,
+	}, counts)
+}
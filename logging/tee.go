@@ -0,0 +1,225 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// channelKey is the attr For binds the logger name to.
+const channelKey = "channel"
+
+// Sink is one downstream of a TeeHandler, with the filters deciding which
+// records reach it.
+type Sink struct {
+	// Name identifies the sink in error messages and ErrorCounts. It
+	// defaults to "sink-<index>".
+	Name string
+
+	// Handler receives the records which pass the sink's filters.
+	Handler slog.Handler
+
+	// Level is the minimum level the sink receives. Nil passes every level.
+	Level slog.Leveler
+
+	// Channels, if set, limits the sink to records whose channel matches
+	// one of them. Entries match like level overrides do: "ziti.router"
+	// also covers "ziti.router.xgress", and "ziti.*.link" is a glob.
+	Channels []string
+
+	// ExcludeChannels drops records whose channel matches any entry,
+	// matched as for Channels. Exclusion wins over inclusion.
+	ExcludeChannels []string
+
+	// Filter, if set, is called last and drops the record if it returns
+	// false. It can select on any attribute of the record.
+	Filter func(ctx context.Context, r slog.Record) bool
+}
+
+// TeeHandler dispatches each record to several sinks, each with its own
+// level and filters, so one Registry root can feed a debug JSON file, an
+// info console and an error-only sink at once. Sinks are called in order
+// on the caller's goroutine; behind an AsyncHandler that is the drain
+// goroutine, which serializes the calls.
+//
+// A sink which returns an error or panics doesn't stop the record reaching
+// the sinks after it. Each failure is counted against the sink, and Handle
+// returns the first failure, so an AsyncHandler upstream counts it toward
+// drain_errors as well.
+type TeeHandler struct {
+	sinks  []Sink
+	errors []atomic.Int64
+}
+
+var _ slog.Handler = (*TeeHandler)(nil)
+
+// NewTeeHandler returns a TeeHandler over sinks. It returns an error if a
+// sink has no handler, or two sinks share a name.
+func NewTeeHandler(sinks ...Sink) (*TeeHandler, error) {
+	h := &TeeHandler{
+		sinks:  slices.Clone(sinks),
+		errors: make([]atomic.Int64, len(sinks)),
+	}
+	names := map[string]struct{}{}
+	for i := range h.sinks {
+		sink := &h.sinks[i]
+		if sink.Handler == nil {
+			return nil, errors.Errorf("sink %d has no handler", i)
+		}
+		if sink.Name == "" {
+			sink.Name = fmt.Sprintf("sink-%d", i)
+		}
+		if _, ok := names[sink.Name]; ok {
+			return nil, errors.Errorf("duplicate sink name %q", sink.Name)
+		}
+		names[sink.Name] = struct{}{}
+		for _, channel := range slices.Concat(sink.Channels, sink.ExcludeChannels) {
+			if channel == "" {
+				return nil, errors.Errorf("sink %q has an empty channel filter", sink.Name)
+			}
+		}
+	}
+	return h, nil
+}
+
+// Enabled reports whether any sink accepts level, and its handler is
+// enabled for it. Channel and attribute filters need the record, so they
+// are applied in Handle.
+func (h *TeeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for i := range h.sinks {
+		if h.sinks[i].levelEnabled(level) && h.sinks[i].Handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle passes r to every sink whose filters accept it.
+func (h *TeeHandler) Handle(ctx context.Context, r slog.Record) error {
+	channel, hasChannel := "", false
+	var firstErr error
+	for i := range h.sinks {
+		sink := &h.sinks[i]
+		if !sink.levelEnabled(r.Level) || !sink.Handler.Enabled(ctx, r.Level) {
+			continue
+		}
+		if len(sink.Channels) > 0 || len(sink.ExcludeChannels) > 0 {
+			if !hasChannel {
+				channel, hasChannel = recordChannel(r), true
+			}
+			if !sink.channelEnabled(channel) {
+				continue
+			}
+		}
+		if sink.Filter != nil && !sink.Filter(ctx, r) {
+			continue
+		}
+		if err := sink.handle(ctx, r); err != nil {
+			h.errors[i].Add(1)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// WithAttrs returns a child handler that prepends the given attrs to every
+// record before forwarding, so sink filters see bound attrs as part of the
+// record.
+func (h *TeeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return &boundHandler{parent: h, attrs: slices.Clone(attrs)}
+}
+
+// WithGroup returns a child handler that wraps every record's attrs in
+// slog.Group(name, ...) before forwarding.
+func (h *TeeHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &groupedHandler{parent: h, name: name}
+}
+
+// ErrorCounts returns the number of failed Handle calls per sink name,
+// since the handler was created.
+func (h *TeeHandler) ErrorCounts() map[string]int64 {
+	result := make(map[string]int64, len(h.sinks))
+	for i := range h.sinks {
+		result[h.sinks[i].Name] = h.errors[i].Load()
+	}
+	return result
+}
+
+func (s *Sink) levelEnabled(level slog.Level) bool {
+	return s.Level == nil || level >= s.Level.Level()
+}
+
+// channelEnabled applies the sink's channel filters. A record without a
+// channel only passes if the sink has no Channels to match.
+func (s *Sink) channelEnabled(channel string) bool {
+	for _, excluded := range s.ExcludeChannels {
+		if channel != "" && overrideSpecificity(excluded, channel) >= 0 {
+			return false
+		}
+	}
+	if len(s.Channels) == 0 {
+		return true
+	}
+	for _, included := range s.Channels {
+		if channel != "" && overrideSpecificity(included, channel) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// handle calls the sink's handler, turning a panic into an error so the
+// remaining sinks still get the record.
+func (s *Sink) handle(ctx context.Context, r slog.Record) (err error) {
+	defer func() {
+		if val := recover(); val != nil {
+			err = errors.Errorf("log sink %s panicked: %v", s.Name, val)
+		}
+	}()
+	if err = s.Handler.Handle(ctx, r.Clone()); err != nil {
+		return errors.Wrapf(err, "log sink %s failed", s.Name)
+	}
+	return nil
+}
+
+// recordChannel returns the value of the record's top-level channel attr,
+// or "" if it has none.
+func recordChannel(r slog.Record) string {
+	channel := ""
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == channelKey {
+			channel = a.Value.String()
+			return false
+		}
+		return true
+	})
+	return channel
+}
@@ -0,0 +1,182 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// panickingHandler panics from every Handle call.
+type panickingHandler struct{}
+
+func (panickingHandler) Enabled(context.Context, slog.Level) bool  { return true }
+func (panickingHandler) Handle(context.Context, slog.Record) error { panic("sink exploded") }
+func (h panickingHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h panickingHandler) WithGroup(string) slog.Handler           { return h }
+
+func messages(records []slog.Record) []string {
+	var result []string
+	for _, r := range records {
+		result = append(result, r.Message)
+	}
+	return result
+}
+
+func TestNewTeeHandlerValidates(t *testing.T) {
+	_, err := NewTeeHandler(Sink{})
+	require.Error(t, err, "a sink needs a handler")
+
+	_, err = NewTeeHandler(Sink{Name: "a", Handler: discardHandler{}}, Sink{Name: "a", Handler: discardHandler{}})
+	require.Error(t, err, "sink names must be unique")
+
+	_, err = NewTeeHandler(Sink{Handler: discardHandler{}, Channels: []string{""}})
+	require.Error(t, err)
+
+	h, err := NewTeeHandler(Sink{Handler: discardHandler{}}, Sink{Name: "named", Handler: discardHandler{}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"sink-0": 0, "named": 0}, h.ErrorCounts())
+}
+
+// TestTeeHandlerPerSinkLevels covers the motivating setup: a debug file,
+// an info console and an error-only sink fed from one Registry root.
+func TestTeeHandlerPerSinkLevels(t *testing.T) {
+	file, console, errs := &recordingHandler{}, &recordingHandler{}, &recordingHandler{}
+	tee, err := NewTeeHandler(
+		Sink{Name: "file", Handler: file, Level: slog.LevelDebug},
+		Sink{Name: "console", Handler: console, Level: slog.LevelInfo},
+		Sink{Name: "errors", Handler: errs, Level: slog.LevelError},
+	)
+	require.NoError(t, err)
+
+	r, async := newTestRegistry(t, tee)
+	r.SetGlobalLevel(LevelTrace)
+	logger := r.For("router")
+	logger.Log(context.Background(), LevelTrace, "trace")
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Error("error")
+
+	require.NoError(t, async.Close())
+	<-async.drainDone
+
+	require.Equal(t, []string{"debug", "info", "error"}, messages(file.snapshot()))
+	require.Equal(t, []string{"info", "error"}, messages(console.snapshot()))
+	require.Equal(t, []string{"error"}, messages(errs.snapshot()))
+
+	require.True(t, tee.Enabled(context.Background(), slog.LevelDebug))
+	require.False(t, tee.Enabled(context.Background(), LevelTrace), "no sink accepts trace")
+}
+
+func TestTeeHandlerLevelsAreLive(t *testing.T) {
+	rec := &recordingHandler{}
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelWarn)
+	tee, err := NewTeeHandler(Sink{Handler: rec, Level: level})
+	require.NoError(t, err)
+
+	require.NoError(t, tee.Handle(context.Background(), makeRecord(slog.LevelInfo, "dropped")))
+	level.Set(slog.LevelInfo)
+	require.NoError(t, tee.Handle(context.Background(), makeRecord(slog.LevelInfo, "kept")))
+	require.Equal(t, []string{"kept"}, messages(rec.snapshot()))
+}
+
+func TestTeeHandlerFilters(t *testing.T) {
+	router, notXgress, audited := &recordingHandler{}, &recordingHandler{}, &recordingHandler{}
+	tee, err := NewTeeHandler(
+		Sink{Name: "router", Handler: router, Channels: []string{"ziti.router", "*.link"}},
+		Sink{Name: "not-xgress", Handler: notXgress, ExcludeChannels: []string{"ziti.router.xgress"}},
+		Sink{Name: "audited", Handler: audited, Filter: func(_ context.Context, r slog.Record) bool {
+			audit := false
+			r.Attrs(func(a slog.Attr) bool {
+				audit = a.Key == "audit" && a.Value.Bool()
+				return !audit
+			})
+			return audit
+		}},
+	)
+	require.NoError(t, err)
+
+	r, async := newTestRegistry(t, tee)
+	r.For("ziti.router").Info("router")
+	r.For("ziti.router.xgress").Info("xgress", "audit", true)
+	r.For("ziti.controller.link").Info("link")
+	r.For("ziti.controller").With("audit", true).WithGroup("g").Info("controller", "k", "v")
+	require.NoError(t, tee.Handle(context.Background(), makeRecord(slog.LevelInfo, "no-channel")))
+
+	require.NoError(t, async.Close())
+	<-async.drainDone
+
+	require.ElementsMatch(t, []string{"router", "xgress", "link"}, messages(router.snapshot()))
+	require.ElementsMatch(t, []string{"router", "link", "controller", "no-channel"}, messages(notXgress.snapshot()))
+	require.ElementsMatch(t, []string{"xgress", "controller"}, messages(audited.snapshot()))
+}
+
+// TestTeeHandlerIsolatesFailingSinks proves an erroring or panicking sink
+// doesn't keep records from the sinks after it, and that each failure is
+// counted against its own sink.
+func TestTeeHandlerIsolatesFailingSinks(t *testing.T) {
+	rec := &recordingHandler{}
+	failing := &erroringHandler{err: errors.New("disk full")}
+	tee, err := NewTeeHandler(
+		Sink{Name: "failing", Handler: failing},
+		Sink{Name: "panicking", Handler: panickingHandler{}},
+		Sink{Name: "healthy", Handler: rec},
+	)
+	require.NoError(t, err)
+
+	async, err := NewAsyncHandler(tee, DefaultOptions())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, async.Handle(context.Background(), makeRecord(slog.LevelInfo, "x")))
+	}
+	require.Eventually(t, func() bool { return async.drainErrors.Load() == 3 }, time.Second, time.Millisecond,
+		"each record's failure should reach the async handler once")
+	require.Equal(t, 3, rec.count())
+	require.NoError(t, async.Close())
+	<-async.drainDone
+
+	counts := tee.ErrorCounts()
+	require.GreaterOrEqual(t, counts["failing"], int64(3))
+	require.Equal(t, counts["failing"], counts["panicking"])
+	require.Equal(t, int64(0), counts["healthy"])
+
+	err = tee.Handle(context.Background(), makeRecord(slog.LevelInfo, "x"))
+	require.ErrorIs(t, err, failing.err, "the first failure should be returned")
+	require.Contains(t, err.Error(), "failing")
+}
+
+func TestTeeHandlerFormatsPerSink(t *testing.T) {
+	jsonBuf, textBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	tee, err := NewTeeHandler(
+		Sink{Handler: slog.NewJSONHandler(jsonBuf, nil)},
+		Sink{Handler: slog.NewTextHandler(textBuf, nil)},
+	)
+	require.NoError(t, err)
+
+	slog.New(tee).With("k", "v").Info("hello")
+	require.True(t, strings.HasPrefix(jsonBuf.String(), "{"))
+	require.Contains(t, jsonBuf.String(), `"k":"v"`)
+	require.Contains(t, textBuf.String(), "msg=hello k=v")
+}
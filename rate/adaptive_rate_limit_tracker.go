@@ -0,0 +1,329 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxLabels is the number of labels an AdaptiveRateLimitTracker keeps separate stats for,
+	// if not configured
+	DefaultMaxLabels = 100
+
+	// OverflowLabel is the label which outcomes are counted under once an AdaptiveRateLimitTracker is
+	// tracking its maximum number of labels
+	OverflowLabel = "other"
+)
+
+// AdaptiveRateLimitTrackerConfig is used to configure a new AdaptiveRateLimitTracker
+type AdaptiveRateLimitTrackerConfig struct {
+	// The smallest the window may shrink to. Must be at least 1, so some work is always admitted and
+	// the window has a chance to grow again
+	MinWindow uint32
+	// The largest the window may grow to. The window starts at this size
+	MaxWindow uint32
+	// The number of successes required to grow the window by one. If zero, DefaultSuccessThreshold is used
+	SuccessThreshold uint32
+	// On backoff the window shrinks to the backed off operation's queue position multiplied by this factor.
+	// Must be between 0 and 1. If zero, DefaultShrinkFactor is used
+	ShrinkFactor float64
+	// How long work may be outstanding before it is marked as failed. Outstanding work is checked
+	// every half timeout, so work may be outstanding for up to one and a half times the timeout
+	Timeout time.Duration
+	// Provides a way to join shutdown of the tracker with other components. Once closed, new work
+	// is rejected with StoppedError and outstanding work is no longer expired. Required, as it also
+	// stops the goroutine which expires outstanding work
+	CloseNotify <-chan struct{}
+	// The maximum number of labels to keep separate stats for. Outcomes for labels first seen after
+	// that are counted under OverflowLabel. If zero, DefaultMaxLabels is used
+	MaxLabels uint32
+	// The clock used to expire outstanding work. If nil, the real clock is used
+	Clock clockz.Clock
+}
+
+func (self *AdaptiveRateLimitTrackerConfig) Validate() error {
+	if err := validateWindow(self.MinWindow, self.MaxWindow, self.ShrinkFactor); err != nil {
+		return err
+	}
+	if self.Timeout <= 0 {
+		return fmt.Errorf("timeout must be greater than 0, was %v", self.Timeout)
+	}
+	if self.CloseNotify == nil {
+		return fmt.Errorf("close notify must be provided")
+	}
+	return nil
+}
+
+// AdaptiveRateLimitTrackerStats is a point-in-time snapshot of an AdaptiveRateLimitTracker's state
+type AdaptiveRateLimitTrackerStats struct {
+	// The current number of operations which may be outstanding
+	WindowSize uint32
+	// The number of operations which have been admitted but not yet reported
+	Outstanding uint32
+	// Outcome counts, keyed by the label work was submitted with. Labels beyond the configured maximum
+	// are counted under OverflowLabel
+	Labels map[string]LabelStats
+}
+
+// LabelStats holds outcome counts for work submitted under a single label
+type LabelStats struct {
+	Successes uint64
+	Backoffs  uint64
+	Failures  uint64
+	// Timeouts counts work which was never reported and was marked as failed by the tracker
+	Timeouts uint64
+}
+
+// NewAdaptiveRateLimitTracker returns an AdaptiveRateLimitTracker which admits up to a window of
+// outstanding operations. The window shrinks on Backoff and grows back on Success, in the same way as
+// the AdaptiveRateLimiter returned by NewAdaptiveRateLimiter. Work which hasn't been reported within
+// the configured timeout is marked as failed. The returned tracker also implements
+// AdaptiveRateLimitTrackerInspector.
+func NewAdaptiveRateLimitTracker(config AdaptiveRateLimitTrackerConfig) (ContextAdaptiveRateLimitTracker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := &adaptiveRateLimitTracker{
+		adaptiveWindow:  newAdaptiveWindow(config.MinWindow, config.MaxWindow, config.SuccessThreshold, config.ShrinkFactor),
+		clock:           clockz.OrReal(config.Clock),
+		timeout:         config.Timeout,
+		outstandingWork: map[uint64]*adaptiveRateLimitTrackerWork{},
+		labelStats:      map[string]*LabelStats{},
+		maxLabels:       int(config.MaxLabels),
+		closeNotify:     config.CloseNotify,
+	}
+
+	if result.maxLabels == 0 {
+		result.maxLabels = DefaultMaxLabels
+	}
+
+	go result.run()
+
+	return result, nil
+}
+
+type adaptiveRateLimitTracker struct {
+	*adaptiveWindow
+	clock           clockz.Clock
+	timeout         time.Duration
+	nextId          uint64
+	workLock        sync.Mutex
+	outstandingWork map[uint64]*adaptiveRateLimitTrackerWork
+	labelStats      map[string]*LabelStats
+	maxLabels       int
+	closeNotify     <-chan struct{}
+}
+
+func (self *adaptiveRateLimitTracker) RunRateLimited(label string) (RateLimitControl, error) {
+	return self.RunRateLimitedCtx(context.Background(), label)
+}
+
+func (self *adaptiveRateLimitTracker) RunRateLimitedCtx(ctx context.Context, label string) (RateLimitControl, error) {
+	if isClosed(self.closeNotify) {
+		return NoOpRateLimitControl(), errors.Wrap(StoppedError, "cannot run")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return NoOpRateLimitControl(), errors.Wrap(err, "cannot run")
+	}
+
+	queuePosition, ok := self.tryEnqueue()
+	if !ok {
+		return NoOpRateLimitControl(), errorz.NewTooManyRequests()
+	}
+
+	self.workLock.Lock()
+	defer self.workLock.Unlock()
+
+	self.nextId++
+	work := &adaptiveRateLimitTrackerWork{
+		id:            self.nextId,
+		tracker:       self,
+		queuePosition: queuePosition,
+		createTime:    self.clock.Now(),
+		label:         label,
+	}
+	self.outstandingWork[work.id] = work
+
+	// if the context is done before the work is reported, mark it as failed so it doesn't hold
+	// its place in the window until it expires. Set under workLock, so complete sees it
+	if ctx.Done() != nil {
+		work.stopCancelNotify = context.AfterFunc(ctx, work.Failed)
+	}
+
+	return work, nil
+}
+
+func (self *adaptiveRateLimitTracker) RunRateLimitedF(label string, f func(control RateLimitControl) error) error {
+	return self.RunRateLimitedFCtx(context.Background(), label, func(_ context.Context, control RateLimitControl) error {
+		return f(control)
+	})
+}
+
+func (self *adaptiveRateLimitTracker) RunRateLimitedFCtx(ctx context.Context, label string, f func(ctx context.Context, control RateLimitControl) error) error {
+	ctrl, err := self.RunRateLimitedCtx(ctx, label)
+	if err != nil {
+		return err
+	}
+	return f(ctx, ctrl)
+}
+
+func (self *adaptiveRateLimitTracker) IsRateLimited() bool {
+	return self.isShrunk()
+}
+
+func (self *adaptiveRateLimitTracker) GetStats() AdaptiveRateLimitTrackerStats {
+	self.workLock.Lock()
+	defer self.workLock.Unlock()
+
+	result := AdaptiveRateLimitTrackerStats{
+		WindowSize:  self.GetWindowSize(),
+		Outstanding: uint32(len(self.outstandingWork)),
+		Labels:      make(map[string]LabelStats, len(self.labelStats)),
+	}
+
+	for label, stats := range self.labelStats {
+		result.Labels[label] = *stats
+	}
+
+	return result
+}
+
+// complete removes the work from the outstanding set, releases its place in the window and updates
+// the stats for its label. It returns false if the work was already completed.
+func (self *adaptiveRateLimitTracker) complete(work *adaptiveRateLimitTrackerWork, update func(stats *LabelStats)) bool {
+	self.workLock.Lock()
+	defer self.workLock.Unlock()
+
+	if _, found := self.outstandingWork[work.id]; !found {
+		return false
+	}
+
+	delete(self.outstandingWork, work.id)
+	self.release()
+
+	if work.stopCancelNotify != nil {
+		work.stopCancelNotify()
+	}
+
+	update(self.getLabelStatsLocked(work.label))
+
+	return true
+}
+
+// getLabelStatsLocked returns the stats for the given label, creating them if there's room. Once
+// maxLabels labels are tracked, new labels share the OverflowLabel stats, which don't count towards
+// the limit. The caller must hold workLock.
+func (self *adaptiveRateLimitTracker) getLabelStatsLocked(label string) *LabelStats {
+	if stats, found := self.labelStats[label]; found {
+		return stats
+	}
+
+	tracked := len(self.labelStats)
+	if _, found := self.labelStats[OverflowLabel]; found {
+		tracked--
+	}
+	if tracked >= self.maxLabels {
+		label = OverflowLabel
+		if stats, found := self.labelStats[label]; found {
+			return stats
+		}
+	}
+
+	stats := &LabelStats{}
+	self.labelStats[label] = stats
+	return stats
+}
+
+func (self *adaptiveRateLimitTracker) run() {
+	interval := self.timeout / 2
+	if interval <= 0 {
+		interval = self.timeout
+	}
+
+	timer := self.clock.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			self.expireOutstanding()
+			timer.Reset(interval)
+		case <-self.closeNotify:
+			return
+		}
+	}
+}
+
+func (self *adaptiveRateLimitTracker) expireOutstanding() {
+	self.workLock.Lock()
+	var expired []*adaptiveRateLimitTrackerWork
+	for _, work := range self.outstandingWork {
+		if self.clock.Since(work.createTime) > self.timeout {
+			expired = append(expired, work)
+		}
+	}
+	self.workLock.Unlock()
+
+	for _, work := range expired {
+		self.complete(work, func(stats *LabelStats) {
+			stats.Timeouts++
+		})
+	}
+}
+
+type adaptiveRateLimitTrackerWork struct {
+	id               uint64
+	tracker          *adaptiveRateLimitTracker
+	queuePosition    int32
+	createTime       time.Time
+	label            string
+	reported         atomic.Bool
+	stopCancelNotify func() bool
+}
+
+func (self *adaptiveRateLimitTrackerWork) Success() {
+	if self.reported.CompareAndSwap(false, true) {
+		if self.tracker.complete(self, func(stats *LabelStats) { stats.Successes++ }) {
+			self.tracker.success()
+		}
+	}
+}
+
+func (self *adaptiveRateLimitTrackerWork) Backoff() {
+	if self.reported.CompareAndSwap(false, true) {
+		if self.tracker.complete(self, func(stats *LabelStats) { stats.Backoffs++ }) {
+			self.tracker.backoff(self.queuePosition)
+		}
+	}
+}
+
+func (self *adaptiveRateLimitTrackerWork) Failed() {
+	if self.reported.CompareAndSwap(false, true) {
+		self.tracker.complete(self, func(stats *LabelStats) { stats.Failures++ })
+	}
+}
@@ -0,0 +1,225 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/clockz"
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveRateLimitTrackerConfigValidate(t *testing.T) {
+	req := require.New(t)
+	closeNotify := make(chan struct{})
+	req.Error((&AdaptiveRateLimitTrackerConfig{MinWindow: 1, MaxWindow: 10, CloseNotify: closeNotify}).Validate())
+	req.Error((&AdaptiveRateLimitTrackerConfig{MinWindow: 1, MaxWindow: 10, Timeout: time.Second}).Validate())
+	req.NoError((&AdaptiveRateLimitTrackerConfig{MinWindow: 1, MaxWindow: 10, Timeout: time.Second, CloseNotify: closeNotify}).Validate())
+}
+
+func TestAdaptiveRateLimitTracker(t *testing.T) {
+	t.Run("tracks outcomes per label", func(t *testing.T) {
+		req := require.New(t)
+		closeNotify := make(chan struct{})
+		defer close(closeNotify)
+
+		tracker, err := NewAdaptiveRateLimitTracker(AdaptiveRateLimitTrackerConfig{
+			MinWindow:   1,
+			MaxWindow:   10,
+			Timeout:     time.Minute,
+			CloseNotify: closeNotify,
+		})
+		req.NoError(err)
+		req.False(tracker.IsRateLimited())
+
+		for i := 0; i < 3; i++ {
+			ctrl, err := tracker.RunRateLimited("create")
+			req.NoError(err)
+			ctrl.Success()
+			ctrl.Failed() // later reports are ignored
+		}
+
+		req.NoError(tracker.RunRateLimitedF("delete", func(control RateLimitControl) error {
+			control.Failed()
+			return nil
+		}))
+
+		outstanding, err := tracker.RunRateLimited("update")
+		req.NoError(err)
+
+		stats := trackerStats(tracker)
+		req.Equal(uint32(10), stats.WindowSize)
+		req.Equal(uint32(1), stats.Outstanding)
+		req.Equal(LabelStats{Successes: 3}, stats.Labels["create"])
+		req.Equal(LabelStats{Failures: 1}, stats.Labels["delete"])
+
+		outstanding.Backoff()
+		stats = trackerStats(tracker)
+		req.Equal(uint32(0), stats.Outstanding)
+		req.Equal(LabelStats{Backoffs: 1}, stats.Labels["update"])
+		req.Equal(uint32(1), stats.WindowSize)
+		req.True(tracker.IsRateLimited())
+	})
+
+	t.Run("rejects work when the window is full", func(t *testing.T) {
+		req := require.New(t)
+		closeNotify := make(chan struct{})
+		defer close(closeNotify)
+
+		tracker, err := NewAdaptiveRateLimitTracker(AdaptiveRateLimitTrackerConfig{
+			MinWindow:   1,
+			MaxWindow:   2,
+			Timeout:     time.Minute,
+			CloseNotify: closeNotify,
+		})
+		req.NoError(err)
+
+		first, err := tracker.RunRateLimited("test")
+		req.NoError(err)
+		_, err = tracker.RunRateLimited("test")
+		req.NoError(err)
+
+		_, err = tracker.RunRateLimited("test")
+		var apiErr *errorz.ApiError
+		req.True(errors.As(err, &apiErr))
+
+		first.Success()
+		_, err = tracker.RunRateLimited("test")
+		req.NoError(err)
+	})
+
+	t.Run("expires outstanding work", func(t *testing.T) {
+		req := require.New(t)
+		closeNotify := make(chan struct{})
+		defer close(closeNotify)
+
+		clock := clockz.NewFakeClock(time.Now())
+		tracker, err := NewAdaptiveRateLimitTracker(AdaptiveRateLimitTrackerConfig{
+			MinWindow:   1,
+			MaxWindow:   1,
+			Timeout:     20 * time.Millisecond,
+			CloseNotify: closeNotify,
+			Clock:       clock,
+		})
+		req.NoError(err)
+
+		ctrl, err := tracker.RunRateLimited("hung")
+		req.NoError(err)
+
+		// the expiry check re-arms its timer once it's done, so waiting for the timer waits for the check
+		req.NoError(clock.AwaitTimers(1, time.Second))
+		clock.Advance(10 * time.Millisecond)
+		req.NoError(clock.AwaitTimers(1, time.Second))
+		req.Equal(uint32(1), trackerStats(tracker).Outstanding, "work shouldn't expire before the timeout")
+
+		clock.Advance(20 * time.Millisecond)
+		req.NoError(clock.AwaitTimers(1, time.Second))
+		req.Equal(uint32(0), trackerStats(tracker).Outstanding)
+		req.Equal(LabelStats{Timeouts: 1}, trackerStats(tracker).Labels["hung"])
+
+		// reporting after expiry doesn't count twice
+		ctrl.Success()
+		req.Equal(LabelStats{Timeouts: 1}, trackerStats(tracker).Labels["hung"])
+
+		_, err = tracker.RunRateLimited("hung")
+		req.NoError(err)
+	})
+
+	t.Run("counts labels over the limit under the overflow label", func(t *testing.T) {
+		req := require.New(t)
+		closeNotify := make(chan struct{})
+		defer close(closeNotify)
+
+		tracker, err := NewAdaptiveRateLimitTracker(AdaptiveRateLimitTrackerConfig{
+			MinWindow:   1,
+			MaxWindow:   10,
+			Timeout:     time.Minute,
+			CloseNotify: closeNotify,
+			MaxLabels:   2,
+		})
+		req.NoError(err)
+
+		for _, label := range []string{"a", "b", "c", "a", "d"} {
+			ctrl, err := tracker.RunRateLimited(label)
+			req.NoError(err)
+			ctrl.Success()
+		}
+
+		req.Equal(map[string]LabelStats{
+			"a":           {Successes: 2},
+			"b":           {Successes: 1},
+			OverflowLabel: {Successes: 2},
+		}, trackerStats(tracker).Labels)
+	})
+
+	t.Run("stops on close notify", func(t *testing.T) {
+		req := require.New(t)
+		closeNotify := make(chan struct{})
+		tracker, err := NewAdaptiveRateLimitTracker(AdaptiveRateLimitTrackerConfig{
+			MinWindow:   1,
+			MaxWindow:   1,
+			Timeout:     time.Minute,
+			CloseNotify: closeNotify,
+		})
+		req.NoError(err)
+		close(closeNotify)
+
+		_, err = tracker.RunRateLimited("test")
+		req.ErrorIs(err, StoppedError)
+	})
+
+	t.Run("fails outstanding work when its context is done", func(t *testing.T) {
+		req := require.New(t)
+		closeNotify := make(chan struct{})
+		defer close(closeNotify)
+
+		tracker, err := NewAdaptiveRateLimitTracker(AdaptiveRateLimitTrackerConfig{
+			MinWindow:   1,
+			MaxWindow:   1,
+			Timeout:     time.Minute,
+			CloseNotify: closeNotify,
+		})
+		req.NoError(err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err = tracker.RunRateLimitedCtx(ctx, "cancelled")
+		req.NoError(err)
+
+		cancel()
+		require.Eventually(t, func() bool {
+			return trackerStats(tracker).Outstanding == 0
+		}, time.Second, time.Millisecond)
+		req.Equal(LabelStats{Failures: 1}, trackerStats(tracker).Labels["cancelled"])
+
+		_, err = tracker.RunRateLimitedCtx(ctx, "cancelled")
+		req.ErrorIs(err, context.Canceled)
+
+		req.NoError(tracker.RunRateLimitedFCtx(context.Background(), "completed", func(ctx context.Context, control RateLimitControl) error {
+			control.Success()
+			return nil
+		}))
+		req.Equal(LabelStats{Successes: 1}, trackerStats(tracker).Labels["completed"])
+	})
+}
+
+func trackerStats(tracker ContextAdaptiveRateLimitTracker) AdaptiveRateLimitTrackerStats {
+	return tracker.(AdaptiveRateLimitTrackerInspector).GetStats()
+}
@@ -0,0 +1,271 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSuccessThreshold is the number of successes required to grow the window by one, if not configured
+	DefaultSuccessThreshold = 10
+
+	// DefaultShrinkFactor is the fraction of a backed off operation's queue position the window shrinks to,
+	// if not configured
+	DefaultShrinkFactor = 1.0
+)
+
+// AdaptiveRateLimiterConfig is used to configure a new AdaptiveRateLimiter
+type AdaptiveRateLimiterConfig struct {
+	// The smallest the window may shrink to. Must be at least 1, so some work is always admitted and
+	// the window has a chance to grow again
+	MinWindow uint32
+	// The largest the window may grow to. The window starts at this size
+	MaxWindow uint32
+	// The number of operations which may be running at the same time
+	MaxConcurrent uint32
+	// The number of successes required to grow the window by one. If zero, DefaultSuccessThreshold is used
+	SuccessThreshold uint32
+	// On backoff the window shrinks to the backed off operation's queue position multiplied by this factor.
+	// Must be between 0 and 1. If zero, DefaultShrinkFactor is used
+	ShrinkFactor float64
+	// Provides a way to join shutdown of the rate limiter with other components. Once closed, waiting
+	// and newly submitted operations return StoppedError
+	CloseNotify <-chan struct{}
+}
+
+func (self *AdaptiveRateLimiterConfig) Validate() error {
+	if err := validateWindow(self.MinWindow, self.MaxWindow, self.ShrinkFactor); err != nil {
+		return err
+	}
+	if self.MaxConcurrent < 1 {
+		return fmt.Errorf("max concurrent must be at least 1")
+	}
+	return nil
+}
+
+func validateWindow(minWindow, maxWindow uint32, shrinkFactor float64) error {
+	if minWindow < 1 {
+		return fmt.Errorf("min window must be at least 1")
+	}
+	if maxWindow > math.MaxInt32 {
+		return fmt.Errorf("max window must be less than or equal to %v", math.MaxInt32)
+	}
+	if minWindow > maxWindow {
+		return fmt.Errorf("min window must be less than or equal to max window. min window=%v, max window=%v", minWindow, maxWindow)
+	}
+	if shrinkFactor < 0 || shrinkFactor > 1 {
+		return fmt.Errorf("shrink factor must be between 0 and 1, was %v", shrinkFactor)
+	}
+	return nil
+}
+
+// NewAdaptiveRateLimiter returns an AdaptiveRateLimiter which runs at most MaxConcurrent operations at a
+// time on the calling goroutines. The number of operations admitted, running or waiting, is bounded by
+// a window which starts at MaxWindow, shrinks on Backoff and grows back on Success.
+func NewAdaptiveRateLimiter(config AdaptiveRateLimiterConfig) (ContextAdaptiveRateLimiter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &adaptiveRateLimiter{
+		adaptiveWindow: newAdaptiveWindow(config.MinWindow, config.MaxWindow, config.SuccessThreshold, config.ShrinkFactor),
+		slots:          make(chan struct{}, config.MaxConcurrent),
+		closeNotify:    config.CloseNotify,
+	}, nil
+}
+
+type adaptiveRateLimiter struct {
+	*adaptiveWindow
+	slots       chan struct{}
+	closeNotify <-chan struct{}
+}
+
+func (self *adaptiveRateLimiter) RunRateLimited(f func() error) (RateLimitControl, error) {
+	return self.RunRateLimitedCtx(context.Background(), func(context.Context) error {
+		return f()
+	})
+}
+
+func (self *adaptiveRateLimiter) RunRateLimitedCtx(ctx context.Context, f func(ctx context.Context) error) (RateLimitControl, error) {
+	if isClosed(self.closeNotify) {
+		return NoOpRateLimitControl(), errors.Wrap(StoppedError, "cannot run")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return NoOpRateLimitControl(), errors.Wrap(err, "cannot run")
+	}
+
+	queuePosition, ok := self.tryEnqueue()
+	if !ok {
+		return NoOpRateLimitControl(), errorz.NewTooManyRequests()
+	}
+	defer self.release()
+
+	select {
+	case self.slots <- struct{}{}:
+	case <-self.closeNotify:
+		return NoOpRateLimitControl(), errors.Wrap(StoppedError, "cannot run, rate limiter stopped while queued")
+	case <-ctx.Done():
+		return NoOpRateLimitControl(), errors.Wrap(ctx.Err(), "cannot run, context done while queued")
+	}
+
+	defer func() {
+		<-self.slots
+	}()
+
+	// if the window shrank while we were waiting, work queued beyond it is likely to time out
+	// before the results can be used, so reject it rather than running it
+	if queuePosition > self.currentWindow.Load() {
+		return NoOpRateLimitControl(), errorz.NewTooManyRequests()
+	}
+
+	return &adaptiveRateLimitControl{limiter: self, queuePosition: queuePosition}, f(ctx)
+}
+
+// adaptiveWindow tracks the number of admitted operations against a window which shrinks on backoff
+// and grows back towards the max as successes are reported. It is shared by the AdaptiveRateLimiter
+// and AdaptiveRateLimitTracker implementations.
+type adaptiveWindow struct {
+	minWindow        int32
+	maxWindow        int32
+	successThreshold uint32
+	shrinkFactor     float64
+	currentWindow    atomic.Int32
+	currentSize      atomic.Int32
+	lock             sync.Mutex
+	successCounter   uint32
+}
+
+func newAdaptiveWindow(minWindow, maxWindow, successThreshold uint32, shrinkFactor float64) *adaptiveWindow {
+	result := &adaptiveWindow{
+		minWindow:        int32(minWindow),
+		maxWindow:        int32(maxWindow),
+		successThreshold: successThreshold,
+		shrinkFactor:     shrinkFactor,
+	}
+
+	if result.successThreshold == 0 {
+		result.successThreshold = DefaultSuccessThreshold
+	}
+
+	if result.shrinkFactor == 0 {
+		result.shrinkFactor = DefaultShrinkFactor
+	}
+
+	result.currentWindow.Store(result.maxWindow)
+	return result
+}
+
+// GetWindowSize returns the current number of operations which may be admitted
+func (self *adaptiveWindow) GetWindowSize() uint32 {
+	return uint32(self.currentWindow.Load())
+}
+
+// GetQueueSize returns the current number of admitted operations which haven't yet been released
+func (self *adaptiveWindow) GetQueueSize() uint32 {
+	return uint32(self.currentSize.Load())
+}
+
+// isShrunk returns true if the window is currently smaller than the max window
+func (self *adaptiveWindow) isShrunk() bool {
+	return self.currentWindow.Load() < self.maxWindow
+}
+
+// tryEnqueue reserves a place in the window, returning the 1-based queue position of the reservation,
+// or false if the window is full
+func (self *adaptiveWindow) tryEnqueue() (int32, bool) {
+	for {
+		current := self.currentSize.Load()
+		if current >= self.currentWindow.Load() {
+			return 0, false
+		}
+		if self.currentSize.CompareAndSwap(current, current+1) {
+			return current + 1, true
+		}
+	}
+}
+
+// release returns a reservation made by tryEnqueue
+func (self *adaptiveWindow) release() {
+	self.currentSize.Add(-1)
+}
+
+func (self *adaptiveWindow) success() {
+	if self.currentWindow.Load() >= self.maxWindow {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.successCounter++
+	if self.successCounter >= self.successThreshold {
+		self.successCounter = 0
+		if self.currentWindow.Load() < self.maxWindow {
+			self.currentWindow.Add(1)
+		}
+	}
+}
+
+func (self *adaptiveWindow) backoff(queuePosition int32) {
+	if self.currentWindow.Load() <= self.minWindow {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	nextWindow := int32(float64(queuePosition) * self.shrinkFactor)
+	if nextWindow < self.minWindow {
+		nextWindow = self.minWindow
+	}
+
+	if nextWindow < self.currentWindow.Load() {
+		self.currentWindow.Store(nextWindow)
+		self.successCounter = 0
+	}
+}
+
+type adaptiveRateLimitControl struct {
+	limiter       *adaptiveRateLimiter
+	queuePosition int32
+	reported      atomic.Bool
+}
+
+func (self *adaptiveRateLimitControl) Success() {
+	if self.reported.CompareAndSwap(false, true) {
+		self.limiter.success()
+	}
+}
+
+func (self *adaptiveRateLimitControl) Backoff() {
+	if self.reported.CompareAndSwap(false, true) {
+		self.limiter.backoff(self.queuePosition)
+	}
+}
+
+func (self *adaptiveRateLimitControl) Failed() {
+	self.reported.Store(true)
+}
@@ -0,0 +1,188 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveRateLimiterConfigValidate(t *testing.T) {
+	req := require.New(t)
+	req.Error((&AdaptiveRateLimiterConfig{MinWindow: 0, MaxWindow: 10, MaxConcurrent: 1}).Validate())
+	req.Error((&AdaptiveRateLimiterConfig{MinWindow: 11, MaxWindow: 10, MaxConcurrent: 1}).Validate())
+	req.Error((&AdaptiveRateLimiterConfig{MinWindow: 1, MaxWindow: 10, MaxConcurrent: 0}).Validate())
+	req.Error((&AdaptiveRateLimiterConfig{MinWindow: 1, MaxWindow: 10, MaxConcurrent: 1, ShrinkFactor: 1.5}).Validate())
+	req.NoError((&AdaptiveRateLimiterConfig{MinWindow: 1, MaxWindow: 10, MaxConcurrent: 1}).Validate())
+}
+
+func TestAdaptiveRateLimiterWindow(t *testing.T) {
+	req := require.New(t)
+	val, err := NewAdaptiveRateLimiter(AdaptiveRateLimiterConfig{
+		MinWindow:        2,
+		MaxWindow:        20,
+		MaxConcurrent:    1,
+		SuccessThreshold: 2,
+	})
+	req.NoError(err)
+	limiter := val.(*adaptiveRateLimiter)
+	req.Equal(uint32(20), limiter.GetWindowSize())
+
+	t.Run("backoff shrinks the window to the queue position", func(t *testing.T) {
+		ctrl := &adaptiveRateLimitControl{limiter: limiter, queuePosition: 8}
+		ctrl.Backoff()
+		req.Equal(uint32(8), limiter.GetWindowSize())
+
+		// a second report on the same control is ignored
+		ctrl.Success()
+		ctrl.Success()
+		req.Equal(uint32(8), limiter.GetWindowSize())
+	})
+
+	t.Run("backoff never shrinks below the min window", func(t *testing.T) {
+		limiter.backoff(1)
+		req.Equal(uint32(2), limiter.GetWindowSize())
+	})
+
+	t.Run("successes grow the window back", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			ctrl, err := limiter.RunRateLimited(func() error { return nil })
+			req.NoError(err)
+			ctrl.Success()
+		}
+		req.Equal(uint32(4), limiter.GetWindowSize())
+
+		for i := 0; i < 100; i++ {
+			limiter.success()
+		}
+		req.Equal(uint32(20), limiter.GetWindowSize())
+	})
+
+	t.Run("failures leave the window unchanged", func(t *testing.T) {
+		ctrl, err := limiter.RunRateLimited(func() error { return nil })
+		req.NoError(err)
+		ctrl.Failed()
+		ctrl.Backoff()
+		req.Equal(uint32(20), limiter.GetWindowSize())
+	})
+}
+
+func TestAdaptiveRateLimiterRejectsQueuedWorkOutsideWindow(t *testing.T) {
+	req := require.New(t)
+	val, err := NewAdaptiveRateLimiter(AdaptiveRateLimiterConfig{
+		MinWindow:     1,
+		MaxWindow:     3,
+		MaxConcurrent: 1,
+	})
+	req.NoError(err)
+	limiter := val.(*adaptiveRateLimiter)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	type result struct {
+		ctrl RateLimitControl
+		err  error
+	}
+	first := make(chan result, 1)
+	go func() {
+		ctrl, err := limiter.RunRateLimited(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+		first <- result{ctrl, err}
+	}()
+	<-started
+
+	queued := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := limiter.RunRateLimited(func() error { return nil })
+			queued <- err
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return limiter.GetQueueSize() == 3
+	}, time.Second, time.Millisecond)
+
+	// window is full
+	_, err = limiter.RunRateLimited(func() error { return nil })
+	var apiErr *errorz.ApiError
+	req.True(errors.As(err, &apiErr))
+	req.Equal(http.StatusTooManyRequests, apiErr.Status)
+
+	// shrinking the window to 1 means both queued operations are now outside it
+	limiter.backoff(1)
+	close(release)
+
+	r := <-first
+	req.NoError(r.err)
+	for i := 0; i < 2; i++ {
+		err := <-queued
+		req.True(errors.As(err, &apiErr))
+	}
+	req.Equal(uint32(0), limiter.GetQueueSize())
+}
+
+func TestAdaptiveRateLimiterCtxDequeuesOnCancel(t *testing.T) {
+	req := require.New(t)
+	val, err := NewAdaptiveRateLimiter(AdaptiveRateLimiterConfig{
+		MinWindow:     1,
+		MaxWindow:     3,
+		MaxConcurrent: 1,
+	})
+	req.NoError(err)
+	limiter := val.(*adaptiveRateLimiter)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_, _ = limiter.RunRateLimited(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan error, 1)
+	go func() {
+		_, err := limiter.RunRateLimitedCtx(ctx, func(context.Context) error { return nil })
+		queued <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		return limiter.GetQueueSize() == 2
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	req.ErrorIs(<-queued, context.Canceled)
+	req.Equal(uint32(1), limiter.GetQueueSize())
+
+	close(release)
+	require.Eventually(t, func() bool {
+		return limiter.GetQueueSize() == 0
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,145 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/pkg/errors"
+)
+
+type strErr string
+
+func (s strErr) Error() string {
+	return string(s)
+}
+
+// StoppedError is returned for work submitted to, or still waiting in, a rate limiter which has been shut down
+const StoppedError = strErr("rate limiter shut down")
+
+// RateLimiterConfig is used to configure a new RateLimiter
+type RateLimiterConfig struct {
+	// The maximum number of operations which may be waiting for a free slot. Operations submitted
+	// while the queue is full are rejected with a too many requests ApiError
+	QueueSize uint32
+	// The number of operations which may be running at the same time
+	MaxConcurrent uint32
+	// Provides a way to join shutdown of the rate limiter with other components. Once closed, waiting
+	// and newly submitted operations return StoppedError
+	CloseNotify <-chan struct{}
+}
+
+func (self *RateLimiterConfig) Validate() error {
+	if self.QueueSize < 1 {
+		return fmt.Errorf("queue size must be at least 1")
+	}
+	if self.QueueSize > math.MaxInt32 {
+		return fmt.Errorf("queue size must be less than or equal to %v", math.MaxInt32)
+	}
+	if self.MaxConcurrent < 1 {
+		return fmt.Errorf("max concurrent must be at least 1")
+	}
+	return nil
+}
+
+// NewRateLimiter returns a RateLimiter which runs at most MaxConcurrent operations at a time on the
+// calling goroutines, with at most QueueSize further operations waiting for a slot.
+func NewRateLimiter(config RateLimiterConfig) (ContextRateLimiter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &rateLimiter{
+		queueSize:   int32(config.QueueSize),
+		slots:       make(chan struct{}, config.MaxConcurrent),
+		closeNotify: config.CloseNotify,
+	}, nil
+}
+
+type rateLimiter struct {
+	queueSize   int32
+	queued      atomic.Int32
+	slots       chan struct{}
+	closeNotify <-chan struct{}
+}
+
+func (self *rateLimiter) RunRateLimited(f func() error) error {
+	return self.RunRateLimitedCtx(context.Background(), func(context.Context) error {
+		return f()
+	})
+}
+
+func (self *rateLimiter) RunRateLimitedCtx(ctx context.Context, f func(ctx context.Context) error) error {
+	if isClosed(self.closeNotify) {
+		return errors.Wrap(StoppedError, "cannot run")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "cannot run")
+	}
+
+	if !self.tryEnqueue() {
+		return errorz.NewTooManyRequests()
+	}
+
+	select {
+	case self.slots <- struct{}{}:
+		self.queued.Add(-1)
+	case <-self.closeNotify:
+		self.queued.Add(-1)
+		return errors.Wrap(StoppedError, "cannot run, rate limiter stopped while queued")
+	case <-ctx.Done():
+		self.queued.Add(-1)
+		return errors.Wrap(ctx.Err(), "cannot run, context done while queued")
+	}
+
+	defer func() {
+		<-self.slots
+	}()
+
+	return f(ctx)
+}
+
+func (self *rateLimiter) GetQueueFillPct() float64 {
+	return float64(self.queued.Load()) / float64(self.queueSize)
+}
+
+// tryEnqueue reserves a place in the wait queue, returning false if the queue is full
+func (self *rateLimiter) tryEnqueue() bool {
+	for {
+		current := self.queued.Load()
+		if current >= self.queueSize {
+			return false
+		}
+		if self.queued.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+func isClosed(closeNotify <-chan struct{}) bool {
+	select {
+	case <-closeNotify:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,188 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterConfigValidate(t *testing.T) {
+	req := require.New(t)
+	req.Error((&RateLimiterConfig{QueueSize: 0, MaxConcurrent: 1}).Validate())
+	req.Error((&RateLimiterConfig{QueueSize: 1, MaxConcurrent: 0}).Validate())
+	req.NoError((&RateLimiterConfig{QueueSize: 1, MaxConcurrent: 1}).Validate())
+}
+
+func TestRateLimiterLimitsConcurrency(t *testing.T) {
+	req := require.New(t)
+	limiter, err := NewRateLimiter(RateLimiterConfig{QueueSize: 100, MaxConcurrent: 3})
+	req.NoError(err)
+
+	var running, maxRunning atomic.Int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := limiter.RunRateLimited(func() error {
+				current := running.Add(1)
+				for {
+					prev := maxRunning.Load()
+					if current <= prev || maxRunning.CompareAndSwap(prev, current) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+			req.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	req.LessOrEqual(maxRunning.Load(), int32(3))
+	req.Equal(0.0, limiter.GetQueueFillPct())
+}
+
+func TestRateLimiterRejectsWhenQueueFull(t *testing.T) {
+	req := require.New(t)
+	limiter, err := NewRateLimiter(RateLimiterConfig{QueueSize: 2, MaxConcurrent: 1})
+	req.NoError(err)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error, 3)
+
+	go func() {
+		done <- limiter.RunRateLimited(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- limiter.RunRateLimited(func() error { return nil })
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return limiter.GetQueueFillPct() == 1
+	}, time.Second, time.Millisecond)
+
+	err = limiter.RunRateLimited(func() error { return nil })
+	var apiErr *errorz.ApiError
+	req.True(errors.As(err, &apiErr))
+	req.Equal(http.StatusTooManyRequests, apiErr.Status)
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		req.NoError(<-done)
+	}
+	req.Equal(0.0, limiter.GetQueueFillPct())
+}
+
+func TestRateLimiterStopsOnCloseNotify(t *testing.T) {
+	req := require.New(t)
+	closeNotify := make(chan struct{})
+	limiter, err := NewRateLimiter(RateLimiterConfig{QueueSize: 2, MaxConcurrent: 1, CloseNotify: closeNotify})
+	req.NoError(err)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = limiter.RunRateLimited(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	queued := make(chan error, 1)
+	go func() {
+		queued <- limiter.RunRateLimited(func() error { return nil })
+	}()
+
+	require.Eventually(t, func() bool {
+		return limiter.GetQueueFillPct() == 0.5
+	}, time.Second, time.Millisecond)
+
+	close(closeNotify)
+	req.ErrorIs(<-queued, StoppedError)
+	req.ErrorIs(limiter.RunRateLimited(func() error { return nil }), StoppedError)
+	close(release)
+}
+
+func TestRateLimiterCtxDequeuesOnCancel(t *testing.T) {
+	req := require.New(t)
+	limiter, err := NewRateLimiter(RateLimiterConfig{QueueSize: 2, MaxConcurrent: 1})
+	req.NoError(err)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = limiter.RunRateLimited(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var ran atomic.Bool
+	queued := make(chan error, 1)
+	go func() {
+		queued <- limiter.RunRateLimitedCtx(ctx, func(context.Context) error {
+			ran.Store(true)
+			return nil
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		return limiter.GetQueueFillPct() == 0.5
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	req.ErrorIs(<-queued, context.Canceled)
+	req.Equal(0.0, limiter.GetQueueFillPct())
+
+	close(release)
+	req.False(ran.Load())
+
+	type ctxKey struct{}
+	valueCtx := context.WithValue(context.Background(), ctxKey{}, "value")
+	req.NoError(limiter.RunRateLimitedCtx(valueCtx, func(ctx context.Context) error {
+		req.Equal("value", ctx.Value(ctxKey{}))
+		return nil
+	}))
+
+	req.ErrorIs(limiter.RunRateLimitedCtx(ctx, func(context.Context) error { return nil }), context.Canceled)
+}
@@ -23,7 +23,13 @@ import (
 )
 
 func ExampleRateLimiter() {
-	var limiter RateLimiter
+	limiter, err := NewRateLimiter(RateLimiterConfig{
+		QueueSize:     100,
+		MaxConcurrent: 4,
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	// code runs in the context of the rate limiter. There's a strict rate limit
 	limitedFunc := func(limiter RateLimiter, a string) (int, error) {
@@ -44,7 +50,14 @@ func ExampleRateLimiter() {
 }
 
 func ExampleAdaptiveRateLimiter() {
-	var limiter AdaptiveRateLimiter
+	limiter, err := NewAdaptiveRateLimiter(AdaptiveRateLimiterConfig{
+		MinWindow:     10,
+		MaxWindow:     100,
+		MaxConcurrent: 4,
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	// code runs in the context of the rate limiter, the rate limit adapts to successes and back-offs
 	// when things aren't processed quickly enough
@@ -72,7 +85,18 @@ func ExampleAdaptiveRateLimiter() {
 }
 
 func ExampleAdaptiveRateLimitTracker() {
-	var limiter AdaptiveRateLimitTracker
+	closeNotify := make(chan struct{})
+	defer close(closeNotify)
+
+	limiter, err := NewAdaptiveRateLimitTracker(AdaptiveRateLimitTrackerConfig{
+		MinWindow:   10,
+		MaxWindow:   100,
+		Timeout:     time.Second,
+		CloseNotify: closeNotify,
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	// code runs in its own context, the rate limit adapts to successes and back-offs
 	// when things aren't processed quickly enough
@@ -0,0 +1,384 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/pkg/errors"
+)
+
+// A KeyedRateLimiter runs operations through a separate RateLimiter per key, such as per identity or
+// per tenant, so that one busy key can't fill the queue for every other key. Limiters are created on
+// first use of a key and evicted once idle.
+type KeyedRateLimiter interface {
+	RunRateLimited(key string, f func() error) error
+	RunRateLimitedCtx(ctx context.Context, key string, f func(ctx context.Context) error) error
+	KeyedRateLimiterInspector
+}
+
+// A KeyedAdaptiveRateLimiter runs operations through a separate AdaptiveRateLimiter per key. See
+// KeyedRateLimiter.
+type KeyedAdaptiveRateLimiter interface {
+	RunRateLimited(key string, f func() error) (RateLimitControl, error)
+	RunRateLimitedCtx(ctx context.Context, key string, f func(ctx context.Context) error) (RateLimitControl, error)
+	KeyedRateLimiterInspector
+}
+
+// KeyedRateLimiterInspector provides visibility into the keys tracked by a keyed rate limiter
+type KeyedRateLimiterInspector interface {
+	// GetKeyCount returns the number of keys which currently have a limiter
+	GetKeyCount() uint32
+
+	// GetHottestKeys returns stats for up to n keys, ordered by number of requests, highest first
+	GetHottestKeys(n int) []KeyStats
+}
+
+// KeyStats holds the request counts for a single key in a keyed rate limiter. Counts start from zero
+// when a limiter is created for the key, so they reset if the key is evicted and later used again.
+type KeyStats struct {
+	Key string
+	// The number of operations submitted for the key
+	Requests uint64
+	// The number of operations rejected because the key's limiter was too busy
+	Rejected uint64
+	// The number of operations currently queued or running for the key
+	Active uint32
+	// When an operation for the key was last submitted or completed
+	LastUsed time.Time
+}
+
+// KeyedLimiterConfig is used to configure a new KeyedRateLimiter or KeyedAdaptiveRateLimiter
+type KeyedLimiterConfig[L any] struct {
+	// Creates the limiter for a key, the first time the key is used or when it's used again after eviction.
+	// It's called without holding the keyed limiter's lock, so it may be called concurrently for the same
+	// key, in which case only one of the limiters created is kept
+	NewLimiter func(key string) (L, error)
+	// The maximum number of keys which may have a limiter at any given time. When a new key is seen and
+	// the cap has been reached, the least recently used idle key is evicted. If every key is busy, the
+	// operation is rejected with a too many requests ApiError
+	MaxKeys uint32
+	// How long a key may go unused before its limiter is evicted. If zero, keys are only evicted to make
+	// room for new keys
+	IdleTimeout time.Duration
+	// Provides a way to join shutdown of the keyed limiter with other components. Stops idle eviction,
+	// so it's required if IdleTimeout is set
+	CloseNotify <-chan struct{}
+}
+
+func (self *KeyedLimiterConfig[L]) Validate() error {
+	if self.NewLimiter == nil {
+		return fmt.Errorf("new limiter function must be provided")
+	}
+	if self.MaxKeys < 1 {
+		return fmt.Errorf("max keys must be at least 1")
+	}
+	if self.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative, was %v", self.IdleTimeout)
+	}
+	if self.IdleTimeout > 0 && self.CloseNotify == nil {
+		return fmt.Errorf("close notify must be provided when idle timeout is set")
+	}
+	return nil
+}
+
+// NewKeyedRateLimiter returns a KeyedRateLimiter which creates per-key limiters using the configured
+// NewLimiter function, for example one which calls NewRateLimiter. Limiters which also implement
+// ContextRateLimiter are used for RunRateLimitedCtx. Other limiters are given the operation with the
+// context bound, so a context which is done while the operation is queued doesn't remove it.
+func NewKeyedRateLimiter(config KeyedLimiterConfig[RateLimiter]) (KeyedRateLimiter, error) {
+	limiters, err := newKeyedLimiters(config)
+	if err != nil {
+		return nil, err
+	}
+	return &keyedRateLimiter{keyedLimiters: limiters}, nil
+}
+
+// NewKeyedAdaptiveRateLimiter returns a KeyedAdaptiveRateLimiter which creates per-key limiters using the
+// configured NewLimiter function, for example one which calls NewAdaptiveRateLimiter. Limiters which also
+// implement ContextAdaptiveRateLimiter are used for RunRateLimitedCtx. See NewKeyedRateLimiter.
+func NewKeyedAdaptiveRateLimiter(config KeyedLimiterConfig[AdaptiveRateLimiter]) (KeyedAdaptiveRateLimiter, error) {
+	limiters, err := newKeyedLimiters(config)
+	if err != nil {
+		return nil, err
+	}
+	return &keyedAdaptiveRateLimiter{keyedLimiters: limiters}, nil
+}
+
+type keyedRateLimiter struct {
+	*keyedLimiters[RateLimiter]
+}
+
+func (self *keyedRateLimiter) RunRateLimited(key string, f func() error) error {
+	entry, err := self.acquire(key)
+	if err != nil {
+		return err
+	}
+	err = entry.limiter.RunRateLimited(f)
+	self.release(entry, err)
+	return err
+}
+
+func (self *keyedRateLimiter) RunRateLimitedCtx(ctx context.Context, key string, f func(ctx context.Context) error) error {
+	entry, err := self.acquire(key)
+	if err != nil {
+		return err
+	}
+
+	if limiter, ok := entry.limiter.(ContextRateLimiter); ok {
+		err = limiter.RunRateLimitedCtx(ctx, f)
+	} else if err = ctx.Err(); err != nil {
+		err = errors.Wrap(err, "cannot run")
+	} else {
+		err = entry.limiter.RunRateLimited(func() error {
+			return f(ctx)
+		})
+	}
+
+	self.release(entry, err)
+	return err
+}
+
+type keyedAdaptiveRateLimiter struct {
+	*keyedLimiters[AdaptiveRateLimiter]
+}
+
+func (self *keyedAdaptiveRateLimiter) RunRateLimited(key string, f func() error) (RateLimitControl, error) {
+	entry, err := self.acquire(key)
+	if err != nil {
+		return NoOpRateLimitControl(), err
+	}
+	ctrl, err := entry.limiter.RunRateLimited(f)
+	self.release(entry, err)
+	return ctrl, err
+}
+
+func (self *keyedAdaptiveRateLimiter) RunRateLimitedCtx(ctx context.Context, key string, f func(ctx context.Context) error) (RateLimitControl, error) {
+	entry, err := self.acquire(key)
+	if err != nil {
+		return NoOpRateLimitControl(), err
+	}
+
+	var ctrl RateLimitControl
+	if limiter, ok := entry.limiter.(ContextAdaptiveRateLimiter); ok {
+		ctrl, err = limiter.RunRateLimitedCtx(ctx, f)
+	} else if err = ctx.Err(); err != nil {
+		ctrl, err = NoOpRateLimitControl(), errors.Wrap(err, "cannot run")
+	} else {
+		ctrl, err = entry.limiter.RunRateLimited(func() error {
+			return f(ctx)
+		})
+	}
+
+	self.release(entry, err)
+	return ctrl, err
+}
+
+type keyedEntry[L any] struct {
+	key      string
+	limiter  L
+	element  *list.Element
+	active   uint32
+	requests uint64
+	rejected uint64
+	lastUsed time.Time
+}
+
+// keyedLimiters holds the per-key limiters in a map, with a list ordered by lastUsed, most recent first,
+// so that the least recently used idle key can be found for eviction. All entry state is guarded by lock.
+type keyedLimiters[L any] struct {
+	lock        sync.Mutex
+	newLimiter  func(key string) (L, error)
+	maxKeys     int
+	idleTimeout time.Duration
+	entries     map[string]*keyedEntry[L]
+	lru         *list.List
+	closeNotify <-chan struct{}
+}
+
+func newKeyedLimiters[L any](config KeyedLimiterConfig[L]) (*keyedLimiters[L], error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	result := &keyedLimiters[L]{
+		newLimiter:  config.NewLimiter,
+		maxKeys:     int(config.MaxKeys),
+		idleTimeout: config.IdleTimeout,
+		entries:     map[string]*keyedEntry[L]{},
+		lru:         list.New(),
+		closeNotify: config.CloseNotify,
+	}
+
+	if result.idleTimeout > 0 {
+		go result.run()
+	}
+
+	return result, nil
+}
+
+func (self *keyedLimiters[L]) acquire(key string) (*keyedEntry[L], error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entry, found := self.entries[key]
+	if found {
+		self.lru.MoveToFront(entry.element)
+	} else {
+		if len(self.entries) >= self.maxKeys && !self.evictLeastRecentlyUsedLocked() {
+			return nil, errorz.NewTooManyRequests()
+		}
+
+		// create the limiter without holding the lock, so a slow NewLimiter doesn't hold up other keys
+		self.lock.Unlock()
+		limiter, err := self.newLimiter(key)
+		self.lock.Lock()
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to create rate limiter for key %v", key)
+		}
+
+		// another caller may have added the key, or filled the free slot, while the lock was released
+		if entry, found = self.entries[key]; found {
+			self.lru.MoveToFront(entry.element)
+		} else {
+			if len(self.entries) >= self.maxKeys && !self.evictLeastRecentlyUsedLocked() {
+				return nil, errorz.NewTooManyRequests()
+			}
+			entry = &keyedEntry[L]{
+				key:     key,
+				limiter: limiter,
+			}
+			entry.element = self.lru.PushFront(entry)
+			self.entries[key] = entry
+		}
+	}
+
+	entry.active++
+	entry.requests++
+	entry.lastUsed = time.Now()
+
+	return entry, nil
+}
+
+func (self *keyedLimiters[L]) release(entry *keyedEntry[L], err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entry.active--
+	entry.lastUsed = time.Now()
+
+	// entries with active operations are never evicted, so the entry is still in the list
+	self.lru.MoveToFront(entry.element)
+
+	var apiErr *errorz.ApiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusTooManyRequests {
+		entry.rejected++
+	}
+}
+
+// evictLeastRecentlyUsedLocked removes the least recently used key which has no active operations,
+// returning false if every key is busy. The caller must hold lock.
+func (self *keyedLimiters[L]) evictLeastRecentlyUsedLocked() bool {
+	for element := self.lru.Back(); element != nil; element = element.Prev() {
+		if entry := element.Value.(*keyedEntry[L]); entry.active == 0 {
+			self.removeLocked(entry)
+			return true
+		}
+	}
+	return false
+}
+
+func (self *keyedLimiters[L]) removeLocked(entry *keyedEntry[L]) {
+	self.lru.Remove(entry.element)
+	delete(self.entries, entry.key)
+}
+
+func (self *keyedLimiters[L]) run() {
+	ticker := time.NewTicker(self.idleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			self.evictIdle()
+		case <-self.closeNotify:
+			return
+		}
+	}
+}
+
+// evictIdle removes keys which have no active operations and haven't been used within the idle timeout.
+// Since the list is ordered by most recent use, it can stop at the first key used within the timeout.
+func (self *keyedLimiters[L]) evictIdle() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	element := self.lru.Back()
+	for element != nil {
+		entry := element.Value.(*keyedEntry[L])
+		element = element.Prev()
+
+		if time.Since(entry.lastUsed) < self.idleTimeout {
+			return
+		}
+
+		if entry.active == 0 {
+			self.removeLocked(entry)
+		}
+	}
+}
+
+func (self *keyedLimiters[L]) GetKeyCount() uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return uint32(len(self.entries))
+}
+
+func (self *keyedLimiters[L]) GetHottestKeys(n int) []KeyStats {
+	self.lock.Lock()
+	result := make([]KeyStats, 0, len(self.entries))
+	for _, entry := range self.entries {
+		result = append(result, KeyStats{
+			Key:      entry.key,
+			Requests: entry.requests,
+			Rejected: entry.rejected,
+			Active:   entry.active,
+			LastUsed: entry.lastUsed,
+		})
+	}
+	self.lock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	if n >= 0 && n < len(result) {
+		result = result[:n]
+	}
+	return result
+}
@@ -0,0 +1,291 @@
+/*
+	Copyright NetFoundry Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package rate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/v2/errorz"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKeyedRateLimiter(t *testing.T, maxKeys uint32, idleTimeout time.Duration) KeyedRateLimiter {
+	closeNotify := make(chan struct{})
+	t.Cleanup(func() { close(closeNotify) })
+
+	limiter, err := NewKeyedRateLimiter(KeyedLimiterConfig[RateLimiter]{
+		NewLimiter: func(string) (RateLimiter, error) {
+			return NewRateLimiter(RateLimiterConfig{QueueSize: 1, MaxConcurrent: 1})
+		},
+		MaxKeys:     maxKeys,
+		IdleTimeout: idleTimeout,
+		CloseNotify: closeNotify,
+	})
+	require.NoError(t, err)
+	return limiter
+}
+
+func TestKeyedLimiterConfigValidate(t *testing.T) {
+	req := require.New(t)
+	newLimiter := func(string) (RateLimiter, error) { return NoOpRateLimiter{}, nil }
+	req.Error((&KeyedLimiterConfig[RateLimiter]{MaxKeys: 1}).Validate())
+	req.Error((&KeyedLimiterConfig[RateLimiter]{NewLimiter: newLimiter}).Validate())
+	req.Error((&KeyedLimiterConfig[RateLimiter]{NewLimiter: newLimiter, MaxKeys: 1, IdleTimeout: -time.Second}).Validate())
+	req.Error((&KeyedLimiterConfig[RateLimiter]{NewLimiter: newLimiter, MaxKeys: 1, IdleTimeout: time.Second}).Validate(),
+		"idle eviction needs a close notify to stop it")
+	req.NoError((&KeyedLimiterConfig[RateLimiter]{NewLimiter: newLimiter, MaxKeys: 1}).Validate())
+	req.NoError((&KeyedLimiterConfig[RateLimiter]{NewLimiter: newLimiter, MaxKeys: 1, IdleTimeout: time.Second, CloseNotify: make(chan struct{})}).Validate())
+}
+
+func TestKeyedRateLimiterCreatesLimitersOutsideLock(t *testing.T) {
+	req := require.New(t)
+	creating := make(chan struct{})
+	release := make(chan struct{})
+
+	limiter, err := NewKeyedRateLimiter(KeyedLimiterConfig[RateLimiter]{
+		NewLimiter: func(key string) (RateLimiter, error) {
+			if key == "slow" {
+				close(creating)
+				<-release
+			}
+			return NoOpRateLimiter{}, nil
+		},
+		MaxKeys: 10,
+	})
+	req.NoError(err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.RunRateLimited("slow", func() error { return nil })
+	}()
+	<-creating
+
+	req.NoError(limiter.RunRateLimited("fast", func() error { return nil }), "other keys shouldn't wait on a slow NewLimiter")
+	req.Equal(uint32(1), limiter.GetKeyCount())
+
+	close(release)
+	req.NoError(<-done)
+	req.Equal(uint32(2), limiter.GetKeyCount())
+}
+
+func TestKeyedRateLimiterIsolatesKeys(t *testing.T) {
+	req := require.New(t)
+	limiter := newTestKeyedRateLimiter(t, 10, 0)
+
+	// fill up the limiter for the noisy key: one running, one queued
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		done <- limiter.RunRateLimited("noisy", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	go func() {
+		done <- limiter.RunRateLimited("noisy", func() error { return nil })
+	}()
+
+	require.Eventually(t, func() bool {
+		stats := limiter.GetHottestKeys(1)
+		return len(stats) == 1 && stats[0].Active == 2
+	}, time.Second, time.Millisecond)
+
+	err := limiter.RunRateLimited("noisy", func() error { return nil })
+	var apiErr *errorz.ApiError
+	req.True(errors.As(err, &apiErr))
+	req.Equal(http.StatusTooManyRequests, apiErr.Status)
+
+	// other keys are unaffected
+	req.NoError(limiter.RunRateLimited("quiet", func() error { return nil }))
+
+	close(release)
+	req.NoError(<-done)
+	req.NoError(<-done)
+
+	stats := limiter.GetHottestKeys(-1)
+	req.Len(stats, 2)
+	req.Equal("noisy", stats[0].Key)
+	req.Equal(uint64(3), stats[0].Requests)
+	req.Equal(uint64(1), stats[0].Rejected)
+	req.Equal(uint32(0), stats[0].Active)
+	req.Equal("quiet", stats[1].Key)
+	req.Equal(uint64(1), stats[1].Requests)
+}
+
+func TestKeyedRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	req := require.New(t)
+	limiter := newTestKeyedRateLimiter(t, 2, 0)
+
+	req.NoError(limiter.RunRateLimited("a", func() error { return nil }))
+	req.NoError(limiter.RunRateLimited("b", func() error { return nil }))
+	req.NoError(limiter.RunRateLimited("a", func() error { return nil }))
+	req.NoError(limiter.RunRateLimited("c", func() error { return nil }))
+
+	req.Equal(uint32(2), limiter.GetKeyCount())
+	var keys []string
+	for _, stat := range limiter.GetHottestKeys(10) {
+		keys = append(keys, stat.Key)
+	}
+	req.Equal([]string{"a", "c"}, keys)
+
+	// busy keys are never evicted, so if every key is busy new keys are rejected
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	for _, key := range []string{"a", "c"} {
+		go func() {
+			_ = limiter.RunRateLimited(key, func() error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+	<-started
+	<-started
+
+	err := limiter.RunRateLimited("d", func() error { return nil })
+	var apiErr *errorz.ApiError
+	req.True(errors.As(err, &apiErr))
+	close(release)
+}
+
+func TestKeyedRateLimiterEvictsIdleKeys(t *testing.T) {
+	req := require.New(t)
+	limiter := newTestKeyedRateLimiter(t, 10, 20*time.Millisecond)
+
+	req.NoError(limiter.RunRateLimited("a", func() error { return nil }))
+	req.Equal(uint32(1), limiter.GetKeyCount())
+
+	require.Eventually(t, func() bool {
+		return limiter.GetKeyCount() == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestKeyedAdaptiveRateLimiter(t *testing.T) {
+	req := require.New(t)
+	limiter, err := NewKeyedAdaptiveRateLimiter(KeyedLimiterConfig[AdaptiveRateLimiter]{
+		NewLimiter: func(string) (AdaptiveRateLimiter, error) {
+			return NewAdaptiveRateLimiter(AdaptiveRateLimiterConfig{MinWindow: 1, MaxWindow: 10, MaxConcurrent: 1})
+		},
+		MaxKeys: 10,
+	})
+	req.NoError(err)
+
+	ctrl, err := limiter.RunRateLimited("a", func() error { return nil })
+	req.NoError(err)
+	ctrl.Success()
+
+	stats := limiter.GetHottestKeys(1)
+	req.Len(stats, 1)
+	req.Equal("a", stats[0].Key)
+	req.Equal(uint64(1), stats[0].Requests)
+}
+
+// baseRateLimiter only implements the RateLimiter interface, without the context aware variant
+type baseRateLimiter struct {
+	runs int
+}
+
+func (self *baseRateLimiter) RunRateLimited(f func() error) error {
+	self.runs++
+	return f()
+}
+
+func (self *baseRateLimiter) GetQueueFillPct() float64 {
+	return 0
+}
+
+// baseAdaptiveRateLimiter only implements the AdaptiveRateLimiter interface
+type baseAdaptiveRateLimiter struct {
+	runs int
+}
+
+func (self *baseAdaptiveRateLimiter) RunRateLimited(f func() error) (RateLimitControl, error) {
+	self.runs++
+	return NoOpRateLimitControl(), f()
+}
+
+func TestKeyedRateLimiterWithBaseLimiters(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("rate limiter", func(t *testing.T) {
+		req := require.New(t)
+		base := &baseRateLimiter{}
+		limiter, err := NewKeyedRateLimiter(KeyedLimiterConfig[RateLimiter]{
+			NewLimiter: func(string) (RateLimiter, error) {
+				return base, nil
+			},
+			MaxKeys: 10,
+		})
+		req.NoError(err)
+
+		req.NoError(limiter.RunRateLimited("a", func() error { return nil }))
+		req.NoError(limiter.RunRateLimitedCtx(ctx, "a", func(ctx context.Context) error {
+			req.Equal("value", ctx.Value(ctxKey{}), "the context should be passed to the operation")
+			return nil
+		}))
+		req.Equal(2, base.runs)
+
+		err = limiter.RunRateLimitedCtx(cancelled, "a", func(context.Context) error {
+			req.Fail("operation shouldn't run once its context is done")
+			return nil
+		})
+		req.ErrorIs(err, context.Canceled)
+		req.Equal(2, base.runs)
+		req.Equal(uint32(0), limiter.GetHottestKeys(1)[0].Active)
+	})
+
+	t.Run("adaptive rate limiter", func(t *testing.T) {
+		req := require.New(t)
+		base := &baseAdaptiveRateLimiter{}
+		limiter, err := NewKeyedAdaptiveRateLimiter(KeyedLimiterConfig[AdaptiveRateLimiter]{
+			NewLimiter: func(string) (AdaptiveRateLimiter, error) {
+				return base, nil
+			},
+			MaxKeys: 10,
+		})
+		req.NoError(err)
+
+		_, err = limiter.RunRateLimited("a", func() error { return nil })
+		req.NoError(err)
+		ctrl, err := limiter.RunRateLimitedCtx(ctx, "a", func(ctx context.Context) error {
+			req.Equal("value", ctx.Value(ctxKey{}), "the context should be passed to the operation")
+			return nil
+		})
+		req.NoError(err)
+		req.NotNil(ctrl)
+		req.Equal(2, base.runs)
+
+		ctrl, err = limiter.RunRateLimitedCtx(cancelled, "a", func(context.Context) error {
+			req.Fail("operation shouldn't run once its context is done")
+			return nil
+		})
+		req.ErrorIs(err, context.Canceled)
+		req.NotNil(ctrl)
+		req.Equal(2, base.runs)
+	})
+}
@@ -16,6 +16,8 @@
 
 package rate
 
+import "context"
+
 // A RateLimiter allows running arbitrary, sequential operations with a limiter, so that only N operations
 // can be queued to run at any given time. If the system is too busy, the rate limiter will return
 // an ApiError indicating that the server is too busy
@@ -24,6 +26,16 @@ type RateLimiter interface {
 	GetQueueFillPct() float64
 }
 
+// A ContextRateLimiter is a RateLimiter which can also run context-aware operations.
+//
+// RunRateLimitedCtx works like RunRateLimited, except that if the context is done while the operation
+// is waiting to run, the operation is removed from the queue and the context's error is returned. The
+// context is passed through to the operation.
+type ContextRateLimiter interface {
+	RateLimiter
+	RunRateLimitedCtx(ctx context.Context, f func(ctx context.Context) error) error
+}
+
 // An AdaptiveRateLimiter allows running arbitrary, sequential operations with a limiter, so that only N operations
 // can be queued to run at any given time. If the system is too busy, the rate limiter will return
 // an ApiError indicating that the server is too busy.
@@ -45,6 +57,16 @@ type AdaptiveRateLimiter interface {
 	RunRateLimited(f func() error) (RateLimitControl, error)
 }
 
+// A ContextAdaptiveRateLimiter is an AdaptiveRateLimiter which can also run context-aware operations.
+//
+// RunRateLimitedCtx works like RunRateLimited, except that if the context is done while the operation
+// is waiting to run, the operation is removed from the queue and the context's error is returned. The
+// context is passed through to the operation.
+type ContextAdaptiveRateLimiter interface {
+	AdaptiveRateLimiter
+	RunRateLimitedCtx(ctx context.Context, f func(ctx context.Context) error) (RateLimitControl, error)
+}
+
 // An AdaptiveRateLimitTracker works similarly to an AdaptiveRateLimiter, except it just manages the rate
 // limiting without actually running the work. Because it doesn't run the work itself, it has to account
 // for the possibility that some work may never report as complete or failed. It thus has a configurable
@@ -55,12 +77,32 @@ type AdaptiveRateLimitTracker interface {
 	IsRateLimited() bool
 }
 
+// A ContextAdaptiveRateLimitTracker is an AdaptiveRateLimitTracker which can also track context-aware work.
+//
+// The context accepting variants reject work if the context is already done. If the context is done
+// while the work is outstanding, the work is marked as failed, freeing its place in the window.
+type ContextAdaptiveRateLimitTracker interface {
+	AdaptiveRateLimitTracker
+	RunRateLimitedCtx(ctx context.Context, label string) (RateLimitControl, error)
+	RunRateLimitedFCtx(ctx context.Context, label string, f func(ctx context.Context, control RateLimitControl) error) error
+}
+
+// AdaptiveRateLimitTrackerInspector provides visibility into the work tracked by an AdaptiveRateLimitTracker
+type AdaptiveRateLimitTrackerInspector interface {
+	// GetStats returns a snapshot of the tracker's window and per-label outcome counts
+	GetStats() AdaptiveRateLimitTrackerStats
+}
+
 type NoOpRateLimiter struct{}
 
 func (self NoOpRateLimiter) RunRateLimited(f func() error) error {
 	return f()
 }
 
+func (self NoOpRateLimiter) RunRateLimitedCtx(ctx context.Context, f func(ctx context.Context) error) error {
+	return f(ctx)
+}
+
 func (self NoOpRateLimiter) GetQueueFillPct() float64 {
 	return 0
 }
@@ -71,20 +113,36 @@ func (self NoOpAdaptiveRateLimiter) RunRateLimited(f func() error) (RateLimitCon
 	return noOpRateLimitControl{}, f()
 }
 
+func (self NoOpAdaptiveRateLimiter) RunRateLimitedCtx(ctx context.Context, f func(ctx context.Context) error) (RateLimitControl, error) {
+	return noOpRateLimitControl{}, f(ctx)
+}
+
 type NoOpAdaptiveRateLimitTracker struct{}
 
 func (n NoOpAdaptiveRateLimitTracker) RunRateLimited(string) (RateLimitControl, error) {
 	return noOpRateLimitControl{}, nil
 }
 
+func (n NoOpAdaptiveRateLimitTracker) RunRateLimitedCtx(context.Context, string) (RateLimitControl, error) {
+	return noOpRateLimitControl{}, nil
+}
+
 func (n NoOpAdaptiveRateLimitTracker) RunRateLimitedF(_ string, f func(control RateLimitControl) error) error {
 	return f(noOpRateLimitControl{})
 }
 
+func (n NoOpAdaptiveRateLimitTracker) RunRateLimitedFCtx(ctx context.Context, _ string, f func(ctx context.Context, control RateLimitControl) error) error {
+	return f(ctx, noOpRateLimitControl{})
+}
+
 func (n NoOpAdaptiveRateLimitTracker) IsRateLimited() bool {
 	return false
 }
 
+func (n NoOpAdaptiveRateLimitTracker) GetStats() AdaptiveRateLimitTrackerStats {
+	return AdaptiveRateLimitTrackerStats{}
+}
+
 type RateLimitControl interface {
 	// Success indicates the operation was a success
 	Success()